@@ -2,13 +2,17 @@ package app
 
 import (
 	"bytes"
-	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/Deewai/finleap/cache"
 	"github.com/Deewai/finleap/model"
 	"log"
+	"mime"
 	"net/http"
-	"sync"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -42,44 +46,120 @@ func AddMockups(m mock) {
 }
 
 type App struct {
-	Router   *mux.Router
-	DB       *sql.DB
-	Webhooks struct {
-		lock     sync.Mutex
-		Webhooks []*model.Webhook
-	}
-	webhookChan    chan webhookAction
+	Router *mux.Router
+	Store  model.Store
+	// TimestampSkew is how far in the future a client supplied measurement
+	// time may be, 5 minutes when zero. TimestampMaxAge is how far in the
+	// past it may be, unlimited when zero.
+	TimestampSkew   time.Duration
+	TimestampMaxAge time.Duration
+	// ForecastCache holds computed forecasts for ForecastCacheTTL, an
+	// in-process LRU when nil. The TTL is a minute when zero.
+	ForecastCache    cache.Backend
+	ForecastCacheTTL time.Duration
+	forecasts        *forecastCache
+	// WebhookMaxAttempts is how many times a webhook delivery is attempted,
+	// 5 when zero. A retry waits WebhookRetryDelay, doubled after every
+	// failed attempt up to WebhookMaxRetryDelay, 1s and 1m when zero.
+	WebhookMaxAttempts   int
+	WebhookRetryDelay    time.Duration
+	WebhookMaxRetryDelay time.Duration
+	// WebhookWorkers deliver webhooks concurrently, at most
+	// WebhookWorkersPerHost of them to the same host, 10 and 2 when zero.
+	// Up to WebhookQueueSize deliveries wait for a worker, 1000 when zero,
+	// and WebhookBackpressure decides what happens when the queue is full.
+	// Every delivery request times out after WebhookTimeout, 10s when zero.
+	WebhookWorkers        int
+	WebhookWorkersPerHost int
+	WebhookQueueSize      int
+	WebhookBackpressure   BackpressurePolicy
+	WebhookTimeout        time.Duration
+	// WebhookSecretOverlap is how long the replaced secret of a webhook still
+	// signs its deliveries when none is asked for, 24h when zero
+	WebhookSecretOverlap time.Duration
+	// WebhookDeliveryRetention is how long delivery attempts are logged,
+	// 7 days when zero
+	WebhookDeliveryRetention time.Duration
+	client                   *http.Client
+	deliveries               *deliveryPool
+	// sleep waits between delivery attempts, time.Sleep when nil
+	sleep          func(time.Duration)
 	newTemperature chan model.Temperature
 }
 
 type Error struct {
-	Code  int    `json:"code"`
+	Code   int          `json:"code"`
+	Error  string       `json:"error"`
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError describes why one field of a request payload is invalid
+type FieldError struct {
+	Field string `json:"field"`
 	Error string `json:"error"`
 }
 
-func (a *App) Initialize(host, port, user, password, dbname string) {
-	db, err := model.NewConn("mysql", host, port, user, password, dbname)
+// Initialize opens the database at dsn with driver ("mysql", "sqlite" or "postgres"),
+// applies pending migrations and sets up the application on top of it
+func (a *App) Initialize(driver, dsn string) {
+	db, err := model.Open(driver, dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	migrator, err := model.NewMigrator(db, driver)
+	if err != nil {
+		log.Fatal(err)
+	}
+	migrations, err := migrator.Up()
 	if err != nil {
 		log.Fatal(err)
 	}
-	a.DB = db
-	a.webhookChan = make(chan webhookAction)
-	a.newTemperature = make(chan model.Temperature)
-	go a.webhookStoreRoutine()
-	go a.webhookRoutine()
-	a.restoreWebhooks()
+	for _, migration := range migrations {
+		log.Printf("applied migration %d_%s", migration.Version, migration.Name)
+	}
+	store, err := model.NewSQLStore(db, driver)
+	if err != nil {
+		log.Fatal(err)
+	}
+	a.setup(store)
+}
+
+func (a *App) setup(store model.Store) {
+	a.Store = store
+	a.forecasts = newForecastCache(a.ForecastCache, a.ForecastCacheTTL)
+	// a wake up is kept while webhookRoutine is busy
+	a.newTemperature = make(chan model.Temperature, 1)
+	timeout := a.WebhookTimeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	a.client = &http.Client{Timeout: timeout}
+	a.startDeliveries()
+	go a.pruneDeliveriesRoutine()
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
 }
 
 func (a *App) initializeRoutes() {
 	a.Router.HandleFunc("/cities", a.handleCreateCities).Methods("POST")
+	a.Router.HandleFunc("/cities", a.handleListCities).Methods("GET")
+	a.Router.HandleFunc("/cities/nearby", a.handleNearbyCities).Methods("GET")
+	a.Router.HandleFunc("/cities/{id}", a.handleGetCities).Methods("GET")
 	a.Router.HandleFunc("/cities/{id}", a.handleUpdateCities).Methods("PATCH")
+	a.Router.HandleFunc("/cities/{id}", a.handleReplaceCities).Methods("PUT")
 	a.Router.HandleFunc("/cities/{id}", a.handleDeleteCities).Methods("DELETE")
+	a.Router.HandleFunc("/cities/{id}/restore", a.handleRestoreCities).Methods("POST")
+	a.Router.HandleFunc("/cities/{id}/temperatures", a.handleListTemperatures).Methods("GET")
+	a.Router.HandleFunc("/cities/{id}/temperatures/rollup", a.handleTemperatureRollup).Methods("GET")
 	a.Router.HandleFunc("/temperatures", a.handleCreateTemperature).Methods("POST")
+	a.Router.HandleFunc("/temperatures/batch", a.handleCreateTemperatureBatch).Methods("POST")
+	a.Router.HandleFunc("/forecasts", a.handleForecasts).Methods("GET")
+	a.Router.HandleFunc("/forecasts/cache", a.handleForecastCache).Methods("GET")
 	a.Router.HandleFunc("/forecasts/{city_id}", a.handleForecast).Methods("GET")
 	a.Router.HandleFunc("/webhooks", a.handleCreateWebhook).Methods("POST")
 	a.Router.HandleFunc("/webhooks/{id}", a.handleDeleteWebhook).Methods("DELETE")
+	a.Router.HandleFunc("/webhooks/{id}/secret", a.handleRotateWebhookSecret).Methods("POST")
+	a.Router.HandleFunc("/webhooks/{id}/deliveries", a.handleListDeliveries).Methods("GET")
 }
 
 func (a *App) Run(addr string) {
@@ -95,13 +175,60 @@ func respondWithError(w http.ResponseWriter, e Error) {
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
-	response, _ := json.Marshal(payload)
+	response, err := json.Marshal(payload)
+	if err != nil {
+		// an empty body would pass for a success, report the failure instead
+		log.Printf("failed to marshal %T response: %v", payload, err)
+		code = http.StatusInternalServerError
+		response, _ = json.Marshal(Error{Code: code, Error: fmt.Sprintf("Failed to encode response: %v", err)})
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
 	w.Write(response)
 }
 
-func (a *App) sendRequest(url string, payload []byte) (*http.Response, error) {
+// negotiate returns the offered media type the Accept header of r prefers,
+// or the first offer when none is acceptable
+func negotiate(r *http.Request, offers ...string) string {
+	best, bestQuality := offers[0], 0.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accepted)
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		for _, offer := range offers {
+			matches := mediaType == offer || mediaType == "*/*" ||
+				(strings.HasSuffix(mediaType, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediaType, "*")))
+			if matches && quality > bestQuality {
+				best, bestQuality = offer, quality
+			}
+		}
+	}
+	return best
+}
+
+// responseUnit returns the unit temperatures are returned in: the unit query
+// parameter, else the unit parameter of the Accept header as in
+// "application/json; unit=F", else Celsius
+func responseUnit(r *http.Request) (model.Unit, error) {
+	if value := r.URL.Query().Get("unit"); value != "" {
+		return model.ParseUnit(value)
+	}
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		if _, params, err := mime.ParseMediaType(accepted); err == nil && params["unit"] != "" {
+			return model.ParseUnit(params["unit"])
+		}
+	}
+	return model.Celsius, nil
+}
+
+func (a *App) sendRequest(url string, payload []byte, header http.Header) (*http.Response, error) {
 	if enableMocks {
 		mock := mocks[url]
 		if mock == nil {
@@ -109,7 +236,19 @@ func (a *App) sendRequest(url string, payload []byte) (*http.Response, error) {
 		}
 		return mock.response, mock.err
 	}
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(payload))
+	client := a.client
+	if client == nil {
+		client = &http.Client{Timeout: defaultWebhookTimeout}
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
 	if err != nil {
 		return resp, err
 	}
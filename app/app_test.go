@@ -3,7 +3,9 @@ package app
 import (
 	"encoding/json"
 	"errors"
+	"math"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 
@@ -27,7 +29,7 @@ func TestApp_sendRequestErrorGotten(t *testing.T) {
 	})
 	a := &App{}
 	payload, _ := json.Marshal(map[string]string{"test": "test"})
-	resp, err := a.sendRequest("https://my.service.com/high-temperature", payload)
+	resp, err := a.sendRequest("https://my.service.com/high-temperature", payload, nil)
 	assert.Nil(t, resp)
 	assert.NotNil(t, err)
 	assert.EqualError(t, err, "invalid response")
@@ -42,8 +44,18 @@ func TestApp_sendRequestSuccessfulRequest(t *testing.T) {
 	})
 	a := &App{}
 	payload, _ := json.Marshal(map[string]string{"test": "test"})
-	resp, err := a.sendRequest("https://my.service.com/high-temperature", payload)
+	resp, err := a.sendRequest("https://my.service.com/high-temperature", payload, nil)
 	assert.Nil(t, resp)
 	assert.NotNil(t, err)
 
 }
+
+func TestRespondWithJSONMarshalError(t *testing.T) {
+	rr := httptest.NewRecorder()
+	respondWithJSON(rr, http.StatusOK, map[string]float64{"max": math.NaN()})
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	var e Error
+	assert.Nil(t, json.Unmarshal(rr.Body.Bytes(), &e))
+	assert.Equal(t, http.StatusInternalServerError, e.Code)
+	assert.Contains(t, e.Error, "Failed to encode response")
+}
@@ -0,0 +1,129 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Deewai/finleap/cache"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultForecastCacheTTL  = time.Minute
+	defaultForecastCacheSize = 10000
+)
+
+// forecastCache caches the forecasts of each city. The entries of a city are
+// keyed by a generation token which a new reading replaces, invalidating
+// every cached window of the city at once without listing them.
+type forecastCache struct {
+	backend cache.Backend
+	ttl     time.Duration
+	hits    int64
+	misses  int64
+}
+
+// cacheStats are the counters of the forecast cache
+type cacheStats struct {
+	Hits   int64  `json:"hits"`
+	Misses int64  `json:"misses"`
+	TTL    string `json:"ttl"`
+}
+
+// newForecastCache returns a forecastCache on backend, an in-process LRU
+// when it is nil. Entries expire after ttl, a minute when zero.
+func newForecastCache(backend cache.Backend, ttl time.Duration) *forecastCache {
+	if backend == nil {
+		backend = cache.NewLRU(defaultForecastCacheSize)
+	}
+	if ttl == 0 {
+		ttl = defaultForecastCacheTTL
+	}
+	return &forecastCache{backend: backend, ttl: ttl}
+}
+
+func generationKey(cityID int) string {
+	return fmt.Sprintf("forecast:%d:generation", cityID)
+}
+
+var generations int64
+
+// newGeneration returns a token not drawn before by this instance, and
+// unlikely to be drawn by another one sharing the backend
+func newGeneration() []byte {
+	n := atomic.AddInt64(&generations, 1)
+	return []byte(strconv.FormatInt(time.Now().UnixNano(), 36) + "." + strconv.FormatInt(n, 36))
+}
+
+// get reads the forecast of cityID cached under key into dest. On a miss it
+// returns the entry the computed forecast is to be set under. The entry is
+// fixed before the forecast is computed, so a reading stored in between
+// invalidates it.
+func (c *forecastCache) get(cityID int, key string, dest interface{}) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	generation, ok, err := c.backend.Get(generationKey(cityID))
+	if err == nil && !ok {
+		generation = newGeneration()
+		err = c.backend.Set(generationKey(cityID), generation, 0)
+	}
+	if err != nil {
+		log.Printf("forecast cache: %v", err)
+		atomic.AddInt64(&c.misses, 1)
+		return "", false
+	}
+	entry := fmt.Sprintf("forecast:%d:%s:%s", cityID, generation, key)
+	value, ok, err := c.backend.Get(entry)
+	if err == nil && ok {
+		err = json.Unmarshal(value, dest)
+	}
+	if err != nil || !ok {
+		if err != nil {
+			log.Printf("forecast cache: %v", err)
+		}
+		atomic.AddInt64(&c.misses, 1)
+		return entry, false
+	}
+	atomic.AddInt64(&c.hits, 1)
+	return entry, true
+}
+
+// set caches value under the entry returned by get
+func (c *forecastCache) set(entry string, value interface{}) {
+	if c == nil || entry == "" {
+		return
+	}
+	data, err := json.Marshal(value)
+	if err == nil {
+		err = c.backend.Set(entry, data, c.ttl)
+	}
+	if err != nil {
+		log.Printf("forecast cache: %v", err)
+	}
+}
+
+// invalidate drops the cached forecasts of cityID
+func (c *forecastCache) invalidate(cityID int) {
+	if c == nil {
+		return
+	}
+	if err := c.backend.Set(generationKey(cityID), newGeneration(), 0); err != nil {
+		log.Printf("forecast cache: %v", err)
+	}
+}
+
+func (c *forecastCache) stats() cacheStats {
+	if c == nil {
+		return cacheStats{}
+	}
+	return cacheStats{Hits: atomic.LoadInt64(&c.hits), Misses: atomic.LoadInt64(&c.misses), TTL: c.ttl.String()}
+}
+
+//handler for "/forecasts/cache" GET endpoint
+func (a *App) handleForecastCache(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, a.forecasts.stats())
+}
@@ -0,0 +1,141 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/Deewai/finleap/model"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingBackend is a cache backend that is down
+type failingBackend struct{}
+
+func (failingBackend) Get(key string) ([]byte, bool, error) {
+	return nil, false, errors.New("connection refused")
+}
+
+func (failingBackend) Set(key string, value []byte, ttl time.Duration) error {
+	return errors.New("connection refused")
+}
+
+func (failingBackend) Delete(keys ...string) error {
+	return errors.New("connection refused")
+}
+
+func TestForecastCache(t *testing.T) {
+	c := newForecastCache(nil, 0)
+	var forecast model.Forecast
+	entry, ok := c.get(1, "24h:mean", &forecast)
+	assert.False(t, ok)
+	c.set(entry, model.Forecast{CityID: 1, Max: 25, Min: 7.5, Sample: 2})
+	_, ok = c.get(1, "24h:mean", &forecast)
+	assert.True(t, ok)
+	assert.Equal(t, model.Forecast{CityID: 1, Max: 25, Min: 7.5, Sample: 2}, forecast)
+
+	// invalidating a city leaves the others cached
+	other, _ := c.get(2, "24h:mean", &forecast)
+	c.set(other, model.Forecast{CityID: 2})
+	c.invalidate(1)
+	_, ok = c.get(1, "24h:mean", &forecast)
+	assert.False(t, ok)
+	_, ok = c.get(2, "24h:mean", &forecast)
+	assert.True(t, ok)
+	assert.Equal(t, cacheStats{Hits: 2, Misses: 3, TTL: "1m0s"}, c.stats())
+
+	// a forecast computed before an invalidation isn't served after it
+	entry, _ = c.get(2, "7d:mean", &forecast)
+	c.invalidate(2)
+	c.set(entry, model.Forecast{CityID: 2, Sample: 1})
+	_, ok = c.get(2, "7d:mean", &forecast)
+	assert.False(t, ok)
+}
+
+func TestForecastCacheBackendDown(t *testing.T) {
+	c := newForecastCache(failingBackend{}, time.Minute)
+	var forecast model.Forecast
+	entry, ok := c.get(1, "24h:mean", &forecast)
+	assert.False(t, ok)
+	c.set(entry, model.Forecast{CityID: 1})
+	c.invalidate(1)
+	assert.Equal(t, int64(1), c.stats().Misses)
+
+	var disabled *forecastCache
+	_, ok = disabled.get(1, "24h:mean", &forecast)
+	assert.False(t, ok)
+	assert.Equal(t, cacheStats{}, disabled.stats())
+}
+
+func TestHandleForecastCached(t *testing.T) {
+	store := model.NewMemoryStore()
+	store.CreateCity(&model.City{Name: "Berlin"})
+	a := App{}
+	a.Store = store
+	a.forecasts = newForecastCache(nil, 0)
+	a.newTemperature = make(chan model.Temperature, 2)
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	forecast := func() model.Forecast {
+		req, _ := http.NewRequest("GET", "/forecasts/1", nil)
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		var f model.Forecast
+		json.Unmarshal(rr.Body.Bytes(), &f)
+		return f
+	}
+	assert.Equal(t, 0, forecast().Sample)
+	assert.Equal(t, 0, forecast().Sample)
+
+	// a new reading invalidates the cached forecast
+	body, _ := json.Marshal(map[string]interface{}{"city_id": 1, "max": 30, "min": 10})
+	req, _ := http.NewRequest("POST", "/temperatures", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, model.Forecast{CityID: 1, Max: 30, Min: 10, Unit: model.Celsius, Sample: 1, Window: "24h", Aggregation: model.Mean}, forecast())
+
+	req, _ = http.NewRequest("GET", "/forecasts/cache", nil)
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var stats cacheStats
+	json.Unmarshal(rr.Body.Bytes(), &stats)
+	assert.Equal(t, cacheStats{Hits: 1, Misses: 2, TTL: "1m0s"}, stats)
+}
+
+func TestHandleForecastCachedOfDeletedCity(t *testing.T) {
+	for _, path := range []string{"/cities/1", "/cities/1?cascade=true"} {
+		t.Run(path, func(t *testing.T) {
+			store := model.NewMemoryStore()
+			store.CreateCity(&model.City{Name: "Berlin"})
+			a := App{}
+			a.Store = store
+			a.forecasts = newForecastCache(nil, 0)
+			a.Router = mux.NewRouter()
+			a.initializeRoutes()
+			forecast := func() int {
+				req, _ := http.NewRequest("GET", "/forecasts/1", nil)
+				rr := httptest.NewRecorder()
+				a.Router.ServeHTTP(rr, req)
+				return rr.Code
+			}
+			assert.Equal(t, http.StatusOK, forecast())
+			assert.Equal(t, http.StatusOK, forecast())
+
+			// deleting the city invalidates its cached forecast
+			req, _ := http.NewRequest("DELETE", path, nil)
+			rr := httptest.NewRecorder()
+			a.Router.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusCreated, rr.Code)
+			assert.Equal(t, http.StatusNotFound, forecast())
+			assert.Equal(t, cacheStats{Hits: 1, Misses: 2, TTL: "1m0s"}, a.forecasts.stats())
+		})
+	}
+}
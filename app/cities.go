@@ -1,38 +1,77 @@
 package app
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/Deewai/finleap/model"
+	"math"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/gorilla/mux"
 )
 
+const maxCityNameLength = 50
+
+// cityPayload is the body of city requests. Its fields are pointers so that
+// missing values can be told apart from zero ones.
+type cityPayload struct {
+	Name      *string  `json:"name"`
+	Latitude  *float32 `json:"latitude"`
+	Longitude *float32 `json:"longitude"`
+}
+
+// validate returns an error for every invalid field of p
+func (p cityPayload) validate() []FieldError {
+	fields := []FieldError{}
+	switch {
+	case p.Name == nil:
+		fields = append(fields, FieldError{Field: "name", Error: "is required"})
+	case strings.TrimSpace(*p.Name) == "":
+		fields = append(fields, FieldError{Field: "name", Error: "must not be empty"})
+	case utf8.RuneCountInString(*p.Name) > maxCityNameLength:
+		fields = append(fields, FieldError{Field: "name", Error: fmt.Sprintf("must be at most %d characters", maxCityNameLength)})
+	}
+	switch {
+	case p.Latitude == nil:
+		fields = append(fields, FieldError{Field: "latitude", Error: "is required"})
+	case *p.Latitude < -90 || *p.Latitude > 90:
+		fields = append(fields, FieldError{Field: "latitude", Error: "must be between -90 and 90"})
+	}
+	switch {
+	case p.Longitude == nil:
+		fields = append(fields, FieldError{Field: "longitude", Error: "is required"})
+	case *p.Longitude < -180 || *p.Longitude > 180:
+		fields = append(fields, FieldError{Field: "longitude", Error: "must be between -180 and 180"})
+	}
+	return fields
+}
+
+// city returns the city described by a validated payload
+func (p cityPayload) city() *model.City {
+	return &model.City{Name: *p.Name, Latitude: *p.Latitude, Longitude: *p.Longitude}
+}
+
 //handler for "/cities" POST endpoint
 func (a *App) handleCreateCities(w http.ResponseWriter, r *http.Request) {
-	var city *model.City
+	var payload cityPayload
 	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&city); err != nil {
+	if err := decoder.Decode(&payload); err != nil {
 		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid resquest payload")})
 		return
 	}
-	if city.Name == "" {
-		respondWithError(w, Error{Code: http.StatusBadRequest, Error: "Invalid name value"})
-		return
-	}
-	if city.Latitude == 0 {
-		respondWithError(w, Error{Code: http.StatusBadRequest, Error: "Invalid latitude value"})
-		return
-	}
-	if city.Longitude == 0 {
-		respondWithError(w, Error{Code: http.StatusBadRequest, Error: "Invalid longitude value"})
+	if fields := payload.validate(); len(fields) > 0 {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: "Invalid city", Fields: fields})
 		return
 	}
+	city := payload.city()
 	defer r.Body.Close()
-	err := city.Create(a.DB)
+	err := a.Store.CreateCity(city)
 	if err != nil {
 		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
 		return
@@ -40,6 +79,24 @@ func (a *App) handleCreateCities(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusCreated, city)
 }
 
+//handler for "/cities/:id" PUT endpoint
+func (a *App) handleReplaceCities(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid city id %v", params["id"])})
+		return
+	}
+	var payload cityPayload
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&payload); err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid resquest payload")})
+		return
+	}
+	defer r.Body.Close()
+	a.updateCity(w, id, payload)
+}
+
 //handler for "/cities/:id" PATCH endpoint
 func (a *App) handleUpdateCities(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
@@ -48,27 +105,71 @@ func (a *App) handleUpdateCities(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid city id %v", params["id"])})
 		return
 	}
-	var city *model.City
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "" {
+		contentType, _, err = mime.ParseMediaType(contentType)
+		if err != nil {
+			respondWithError(w, Error{Code: http.StatusUnsupportedMediaType, Error: fmt.Sprintf("Invalid Content-Type %v", r.Header.Get("Content-Type"))})
+			return
+		}
+	}
+	if contentType != "" && contentType != "application/json" && contentType != mergePatchContentType && contentType != jsonPatchContentType {
+		respondWithError(w, Error{Code: http.StatusUnsupportedMediaType, Error: fmt.Sprintf("Unsupported Content-Type %v", contentType)})
+		return
+	}
+	var patch interface{}
+	var operations []patchOperation
 	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&city); err != nil {
+	if contentType == jsonPatchContentType {
+		err = decoder.Decode(&operations)
+	} else {
+		err = decoder.Decode(&patch)
+	}
+	if err != nil {
 		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid resquest payload")})
 		return
 	}
-	if city.Name == "" {
-		respondWithError(w, Error{Code: http.StatusBadRequest, Error: "Invalid name value"})
+	defer r.Body.Close()
+	city := &model.City{ID: id}
+	err = a.Store.GetCity(city)
+	if err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			respondWithError(w, Error{Code: http.StatusNotFound, Error: err.Error()})
+			return
+		}
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
 		return
 	}
-	if city.Latitude == 0 {
-		respondWithError(w, Error{Code: http.StatusBadRequest, Error: "Invalid latitude value"})
+	var doc interface{}
+	current, _ := json.Marshal(city)
+	json.Unmarshal(current, &doc)
+	if contentType == jsonPatchContentType {
+		doc, err = jsonPatch(doc, operations)
+		if err != nil {
+			respondWithError(w, Error{Code: http.StatusUnprocessableEntity, Error: err.Error()})
+			return
+		}
+	} else {
+		doc = mergePatch(doc, patch)
+	}
+	var payload cityPayload
+	patched, _ := json.Marshal(doc)
+	if err := json.Unmarshal(patched, &payload); err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid resquest payload")})
 		return
 	}
-	if city.Longitude == 0 {
-		respondWithError(w, Error{Code: http.StatusBadRequest, Error: "Invalid longitude value"})
+	a.updateCity(w, id, payload)
+}
+
+// updateCity validates payload and stores it as the city with the given id
+func (a *App) updateCity(w http.ResponseWriter, id int, payload cityPayload) {
+	if fields := payload.validate(); len(fields) > 0 {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: "Invalid city", Fields: fields})
 		return
 	}
-	defer r.Body.Close()
+	city := payload.city()
 	city.ID = id
-	err = city.Update(a.DB)
+	err := a.Store.UpdateCity(city)
 	if err != nil {
 		if strings.Contains(err.Error(), "no rows in result set") {
 			respondWithError(w, Error{Code: http.StatusNotFound, Error: err.Error()})
@@ -88,8 +189,21 @@ func (a *App) handleDeleteCities(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid city id %v", params["id"])})
 		return
 	}
+	cascade := false
+	if value := r.URL.Query().Get("cascade"); value != "" {
+		cascade, err = strconv.ParseBool(value)
+		if err != nil {
+			respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid cascade %v", value)})
+			return
+		}
+	}
 	city := &model.City{ID: id}
-	err = city.Delete(a.DB)
+	// without cascade the city is only soft deleted and can be restored
+	if cascade {
+		_, err = a.Store.DeleteCityCascade(city)
+	} else {
+		err = a.Store.DeleteCity(city)
+	}
 	if err != nil {
 		if strings.Contains(err.Error(), "no rows in result set") {
 			respondWithError(w, Error{Code: http.StatusNotFound, Error: err.Error()})
@@ -98,5 +212,196 @@ func (a *App) handleDeleteCities(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
 		return
 	}
+	a.forecasts.invalidate(city.ID)
 	respondWithJSON(w, http.StatusCreated, city)
 }
+
+//handler for "/cities/:id/restore" POST endpoint
+func (a *App) handleRestoreCities(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid city id %v", params["id"])})
+		return
+	}
+	city := &model.City{ID: id}
+	err = a.Store.RestoreCity(city)
+	if err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			respondWithError(w, Error{Code: http.StatusNotFound, Error: err.Error()})
+			return
+		}
+		if err == model.ErrCityNameTaken {
+			respondWithError(w, Error{Code: http.StatusConflict, Error: err.Error()})
+			return
+		}
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, city)
+}
+
+const (
+	defaultCityPageSize = 20
+	maxCityPageSize     = 100
+	defaultNearbyRadius = 50.0
+	// maxNearbyRadius is half the earth's circumference, which covers every city
+	maxNearbyRadius    = 20016.0
+	defaultNearbyLimit = 10
+	maxNearbyLimit     = 100
+)
+
+// cityCursor points after the last city of a page of GET /cities
+type cityCursor struct {
+	Sort string `json:"s"`
+	ID   int    `json:"i"`
+	Name string `json:"n,omitempty"`
+}
+
+type cityPage struct {
+	Cities     []model.City `json:"cities"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+func encodeCityCursor(c cityCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCityCursor(s string) (cityCursor, error) {
+	var c cityCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errors.New("Invalid cursor")
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, errors.New("Invalid cursor")
+	}
+	return c, nil
+}
+
+//handler for "/cities/:id" GET endpoint
+func (a *App) handleGetCities(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid city id %v", params["id"])})
+		return
+	}
+	city := &model.City{ID: id}
+	err = a.Store.GetCity(city)
+	if err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			respondWithError(w, Error{Code: http.StatusNotFound, Error: err.Error()})
+			return
+		}
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, city)
+}
+
+//handler for "/cities" GET endpoint
+func (a *App) handleListCities(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	sort := values.Get("sort")
+	if sort == "" {
+		sort = "id"
+	}
+	query := model.CityQuery{NamePrefix: values.Get("name_prefix"), Limit: defaultCityPageSize}
+	switch sort {
+	case "id", "name":
+		query.SortBy = sort
+	case "-id", "-name":
+		query.SortBy = sort[1:]
+		query.Descending = true
+	default:
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid sort value '%v'", sort)})
+		return
+	}
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid limit value '%v'", limit)})
+			return
+		}
+		if n > maxCityPageSize {
+			n = maxCityPageSize
+		}
+		query.Limit = n
+	}
+	if cursor := values.Get("cursor"); cursor != "" {
+		c, err := decodeCityCursor(cursor)
+		if err != nil {
+			respondWithError(w, Error{Code: http.StatusBadRequest, Error: err.Error()})
+			return
+		}
+		if c.Sort != sort {
+			respondWithError(w, Error{Code: http.StatusBadRequest, Error: "Cursor was issued for a different sort"})
+			return
+		}
+		query.After = &model.City{ID: c.ID, Name: c.Name}
+	}
+	// ask for one more city than the page holds to know whether a next page exists
+	pageSize := query.Limit
+	query.Limit++
+	cities, err := a.Store.ListCities(query)
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	page := cityPage{Cities: cities}
+	if len(cities) > pageSize {
+		page.Cities = cities[:pageSize]
+		last := page.Cities[pageSize-1]
+		next := cityCursor{Sort: sort, ID: last.ID}
+		if query.SortBy == "name" {
+			next.Name = last.Name
+		}
+		page.NextCursor = encodeCityCursor(next)
+	}
+	respondWithJSON(w, http.StatusOK, page)
+}
+
+//handler for "/cities/nearby" GET endpoint
+func (a *App) handleNearbyCities(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	lat, err := strconv.ParseFloat(values.Get("lat"), 64)
+	if err != nil || !(lat >= -90 && lat <= 90) {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid lat value '%v'", values.Get("lat"))})
+		return
+	}
+	lon, err := strconv.ParseFloat(values.Get("lon"), 64)
+	if err != nil || !(lon >= -180 && lon <= 180) {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid lon value '%v'", values.Get("lon"))})
+		return
+	}
+	radius := defaultNearbyRadius
+	if value := values.Get("radius_km"); value != "" {
+		radius, err = strconv.ParseFloat(value, 64)
+		if err != nil || !(radius > 0) || math.IsInf(radius, 1) {
+			respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid radius_km value '%v'", value)})
+			return
+		}
+		if radius > maxNearbyRadius {
+			radius = maxNearbyRadius
+		}
+	}
+	limit := defaultNearbyLimit
+	if value := values.Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid limit value '%v'", value)})
+			return
+		}
+		if limit > maxNearbyLimit {
+			limit = maxNearbyLimit
+		}
+	}
+	cities, err := model.FindNearbyCities(a.Store, lat, lon, radius, limit)
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, cities)
+}
@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"github.com/Deewai/finleap/model"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"strings"
 
 	"testing"
 
@@ -18,7 +21,7 @@ func TestHandleCreateCitiesInvalidHttpMethod(t *testing.T) {
 	a := App{}
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
-	req, _ := http.NewRequest("GET", "/cities", nil)
+	req, _ := http.NewRequest("PUT", "/cities", nil)
 	rr := httptest.NewRecorder()
 	a.Router.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
@@ -41,8 +44,8 @@ func TestHandleCreateCitiesValidFormData(t *testing.T) {
 	}
 	defer db.Close()
 	a := App{}
-	a.DB = db
-	mock.ExpectExec("INSERT INTO cities").WillReturnResult(sqlmock.NewResult(1, 1))
+	a.Store = model.NewMySQLStore(db)
+	mock.ExpectPrepare("INSERT INTO cities").ExpectExec().WillReturnResult(sqlmock.NewResult(1, 1))
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
 	req, _ := http.NewRequest("POST", "/cities", bytes.NewBuffer([]byte(`{"name":"Berlin","latitude":52.520008,"longitude":13.404954}`)))
@@ -64,8 +67,8 @@ func TestHandleCreateCitiesExistingName(t *testing.T) {
 	}
 	defer db.Close()
 	a := App{}
-	a.DB = db
-	mock.ExpectExec("INSERT INTO cities").WillReturnError(fmt.Errorf("Duplicate key for column name"))
+	a.Store = model.NewMySQLStore(db)
+	mock.ExpectPrepare("INSERT INTO cities").ExpectExec().WillReturnError(fmt.Errorf("Duplicate key for column name"))
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
 	req, _ := http.NewRequest("POST", "/cities", bytes.NewBuffer([]byte(`{"name":"Berlin","latitude":52.520008,"longitude":13.404954}`)))
@@ -94,8 +97,11 @@ func TestHandleUpdateCitiesValidFormData(t *testing.T) {
 	}
 	defer db.Close()
 	a := App{}
-	a.DB = db
-	mock.ExpectExec("UPDATE cities SET (.+)").WillReturnResult(sqlmock.NewResult(1, 1))
+	a.Store = model.NewMySQLStore(db)
+	rows := sqlmock.NewRows([]string{"name", "latitude", "longitude"}).
+		AddRow("Hamburg", 53.551086, 9.993682)
+	mock.ExpectPrepare("^SELECT (.+) FROM cities (.+)").ExpectQuery().WillReturnRows(rows)
+	mock.ExpectPrepare("UPDATE cities SET (.+)").ExpectExec().WillReturnResult(sqlmock.NewResult(1, 1))
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
 	req, _ := http.NewRequest("PATCH", "/cities/1", bytes.NewBuffer([]byte(`{"name":"Berlin","latitude":52.520008,"longitude":13.404954}`)))
@@ -114,7 +120,7 @@ func TestHandleDeleteCitiesInvalidHttpMethod(t *testing.T) {
 	a := App{}
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
-	req, _ := http.NewRequest("GET", "/cities/1", nil)
+	req, _ := http.NewRequest("POST", "/cities/1", nil)
 	rr := httptest.NewRecorder()
 	a.Router.ServeHTTP(rr, req)
 	assert.Equal(t, http.StatusMethodNotAllowed, rr.Code)
@@ -127,9 +133,9 @@ func TestHandleDeleteCitiesNotExistingCityID(t *testing.T) {
 	}
 	defer db.Close()
 	a := App{}
-	a.DB = db
-	mock.ExpectQuery("^SELECT (.+) FROM cities (.+)").WillReturnError(fmt.Errorf("no rows in result set"))
-	mock.ExpectExec("DELETE FROM cities").WillReturnError(fmt.Errorf("no rows in result set"))
+	a.Store = model.NewMySQLStore(db)
+	mock.ExpectPrepare("^SELECT (.+) FROM cities (.+)").ExpectQuery().WillReturnError(fmt.Errorf("no rows in result set"))
+	mock.ExpectPrepare("UPDATE cities SET deleted_at").ExpectExec().WillReturnError(fmt.Errorf("no rows in result set"))
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
 	req, _ := http.NewRequest("DELETE", "/cities/1", nil)
@@ -158,11 +164,11 @@ func TestHandleDeleteCitiesValidCityID(t *testing.T) {
 	}
 	defer db.Close()
 	a := App{}
-	a.DB = db
+	a.Store = model.NewMySQLStore(db)
 	rows := sqlmock.NewRows([]string{"name", "latitude", "longitude"}).
 		AddRow("Berlin", 52.520008, 13.404954)
-	mock.ExpectQuery("^SELECT (.+) FROM cities (.+)").WillReturnRows(rows)
-	mock.ExpectExec("DELETE FROM cities (.+) ").WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectPrepare("^SELECT (.+) FROM cities (.+)").ExpectQuery().WillReturnRows(rows)
+	mock.ExpectPrepare("UPDATE cities SET deleted_at=CURRENT_TIMESTAMP (.+) AND deleted_at IS NULL").ExpectExec().WillReturnResult(sqlmock.NewResult(0, 1))
 
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
@@ -177,3 +183,533 @@ func TestHandleDeleteCitiesValidCityID(t *testing.T) {
 	assert.EqualValues(t, 52.520008, m["latitude"])
 	assert.EqualValues(t, 13.404954, m["longitude"])
 }
+
+func TestHandleDeleteCitiesInvalidCascade(t *testing.T) {
+	a := App{}
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("DELETE", "/cities/1?cascade=maybe", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestHandleDeleteCitiesCascade(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	a := App{}
+	a.Store = model.NewMySQLStore(db)
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT (.+) FROM cities WHERE id=\\?$").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude"}).AddRow("Berlin", 52.520008, 13.404954))
+	mock.ExpectQuery("^SELECT (.+) FROM webhooks WHERE city_id=\\?$").WithArgs(1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "city_id", "callback_url", "unit"}).AddRow(3, 1, "https://my.service.com/high-temperature", "C"))
+	mock.ExpectExec("DELETE FROM webhook_outbox").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM temperatures").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM temperature_rollups").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM webhooks").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM cities").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("DELETE", "/cities/1?cascade=true", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var m map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &m)
+	assert.EqualValues(t, "Berlin", m["name"])
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestHandleDeleteCitiesCascadeRollsBack(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	a := App{}
+	a.Store = model.NewMySQLStore(db)
+	mock.ExpectBegin()
+	mock.ExpectQuery("^SELECT (.+) FROM cities").
+		WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude"}).AddRow("Berlin", 52.520008, 13.404954))
+	mock.ExpectQuery("^SELECT (.+) FROM webhooks").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "city_id", "callback_url", "unit"}))
+	mock.ExpectExec("DELETE FROM webhook_outbox").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM temperatures").WillReturnError(fmt.Errorf("a database error"))
+	mock.ExpectRollback()
+
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("DELETE", "/cities/1?cascade=1", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+// expectNameFree expects no other city to be found with the name of the city
+// being restored
+func expectNameFree(mock sqlmock.Sqlmock) {
+	mock.ExpectPrepare("SELECT COUNT\\(\\*\\) FROM cities").ExpectQuery().WithArgs(1, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+}
+
+func TestHandleRestoreCitiesNameTaken(t *testing.T) {
+	store := model.NewMemoryStore()
+	assert.Nil(t, store.CreateCity(&model.City{Name: "Berlin"}))
+	assert.Nil(t, store.DeleteCity(&model.City{ID: 1}))
+	a := App{Store: store}
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	// the name of a deleted city can be used again
+	req, _ := http.NewRequest("POST", "/cities", bytes.NewBuffer([]byte(`{"name":"Berlin","latitude":52.520008,"longitude":13.404954}`)))
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	req, _ = http.NewRequest("POST", "/cities/1/restore", nil)
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusConflict, rr.Code)
+}
+
+func TestHandleRestoreCitiesNotDeleted(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	a := App{}
+	a.Store = model.NewMySQLStore(db)
+	expectNameFree(mock)
+	mock.ExpectPrepare("UPDATE cities SET deleted_at=NULL").ExpectExec().WillReturnResult(sqlmock.NewResult(0, 0))
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("POST", "/cities/1/restore", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestHandleRestoreCities(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	a := App{}
+	a.Store = model.NewMySQLStore(db)
+	expectNameFree(mock)
+	mock.ExpectPrepare("UPDATE cities SET deleted_at=NULL (.+) AND deleted_at IS NOT NULL").ExpectExec().WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectPrepare("^SELECT (.+) FROM cities (.+)").ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude"}).AddRow("Berlin", 52.520008, 13.404954))
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("POST", "/cities/1/restore", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var m map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &m)
+	assert.EqualValues(t, 1, m["id"])
+	assert.EqualValues(t, "Berlin", m["name"])
+}
+
+func TestHandleCreateCitiesHostileNames(t *testing.T) {
+	names := []string{
+		"O'Fallon",
+		"Berlin'); DROP TABLE cities; --",
+		`Back\slash "quoted"`,
+		"' OR '1'='1",
+	}
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			a := App{}
+			a.Store = model.NewMySQLStore(db)
+			mock.ExpectPrepare(regexp.QuoteMeta("INSERT INTO cities(name, latitude, longitude) VALUES(?, ?, ?)")).
+				ExpectExec().
+				WithArgs(name, sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			a.Router = mux.NewRouter()
+			a.initializeRoutes()
+			payload, _ := json.Marshal(map[string]interface{}{"name": name, "latitude": 38.59, "longitude": -90.24})
+			req, _ := http.NewRequest("POST", "/cities", bytes.NewBuffer(payload))
+			rr := httptest.NewRecorder()
+			a.Router.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusCreated, rr.Code)
+			var m map[string]interface{}
+			json.Unmarshal(rr.Body.Bytes(), &m)
+			assert.Equal(t, name, m["name"])
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestHandleUpdateCitiesHostileNames(t *testing.T) {
+	name := "O'Fallon'; DELETE FROM cities; --"
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	a := App{}
+	a.Store = model.NewMySQLStore(db)
+	mock.ExpectPrepare("^SELECT (.+) FROM cities (.+)").ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude"}).AddRow("O'Fallon", 38.59, -90.24))
+	mock.ExpectPrepare(regexp.QuoteMeta("UPDATE cities SET name=?, latitude=?, longitude=? WHERE id=?")).
+		ExpectExec().
+		WithArgs(name, sqlmock.AnyArg(), sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	payload, _ := json.Marshal(map[string]interface{}{"name": name, "latitude": 38.59, "longitude": -90.24})
+	req, _ := http.NewRequest("PATCH", "/cities/1", bytes.NewBuffer(payload))
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestHandleGetCitiesValidCityID(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	a := App{}
+	a.Store = model.NewMySQLStore(db)
+	rows := sqlmock.NewRows([]string{"name", "latitude", "longitude"}).
+		AddRow("Berlin", 52.520008, 13.404954)
+	mock.ExpectPrepare("^SELECT (.+) FROM cities (.+)").ExpectQuery().WithArgs(1).WillReturnRows(rows)
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("GET", "/cities/1", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var m map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &m)
+	assert.EqualValues(t, 1, m["id"])
+	assert.EqualValues(t, "Berlin", m["name"])
+}
+
+func TestHandleGetCitiesNotExistingCityID(t *testing.T) {
+	a := App{}
+	a.Store = model.NewMemoryStore()
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("GET", "/cities/1", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestHandleGetCitiesInvalidCityID(t *testing.T) {
+	a := App{}
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("GET", "/cities/me", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func newCityListApp(names ...string) *App {
+	a := &App{}
+	store := model.NewMemoryStore()
+	for _, name := range names {
+		store.CreateCity(&model.City{Name: name, Latitude: 50, Longitude: 10})
+	}
+	a.Store = store
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	return a
+}
+
+func listCities(a *App, url string) (int, []string, string) {
+	req, _ := http.NewRequest("GET", url, nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	var page struct {
+		Cities     []model.City `json:"cities"`
+		NextCursor string       `json:"next_cursor"`
+	}
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	names := []string{}
+	for _, city := range page.Cities {
+		names = append(names, city.Name)
+	}
+	return rr.Code, names, page.NextCursor
+}
+
+func TestHandleListCitiesPaginatesByName(t *testing.T) {
+	a := newCityListApp("Munich", "Berlin", "Hamburg", "Bremen", "Cologne")
+	code, names, cursor := listCities(a, "/cities?sort=name&limit=2")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"Berlin", "Bremen"}, names)
+	assert.NotEmpty(t, cursor)
+	code, names, cursor = listCities(a, "/cities?sort=name&limit=2&cursor="+cursor)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"Cologne", "Hamburg"}, names)
+	code, names, cursor = listCities(a, "/cities?sort=name&limit=2&cursor="+cursor)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"Munich"}, names)
+	assert.Empty(t, cursor)
+}
+
+func TestHandleListCitiesDescendingIDWithPrefix(t *testing.T) {
+	a := newCityListApp("Munich", "Berlin", "Hamburg", "Bremen", "Cologne")
+	code, names, cursor := listCities(a, "/cities?sort=-id&name_prefix=b")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []string{"Bremen", "Berlin"}, names)
+	assert.Empty(t, cursor)
+}
+
+func TestHandleListCitiesDefaults(t *testing.T) {
+	a := newCityListApp()
+	for i := 0; i < defaultCityPageSize+1; i++ {
+		a.Store.CreateCity(&model.City{Name: fmt.Sprintf("City %d", i), Latitude: 50, Longitude: 10})
+	}
+	code, names, cursor := listCities(a, "/cities")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, names, defaultCityPageSize)
+	assert.Equal(t, "City 0", names[0])
+	assert.NotEmpty(t, cursor)
+}
+
+func TestHandleListCitiesInvalidParameters(t *testing.T) {
+	a := newCityListApp("Berlin", "Bremen")
+	_, _, nameCursor := listCities(a, "/cities?sort=name&limit=1")
+	for _, url := range []string{
+		"/cities?sort=latitude",
+		"/cities?limit=0",
+		"/cities?limit=ten",
+		"/cities?cursor=not-a-cursor",
+		"/cities?sort=id&cursor=" + nameCursor,
+	} {
+		code, _, _ := listCities(a, url)
+		assert.Equal(t, http.StatusBadRequest, code, url)
+	}
+}
+
+func TestHandleNearbyCities(t *testing.T) {
+	a := &App{}
+	store := model.NewMemoryStore()
+	store.CreateCity(&model.City{Name: "Berlin", Latitude: 52.520008, Longitude: 13.404954})
+	store.CreateCity(&model.City{Name: "Potsdam", Latitude: 52.390569, Longitude: 13.064473})
+	store.CreateCity(&model.City{Name: "Hamburg", Latitude: 53.551086, Longitude: 9.993682})
+	a.Store = store
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("GET", "/cities/nearby?lat=52.5&lon=13.4&radius_km=100", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var m []map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &m)
+	if assert.Len(t, m, 2) {
+		assert.Equal(t, "Berlin", m[0]["name"])
+		assert.EqualValues(t, 1, m[0]["id"])
+		assert.InDelta(t, 1.5, m[0]["distance_km"], 1)
+		assert.Equal(t, "Potsdam", m[1]["name"])
+	}
+}
+
+func TestHandleNearbyCitiesInvalidParameters(t *testing.T) {
+	a := &App{}
+	a.Store = model.NewMemoryStore()
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	for _, url := range []string{
+		"/cities/nearby",
+		"/cities/nearby?lat=91&lon=0",
+		"/cities/nearby?lat=0&lon=-181",
+		"/cities/nearby?lat=north&lon=0",
+		"/cities/nearby?lat=0&lon=0&radius_km=-5",
+		"/cities/nearby?lat=0&lon=0&limit=0",
+		"/cities/nearby?lat=NaN&lon=0",
+		"/cities/nearby?lat=0&lon=NaN",
+		"/cities/nearby?lat=0&lon=0&radius_km=NaN",
+		"/cities/nearby?lat=0&lon=0&radius_km=Inf",
+		"/cities/nearby?lat=-Inf&lon=0",
+	} {
+		req, _ := http.NewRequest("GET", url, nil)
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, url)
+	}
+}
+
+func TestHandleCreateCitiesOnEquatorAndPrimeMeridian(t *testing.T) {
+	a := &App{}
+	a.Store = model.NewMemoryStore()
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("POST", "/cities", bytes.NewBuffer([]byte(`{"name":"Null Island","latitude":0,"longitude":0}`)))
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var m map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &m)
+	assert.EqualValues(t, 0, m["latitude"])
+	assert.EqualValues(t, 0, m["longitude"])
+}
+
+func TestHandleCreateCitiesReportsEveryInvalidField(t *testing.T) {
+	a := &App{}
+	a.Store = model.NewMemoryStore()
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("POST", "/cities", bytes.NewBuffer([]byte(`{"name":" ","latitude":500,"longitude":-180.5}`)))
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	var e Error
+	json.Unmarshal(rr.Body.Bytes(), &e)
+	assert.Equal(t, "Invalid city", e.Error)
+	assert.Equal(t, []FieldError{
+		{Field: "name", Error: "must not be empty"},
+		{Field: "latitude", Error: "must be between -90 and 90"},
+		{Field: "longitude", Error: "must be between -180 and 180"},
+	}, e.Fields)
+}
+
+func TestHandleReplaceCitiesMissingFields(t *testing.T) {
+	a := &App{}
+	a.Store = model.NewMemoryStore()
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("PUT", "/cities/1", bytes.NewBuffer([]byte(`{"latitude":45}`)))
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	var e Error
+	json.Unmarshal(rr.Body.Bytes(), &e)
+	assert.Equal(t, []FieldError{
+		{Field: "name", Error: "is required"},
+		{Field: "longitude", Error: "is required"},
+	}, e.Fields)
+}
+
+func TestCityPayloadValidateNameLength(t *testing.T) {
+	name := strings.Repeat("ü", maxCityNameLength)
+	lat, lon := float32(1), float32(1)
+	assert.Empty(t, cityPayload{Name: &name, Latitude: &lat, Longitude: &lon}.validate())
+	name += "x"
+	assert.Equal(t, []FieldError{{Field: "name", Error: "must be at most 50 characters"}}, cityPayload{Name: &name, Latitude: &lat, Longitude: &lon}.validate())
+}
+
+func newCityPatchApp() *App {
+	a := &App{}
+	store := model.NewMemoryStore()
+	store.CreateCity(&model.City{Name: "Berlin", Latitude: 52.5, Longitude: 13.4})
+	a.Store = store
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	return a
+}
+
+func patchCity(a *App, method, url, contentType, body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+	req, _ := http.NewRequest(method, url, bytes.NewBuffer([]byte(body)))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	var m map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &m)
+	return rr, m
+}
+
+func TestHandleUpdateCitiesMergePatch(t *testing.T) {
+	a := newCityPatchApp()
+	rr, m := patchCity(a, "PATCH", "/cities/1", "application/merge-patch+json", `{"latitude":0}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.EqualValues(t, 1, m["id"])
+	assert.Equal(t, "Berlin", m["name"])
+	assert.EqualValues(t, 0, m["latitude"])
+	assert.EqualValues(t, 13.4, m["longitude"])
+
+	city := &model.City{ID: 1}
+	a.Store.GetCity(city)
+	assert.Equal(t, model.City{ID: 1, Name: "Berlin", Latitude: 0, Longitude: 13.4}, *city)
+}
+
+func TestHandleUpdateCitiesMergePatchWithPlainJSON(t *testing.T) {
+	a := newCityPatchApp()
+	rr, m := patchCity(a, "PATCH", "/cities/1", "application/json", `{"name":"Berlin-Mitte"}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, "Berlin-Mitte", m["name"])
+}
+
+func TestHandleUpdateCitiesMergePatchRemovingRequiredField(t *testing.T) {
+	a := newCityPatchApp()
+	rr, m := patchCity(a, "PATCH", "/cities/1", "application/merge-patch+json", `{"name":null,"longitude":200}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Len(t, m["fields"], 2)
+}
+
+func TestHandleUpdateCitiesJSONPatch(t *testing.T) {
+	a := newCityPatchApp()
+	rr, m := patchCity(a, "PATCH", "/cities/1", "application/json-patch+json",
+		`[{"op":"test","path":"/name","value":"Berlin"},{"op":"replace","path":"/name","value":"Potsdam"},{"op":"copy","from":"/latitude","path":"/longitude"}]`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, "Potsdam", m["name"])
+	assert.EqualValues(t, 52.5, m["longitude"])
+}
+
+func TestHandleUpdateCitiesJSONPatchFailedTest(t *testing.T) {
+	a := newCityPatchApp()
+	rr, _ := patchCity(a, "PATCH", "/cities/1", "application/json-patch+json",
+		`[{"op":"test","path":"/name","value":"Hamburg"},{"op":"replace","path":"/name","value":"Potsdam"}]`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+	city := &model.City{ID: 1}
+	a.Store.GetCity(city)
+	assert.Equal(t, "Berlin", city.Name)
+}
+
+func TestHandleUpdateCitiesUnsupportedContentType(t *testing.T) {
+	a := newCityPatchApp()
+	rr, _ := patchCity(a, "PATCH", "/cities/1", "text/plain", `name=Potsdam`)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+}
+
+func TestHandleUpdateCitiesNotExistingCityID(t *testing.T) {
+	a := newCityPatchApp()
+	rr, _ := patchCity(a, "PATCH", "/cities/2", "application/merge-patch+json", `{"name":"Potsdam"}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestHandleReplaceCities(t *testing.T) {
+	a := newCityPatchApp()
+	rr, m := patchCity(a, "PUT", "/cities/1", "", `{"name":"Potsdam","latitude":52.39,"longitude":13.06}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, "Potsdam", m["name"])
+	rr, _ = patchCity(a, "PUT", "/cities/2", "", `{"name":"Hamburg","latitude":53.55,"longitude":9.99}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestHandleUpdateCitiesMissingRowOnUpdate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	a := &App{}
+	a.Store = model.NewMySQLStore(db)
+	mock.ExpectPrepare("UPDATE cities SET (.+)").ExpectExec().WillReturnResult(sqlmock.NewResult(0, 0))
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	rr, _ := patchCity(a, "PUT", "/cities/1", "", `{"name":"Berlin","latitude":52.520008,"longitude":13.404954}`)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,240 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Deewai/finleap/model"
+	"github.com/Deewai/finleap/signature"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	defaultWebhookMaxAttempts   = 5
+	defaultWebhookRetryDelay    = time.Second
+	defaultWebhookMaxRetryDelay = time.Minute
+	defaultWebhookTimeout       = 10 * time.Second
+	// outboxPollInterval is how often the outbox is looked at without a new
+	// reading
+	outboxPollInterval = 5 * time.Second
+	// outboxBatchSize is the number of deliveries claimed at once
+	outboxBatchSize = 100
+	// deliveryResponseSnippet is how much of a response body the delivery
+	// log keeps
+	deliveryResponseSnippet         = 512
+	defaultWebhookDeliveryRetention = 7 * 24 * time.Hour
+	// deliveryPruneInterval is how often the delivery log is pruned
+	deliveryPruneInterval = time.Hour
+)
+
+// outboxClaim returns how long claimed deliveries are left to an instance
+// before others take them over: long enough for every attempt of a delivery
+// to time out and wait the longest retry delay. The claims of the deliveries
+// still queued or in progress are extended by extendClaimsRoutine.
+func (a *App) outboxClaim() time.Duration {
+	attempts, timeout, maxDelay := a.WebhookMaxAttempts, a.WebhookTimeout, a.WebhookMaxRetryDelay
+	if attempts < 1 {
+		attempts = defaultWebhookMaxAttempts
+	}
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	if maxDelay <= 0 {
+		maxDelay = defaultWebhookMaxRetryDelay
+	}
+	return time.Duration(attempts) * (timeout + maxDelay)
+}
+
+// deliverOutbox claims the deliveries in the outbox and queues them for the
+// workers until none is left. A delivery claimed again while it is queued or
+// in progress isn't queued twice.
+func (a *App) deliverOutbox() {
+	claim := a.outboxClaim()
+	for {
+		now := time.Now()
+		entries, err := a.Store.ClaimOutbox(now.Unix(), now.Add(claim).Unix(), outboxBatchSize)
+		if err != nil {
+			log.Println(err.Error())
+			return
+		}
+		if len(entries) == 0 {
+			return
+		}
+		for _, entry := range entries {
+			a.deliveries.push(entry)
+		}
+	}
+}
+
+// extendClaimsRoutine extends the claims of the deliveries queued or in
+// progress three times per claim, so that they don't end while a delivery
+// waits for a slow host
+func (a *App) extendClaimsRoutine() {
+	claim := a.outboxClaim()
+	ticker := time.NewTicker(claim / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		a.extendClaims(claim)
+	}
+}
+
+func (a *App) extendClaims(claim time.Duration) {
+	ids := a.deliveries.pendingIDs()
+	if len(ids) == 0 {
+		return
+	}
+	if err := a.Store.ExtendOutboxClaim(ids, time.Now().Add(claim).Unix()); err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// sendEntry delivers a claimed entry, logging every attempt, and removes it
+// from the outbox, also when its delivery failed for good
+func (a *App) sendEntry(entry model.OutboxEntry) error {
+	record := func(d model.Delivery) {
+		d.WebhookID, d.TemperatureID = entry.Webhook.ID, entry.Temperature.ID
+		if err := a.Store.RecordDelivery(&d); err != nil {
+			log.Printf("failed to record delivery %d: %v", entry.ID, err)
+		}
+	}
+	secrets := entry.Webhook.Secrets(time.Now().Unix())
+	err := a.deliver(entry.Webhook.CallbackURL, webhookPayload(entry.Webhook, entry.Temperature), secrets, record)
+	if err := a.Store.CompleteOutbox(entry.ID); err != nil {
+		log.Printf("failed to complete delivery %d: %v", entry.ID, err)
+	}
+	return err
+}
+
+// webhookPayload returns the body delivering temp to hook, in the unit of
+// the webhook
+func webhookPayload(hook model.Webhook, temp model.Temperature) []byte {
+	unit := hook.Unit
+	if unit == "" {
+		unit = model.Celsius
+	}
+	converted := temp.In(unit)
+	payload, _ := json.Marshal(map[string]interface{}{
+		"city_id":     converted.CityID,
+		"max":         converted.Max,
+		"min":         converted.Min,
+		"unit":        converted.Unit,
+		"Timestamp":   converted.Timestamp,
+		"received_at": converted.ReceivedAt,
+	})
+	return payload
+}
+
+// deliver posts payload to the callback url until it is accepted or
+// WebhookMaxAttempts attempts failed, waiting longer after every failure. Every
+// attempt is signed with secrets when there are any, and passed to record
+// when it isn't nil. It returns the error of the last attempt.
+func (a *App) deliver(url string, payload []byte, secrets []string, record func(model.Delivery)) error {
+	attempts := a.WebhookMaxAttempts
+	if attempts < 1 {
+		attempts = defaultWebhookMaxAttempts
+	}
+	sleep := a.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	for attempt := 1; ; attempt++ {
+		delivery, err := a.deliverOnce(url, payload, secrets)
+		if record != nil {
+			delivery.Attempt = attempt
+			record(delivery)
+		}
+		if err == nil || attempt == attempts {
+			return err
+		}
+		delay := a.retryDelay(attempt)
+		log.Printf("delivery to %s failed (attempt %d of %d), retrying in %v: %v", url, attempt, attempts, delay, err)
+		sleep(delay)
+	}
+}
+
+// deliverOnce posts payload to the callback url once, signed now, and
+// returns the attempt. Network errors and responses other than 2xx are
+// failures.
+func (a *App) deliverOnce(url string, payload []byte, secrets []string) (model.Delivery, error) {
+	header := http.Header{}
+	start := time.Now()
+	if len(secrets) > 0 {
+		header.Set(signature.Header, signature.Sign(payload, start, secrets...))
+	}
+	delivery := model.Delivery{Status: model.DeliveryFailed, CreatedAt: start.Unix()}
+	resp, err := a.sendRequest(url, payload, header)
+	if err == nil {
+		delivery.StatusCode = resp.StatusCode
+		if resp.Body != nil {
+			// drain the body so that the connection can be reused
+			body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			if len(body) > deliveryResponseSnippet {
+				body = body[:deliveryResponseSnippet]
+			}
+			delivery.Response = strings.ToValidUTF8(string(body), "")
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			err = fmt.Errorf("%s responded with status %d", url, resp.StatusCode)
+		}
+	}
+	delivery.Latency = time.Since(start).Milliseconds()
+	if err != nil {
+		delivery.Error = err.Error()
+	} else {
+		delivery.Status = model.DeliverySucceeded
+	}
+	return delivery, err
+}
+
+// retryDelay returns how long to wait after the attempt-th failed attempt:
+// WebhookRetryDelay doubled per earlier failure, at most WebhookMaxRetryDelay,
+// less a random jitter of up to half of it so that the retries of deliveries
+// failing together spread out
+func (a *App) retryDelay(attempt int) time.Duration {
+	delay, max := a.WebhookRetryDelay, a.WebhookMaxRetryDelay
+	if delay <= 0 {
+		delay = defaultWebhookRetryDelay
+	}
+	if max <= 0 {
+		max = defaultWebhookMaxRetryDelay
+	}
+	for i := 1; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay - time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// pruneDeliveriesRoutine removes the delivery attempts older than
+// WebhookDeliveryRetention every deliveryPruneInterval
+func (a *App) pruneDeliveriesRoutine() {
+	ticker := time.NewTicker(deliveryPruneInterval)
+	defer ticker.Stop()
+	for {
+		a.pruneDeliveries()
+		<-ticker.C
+	}
+}
+
+func (a *App) pruneDeliveries() {
+	retention := a.WebhookDeliveryRetention
+	if retention <= 0 {
+		retention = defaultWebhookDeliveryRetention
+	}
+	pruned, err := a.Store.PruneDeliveries(time.Now().Add(-retention).Unix())
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if pruned > 0 {
+		log.Printf("pruned %d webhook delivery attempts", pruned)
+	}
+}
@@ -0,0 +1,362 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Deewai/finleap/model"
+	"github.com/Deewai/finleap/signature"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// callbackServer answers the deliveries to a path with the statuses listed
+// for it in turn, the last one repeatedly, and counts them
+type callbackServer struct {
+	*httptest.Server
+	lock     sync.Mutex
+	statuses map[string][]int
+	received map[string]int
+}
+
+func newCallbackServer(statuses map[string][]int) *callbackServer {
+	s := &callbackServer{statuses: statuses, received: map[string]int{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		statuses := s.statuses[r.URL.Path]
+		status := statuses[len(statuses)-1]
+		if n := s.received[r.URL.Path]; n < len(statuses) {
+			status = statuses[n]
+		}
+		s.received[r.URL.Path]++
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+func (s *callbackServer) count(path string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.received[path]
+}
+
+func TestDeliverRetriesWithBackoff(t *testing.T) {
+	server := newCallbackServer(map[string][]int{"/hook": {http.StatusInternalServerError, http.StatusBadGateway, http.StatusNoContent}})
+	defer server.Close()
+	DisableMockups()
+	defer StartMockups()
+	var delays []time.Duration
+	a := App{WebhookRetryDelay: time.Second, WebhookMaxRetryDelay: time.Minute}
+	a.sleep = func(d time.Duration) { delays = append(delays, d) }
+	assert.Nil(t, a.deliver(server.URL+"/hook", []byte(`{}`), nil, nil))
+	assert.Equal(t, 3, server.count("/hook"))
+	if assert.Len(t, delays, 2) {
+		assert.True(t, delays[0] >= 500*time.Millisecond && delays[0] <= time.Second, delays[0])
+		assert.True(t, delays[1] >= time.Second && delays[1] <= 2*time.Second, delays[1])
+	}
+}
+
+func TestDeliverGivesUp(t *testing.T) {
+	server := newCallbackServer(map[string][]int{"/hook": {http.StatusNotFound}})
+	defer server.Close()
+	DisableMockups()
+	defer StartMockups()
+	a := App{WebhookMaxAttempts: 3, sleep: func(time.Duration) {}}
+	err := a.deliver(server.URL+"/hook", []byte(`{}`), nil, nil)
+	assert.EqualError(t, err, fmt.Sprintf("%s/hook responded with status 404", server.URL))
+	assert.Equal(t, 3, server.count("/hook"))
+}
+
+func TestRetryDelay(t *testing.T) {
+	a := App{WebhookRetryDelay: 100 * time.Millisecond, WebhookMaxRetryDelay: time.Second}
+	for attempt, max := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 4: 800 * time.Millisecond, 5: time.Second, 100: time.Second} {
+		for i := 0; i < 20; i++ {
+			delay := a.retryDelay(attempt)
+			assert.True(t, delay >= max/2 && delay <= max, "attempt %d waits %v", attempt, delay)
+		}
+	}
+	// defaults
+	delay := (&App{}).retryDelay(1)
+	assert.True(t, delay >= 500*time.Millisecond && delay <= time.Second)
+}
+
+// newOutboxApp returns an App on a memory store holding a reading of a city
+// with a webhook for each of urls, and the deliveries of the reading
+func newOutboxApp(t *testing.T, urls ...string) (*App, []model.OutboxEntry) {
+	store := model.NewMemoryStore()
+	assert.Nil(t, store.CreateCity(&model.City{Name: "Berlin"}))
+	for _, url := range urls {
+		assert.Nil(t, store.CreateWebhook(&model.Webhook{CityID: 1, CallbackURL: url}))
+	}
+	assert.Nil(t, store.CreateTemperature(&model.Temperature{CityID: 1, Max: 20, Min: 10, Timestamp: 10000}))
+	a := &App{Store: store, sleep: func(time.Duration) {}}
+	entries, err := store.ClaimOutbox(time.Now().Unix(), time.Now().Add(time.Minute).Unix(), 10)
+	assert.Nil(t, err)
+	assert.Len(t, entries, len(urls))
+	return a, entries
+}
+
+// pending returns the deliveries left in the outbox of a
+func pending(t *testing.T, a *App) []model.OutboxEntry {
+	entries, err := a.Store.ClaimOutbox(time.Now().Add(time.Hour).Unix(), 0, 100)
+	assert.Nil(t, err)
+	return entries
+}
+
+func TestSendEntryNoMockUrl(t *testing.T) {
+	FlushMockups()
+	a, entries := newOutboxApp(t, "https://my.service.com/high-temperature")
+	err := a.sendEntry(entries[0])
+	assert.NotNil(t, err)
+	assert.EqualValues(t, errors.New("No mockup found for given request"), err)
+}
+
+func TestSendEntryInvalidUrl(t *testing.T) {
+	FlushMockups()
+	AddMockups(mock{
+		url:        "https://my.service.com/high-temperature",
+		httpMethod: http.MethodPost,
+		err:        errors.New("invalid response"),
+	})
+	a, entries := newOutboxApp(t, "https://my.service.com/high-temperature")
+	err := a.sendEntry(entries[0])
+	assert.NotNil(t, err)
+	assert.EqualValues(t, errors.New("invalid response"), err)
+	// a delivery that failed for good leaves the outbox
+	assert.Empty(t, pending(t, a))
+}
+
+func TestSendEntryValidUrl(t *testing.T) {
+	FlushMockups()
+	AddMockups(mock{
+		url:        "https://my.service.com/high-temperature",
+		httpMethod: http.MethodPost,
+		response: &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(strings.NewReader(`"message":"success"`)),
+		},
+	})
+	a, entries := newOutboxApp(t, "https://my.service.com/high-temperature")
+	assert.Nil(t, a.sendEntry(entries[0]))
+	assert.Empty(t, pending(t, a))
+}
+
+func TestSendEntryRecordsAttempts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/down" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(strings.Repeat("x", 1000)))
+			return
+		}
+		w.Write([]byte(`{"ok":true}`))
+	}))
+	defer server.Close()
+	DisableMockups()
+	defer StartMockups()
+	a, entries := newOutboxApp(t, server.URL+"/down", server.URL+"/up")
+	a.WebhookMaxAttempts = 2
+	for _, entry := range entries {
+		a.sendEntry(entry)
+	}
+
+	failed, err := a.Store.ListDeliveries(model.DeliveryQuery{WebhookID: entries[0].Webhook.ID, Limit: 10})
+	assert.Nil(t, err)
+	if assert.Len(t, failed, 2) {
+		for i, d := range failed {
+			assert.Equal(t, 2-i, d.Attempt)
+			assert.Equal(t, entries[0].Temperature.ID, d.TemperatureID)
+			assert.Equal(t, model.DeliveryFailed, d.Status)
+			assert.Equal(t, http.StatusServiceUnavailable, d.StatusCode)
+			assert.Equal(t, strings.Repeat("x", deliveryResponseSnippet), d.Response)
+			assert.Equal(t, fmt.Sprintf("%s/down responded with status 503", server.URL), d.Error)
+			assert.InDelta(t, time.Now().Unix(), d.CreatedAt, 5)
+		}
+	}
+	succeeded, err := a.Store.ListDeliveries(model.DeliveryQuery{WebhookID: entries[1].Webhook.ID, Limit: 10})
+	assert.Nil(t, err)
+	if assert.Len(t, succeeded, 1) {
+		assert.Equal(t, 1, succeeded[0].Attempt)
+		assert.Equal(t, model.DeliverySucceeded, succeeded[0].Status)
+		assert.Equal(t, http.StatusOK, succeeded[0].StatusCode)
+		assert.Equal(t, `{"ok":true}`, succeeded[0].Response)
+		assert.Empty(t, succeeded[0].Error)
+	}
+}
+
+func TestSendEntryRecordsNetworkErrors(t *testing.T) {
+	FlushMockups()
+	AddMockups(mock{
+		url:        "https://my.service.com/high-temperature",
+		httpMethod: http.MethodPost,
+		err:        errors.New("connection refused"),
+	})
+	a, entries := newOutboxApp(t, "https://my.service.com/high-temperature")
+	a.WebhookMaxAttempts = 1
+	a.sendEntry(entries[0])
+	deliveries, err := a.Store.ListDeliveries(model.DeliveryQuery{WebhookID: entries[0].Webhook.ID, Limit: 10})
+	assert.Nil(t, err)
+	if assert.Len(t, deliveries, 1) {
+		assert.Equal(t, model.DeliveryFailed, deliveries[0].Status)
+		assert.Zero(t, deliveries[0].StatusCode)
+		assert.Equal(t, "connection refused", deliveries[0].Error)
+	}
+}
+
+func TestPruneDeliveries(t *testing.T) {
+	store := model.NewMemoryStore()
+	now := time.Now()
+	for _, age := range []time.Duration{48 * time.Hour, 2 * time.Hour, time.Minute} {
+		assert.Nil(t, store.RecordDelivery(&model.Delivery{WebhookID: 1, TemperatureID: 1, Status: model.DeliverySucceeded, CreatedAt: now.Add(-age).Unix()}))
+	}
+	a := App{Store: store, WebhookDeliveryRetention: 24 * time.Hour}
+	a.pruneDeliveries()
+	deliveries, err := store.ListDeliveries(model.DeliveryQuery{WebhookID: 1, Limit: 10})
+	assert.Nil(t, err)
+	assert.Len(t, deliveries, 2)
+
+	a.WebhookDeliveryRetention = time.Hour
+	a.pruneDeliveries()
+	deliveries, err = store.ListDeliveries(model.DeliveryQuery{WebhookID: 1, Limit: 10})
+	assert.Nil(t, err)
+	assert.Len(t, deliveries, 1)
+}
+
+func TestSendEntryInWebhookUnit(t *testing.T) {
+	bodies := map[string]map[string]interface{}{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&m)
+		bodies[r.URL.Path] = m
+	}))
+	defer server.Close()
+	DisableMockups()
+	defer StartMockups()
+	a := App{Store: model.NewMemoryStore()}
+	temperature := model.Temperature{ID: 1, CityID: 1, Max: 20.5, Min: -10, Timestamp: 10000}
+	for _, entry := range []model.OutboxEntry{
+		{Webhook: model.Webhook{ID: 1, CityID: 1, CallbackURL: server.URL + "/celsius"}, Temperature: temperature},
+		{Webhook: model.Webhook{ID: 2, CityID: 1, CallbackURL: server.URL + "/fahrenheit", Unit: model.Fahrenheit}, Temperature: temperature},
+	} {
+		assert.Nil(t, a.sendEntry(entry))
+	}
+	assert.Equal(t, map[string]interface{}{"city_id": 1.0, "max": 20.5, "min": -10.0, "unit": "C", "Timestamp": 10000.0, "received_at": 0.0}, bodies["/celsius"])
+	assert.Equal(t, map[string]interface{}{"city_id": 1.0, "max": 68.9, "min": 14.0, "unit": "F", "Timestamp": 10000.0, "received_at": 0.0}, bodies["/fahrenheit"])
+}
+
+func TestSendEntrySigned(t *testing.T) {
+	headers := map[string]string{}
+	bodies := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers[r.URL.Path] = r.Header.Get(signature.Header)
+		bodies[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+	DisableMockups()
+	defer StartMockups()
+	a := App{Store: model.NewMemoryStore()}
+	temperature := model.Temperature{ID: 1, CityID: 1, Max: 20, Min: 10, Timestamp: 10000}
+	expires := time.Now().Add(time.Hour).Unix()
+	for _, entry := range []model.OutboxEntry{
+		{Webhook: model.Webhook{ID: 1, CityID: 1, CallbackURL: server.URL + "/signed", Secret: "secret"}, Temperature: temperature},
+		{Webhook: model.Webhook{ID: 2, CityID: 1, CallbackURL: server.URL + "/rotated", Secret: "new", PreviousSecret: "old", PreviousSecretExpiresAt: expires}, Temperature: temperature},
+		{Webhook: model.Webhook{ID: 3, CityID: 1, CallbackURL: server.URL + "/expired", Secret: "new", PreviousSecret: "old", PreviousSecretExpiresAt: 10000}, Temperature: temperature},
+		{Webhook: model.Webhook{ID: 4, CityID: 1, CallbackURL: server.URL + "/unsigned"}, Temperature: temperature},
+	} {
+		assert.Nil(t, a.sendEntry(entry))
+	}
+	assert.Nil(t, signature.Verify(headers["/signed"], bodies["/signed"], 0, "secret"))
+	assert.Equal(t, signature.ErrMismatch, signature.Verify(headers["/signed"], bodies["/signed"], 0, "other"))
+	// both secrets sign the deliveries while a secret is rotated
+	assert.Nil(t, signature.Verify(headers["/rotated"], bodies["/rotated"], 0, "old"))
+	assert.Nil(t, signature.Verify(headers["/rotated"], bodies["/rotated"], 0, "new"))
+	assert.Nil(t, signature.Verify(headers["/expired"], bodies["/expired"], 0, "new"))
+	assert.Equal(t, signature.ErrMismatch, signature.Verify(headers["/expired"], bodies["/expired"], 0, "old"))
+	assert.Empty(t, headers["/unsigned"])
+}
+
+func TestDeliverTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	DisableMockups()
+	defer StartMockups()
+	a := App{WebhookMaxAttempts: 1, client: &http.Client{Timeout: 50 * time.Millisecond}}
+	err := a.deliver(server.URL, []byte(`{}`), nil, nil)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "Client.Timeout exceeded")
+	}
+}
+
+func TestOutboxClaimOutlastsRetries(t *testing.T) {
+	assert.Equal(t, 5*(10*time.Second+time.Minute), (&App{}).outboxClaim())
+	a := App{WebhookMaxAttempts: 10, WebhookTimeout: 30 * time.Second, WebhookMaxRetryDelay: 5 * time.Minute}
+	assert.Equal(t, 10*(30*time.Second+5*time.Minute), a.outboxClaim())
+}
+
+func TestExtendClaimsOfPendingDeliveries(t *testing.T) {
+	a, entries := newOutboxApp(t, "http://my.service.com/first", "http://my.service.com/second")
+	a.deliveries = newDeliveryPool(10, 1, Block)
+	assert.True(t, a.deliveries.push(entries[0]))
+	a.extendClaims(time.Hour)
+	// the claim of the queued delivery outlasts the one of the other
+	claimed, err := a.Store.ClaimOutbox(time.Now().Add(30*time.Minute).Unix(), 0, 10)
+	assert.Nil(t, err)
+	if assert.Len(t, claimed, 1) {
+		assert.Equal(t, entries[1].ID, claimed[0].ID)
+	}
+}
+
+func TestWebhookRoutineDeliversOutbox(t *testing.T) {
+	received := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.URL.Path
+	}))
+	defer server.Close()
+	DisableMockups()
+	defer StartMockups()
+	store := model.NewMemoryStore()
+	assert.Nil(t, store.CreateCity(&model.City{Name: "Berlin"}))
+	assert.Nil(t, store.CreateWebhook(&model.Webhook{CityID: 1, CallbackURL: server.URL + "/first"}))
+	assert.Nil(t, store.CreateTemperature(&model.Temperature{CityID: 1, Max: 20, Min: 10, Timestamp: 10000}))
+	// the claim of an instance that stopped before delivering has ended
+	claimed, err := store.ClaimOutbox(time.Now().Unix(), time.Now().Unix()-1, 10)
+	assert.Nil(t, err)
+	assert.Len(t, claimed, 1)
+
+	a := &App{Store: store}
+	a.newTemperature = make(chan model.Temperature, 1)
+	a.startDeliveries()
+	select {
+	case path := <-received:
+		assert.Equal(t, "/first", path)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the pending delivery wasn't resumed")
+	}
+
+	// a new reading wakes up the routine
+	assert.Nil(t, store.CreateWebhook(&model.Webhook{CityID: 1, CallbackURL: server.URL + "/second"}))
+	temperature := &model.Temperature{CityID: 1, Max: 20, Min: 10, Timestamp: 10100}
+	assert.Nil(t, store.CreateTemperature(temperature))
+	a.notifyWebhooks(*temperature)
+	paths := []string{}
+	for len(paths) < 2 {
+		select {
+		case path := <-received:
+			paths = append(paths, path)
+		case <-time.After(time.Second):
+			t.Fatal("the new reading wasn't delivered")
+		}
+	}
+	assert.ElementsMatch(t, []string{"/first", "/second"}, paths)
+}
@@ -0,0 +1,251 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/Deewai/finleap/model"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// integrationBackends are the databases the integration tests run against.
+// SQLite always runs in memory, the others run when their DSN variable is set.
+var integrationBackends = []struct {
+	driver string
+	dsnEnv string
+	reset  []string
+}{
+	{driver: "sqlite"},
+	{
+		driver: "mysql",
+		dsnEnv: "MYSQL_DSN",
+		reset: []string{
+			"DELETE FROM webhook_deliveries", "DELETE FROM webhook_outbox", "DELETE FROM webhooks", "DELETE FROM temperature_rollups", "DELETE FROM temperatures", "DELETE FROM cities",
+			"ALTER TABLE webhooks AUTO_INCREMENT = 1", "ALTER TABLE temperatures AUTO_INCREMENT = 1", "ALTER TABLE cities AUTO_INCREMENT = 1",
+		},
+	},
+	{
+		driver: "postgres",
+		dsnEnv: "POSTGRES_DSN",
+		reset:  []string{"TRUNCATE webhook_deliveries, webhook_outbox, webhooks, temperature_rollups, temperatures, cities RESTART IDENTITY"},
+	},
+}
+
+// forEachBackend runs test against an App initialized on every available
+// integration backend, each starting from empty tables
+func forEachBackend(t *testing.T, test func(t *testing.T, a *App)) {
+	for _, backend := range integrationBackends {
+		backend := backend
+		t.Run(backend.driver, func(t *testing.T) {
+			dsn := ":memory:"
+			if backend.dsnEnv != "" {
+				dsn = os.Getenv(backend.dsnEnv)
+				if dsn == "" {
+					t.Skipf("%s not set, skipping %s", backend.dsnEnv, backend.driver)
+				}
+				resetDatabase(t, backend.driver, dsn, backend.reset)
+			}
+			a := &App{}
+			a.Initialize(backend.driver, dsn)
+			test(t, a)
+		})
+	}
+}
+
+func resetDatabase(t *testing.T, driver, dsn string, statements []string) {
+	db, err := model.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a database connection", err)
+	}
+	defer db.Close()
+	m, err := model.NewMigrator(db, driver)
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when loading migrations", err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatalf("an error '%s' was not expected when migrating", err)
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("an error '%s' was not expected when running %s", err, statement)
+		}
+	}
+}
+
+func doRequest(a *App, method, url string, body interface{}) (*httptest.ResponseRecorder, map[string]interface{}) {
+	var payload []byte
+	if body != nil {
+		payload, _ = json.Marshal(body)
+	}
+	req, _ := http.NewRequest(method, url, bytes.NewBuffer(payload))
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	var m map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &m)
+	return rr, m
+}
+
+func TestIntegrationCityTemperatureForecast(t *testing.T) {
+	forEachBackend(t, testCityTemperatureForecast)
+}
+
+func testCityTemperatureForecast(t *testing.T, a *App) {
+	rr, city := doRequest(a, "POST", "/cities", map[string]interface{}{"name": "O'Fallon", "latitude": 38.59, "longitude": -90.24})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.EqualValues(t, 1, city["id"])
+
+	rr, _ = doRequest(a, "POST", "/cities", map[string]interface{}{"name": "O'Fallon", "latitude": 1, "longitude": 1})
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+
+	// a city without readings has an empty forecast
+	rr, forecast := doRequest(a, "GET", "/forecasts/1", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.EqualValues(t, 0, forecast["sample"])
+	assert.Contains(t, forecast, "max")
+	assert.Nil(t, forecast["max"])
+	assert.Nil(t, forecast["min"])
+	rr, _ = doRequest(a, "GET", "/forecasts/2", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	for _, reading := range []map[string]interface{}{{"city_id": 1, "max": 30, "min": 10}, {"city_id": 1, "max": 20, "min": 5}} {
+		rr, _ = doRequest(a, "POST", "/temperatures", reading)
+		assert.Equal(t, http.StatusCreated, rr.Code)
+	}
+
+	// a backfilled reading older than the forecast window is stored but not used
+	rr, reading := doRequest(a, "POST", "/temperatures", map[string]interface{}{"city_id": 1, "max": 40, "min": 30, "timestamp": "2020-01-26T00:53:20Z"})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.EqualValues(t, 1580000000, reading["timestamp"])
+
+	rr, forecast = doRequest(a, "GET", "/forecasts/1", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.EqualValues(t, 1, forecast["city_id"])
+	assert.EqualValues(t, 25, forecast["max"])
+	assert.EqualValues(t, 7.5, forecast["min"])
+	assert.EqualValues(t, 2, forecast["sample"])
+	rr, forecast = doRequest(a, "GET", "/forecasts/1?window=7d&agg=max-of-maxes", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.EqualValues(t, 30, forecast["max"])
+	assert.EqualValues(t, 10, forecast["min"])
+	// the readings of a single hour are not enough to fit a model to
+	rr, _ = doRequest(a, "GET", "/forecasts/1?model=exponential-smoothing&horizon=3h", nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+
+	rr, _ = doRequest(a, "PATCH", "/cities/1", map[string]interface{}{"name": "St. Louis", "latitude": 38.63, "longitude": -90.2})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	// a plain delete only hides the city, its temperatures are kept
+	rr, _ = doRequest(a, "DELETE", "/cities/1", nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	rr, _ = doRequest(a, "GET", "/cities/1", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr, _ = doRequest(a, "DELETE", "/cities/1", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr, city = doRequest(a, "POST", "/cities/1/restore", nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.EqualValues(t, "St. Louis", city["name"])
+	rr, forecast = doRequest(a, "GET", "/forecasts/1", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.EqualValues(t, 2, forecast["sample"])
+	rr, _ = doRequest(a, "POST", "/cities/1/restore", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr, _ = doRequest(a, "DELETE", "/cities/1?cascade=true", nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	rr, _ = doRequest(a, "POST", "/cities/1/restore", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	rr, _ = doRequest(a, "GET", "/forecasts/1", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestIntegrationTemperatureBatch(t *testing.T) {
+	forEachBackend(t, testTemperatureBatch)
+}
+
+func testTemperatureBatch(t *testing.T, a *App) {
+	rr, _ := doRequest(a, "POST", "/cities", map[string]interface{}{"name": "Berlin", "latitude": 52.52, "longitude": 13.405})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	readings := []map[string]interface{}{}
+	for i := 0; i < 150; i++ {
+		readings = append(readings, map[string]interface{}{"city_id": 1, "max": 20 + i%2*10, "min": 10})
+	}
+	readings = append(readings, map[string]interface{}{"city_id": 2, "max": 20, "min": 10})
+	rr, batch := doRequest(a, "POST", "/temperatures/batch", readings)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.EqualValues(t, 150, batch["accepted"])
+	assert.EqualValues(t, 1, batch["rejected"])
+
+	rr, forecast := doRequest(a, "GET", "/forecasts/1", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.EqualValues(t, 25, forecast["max"])
+	assert.EqualValues(t, 150, forecast["sample"])
+	rr, forecasts := doRequest(a, "GET", "/forecasts?city_ids=1,2&agg=median", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	if assert.Len(t, forecasts, 2) {
+		assert.EqualValues(t, 25, forecasts["1"].(map[string]interface{})["max"])
+		assert.EqualValues(t, 150, forecasts["1"].(map[string]interface{})["sample"])
+		assert.EqualValues(t, http.StatusNotFound, forecasts["2"].(map[string]interface{})["code"])
+	}
+	rr, forecasts = doRequest(a, "GET", "/forecasts", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Len(t, forecasts, 1)
+	// page through the history of city 1
+	seen := 0
+	url := "/cities/1/temperatures?limit=40"
+	for url != "" {
+		rr, page := doRequest(a, "GET", url, nil)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		seen += len(page["temperatures"].([]interface{}))
+		url = ""
+		if cursor, ok := page["next_cursor"].(string); ok {
+			url = "/cities/1/temperatures?limit=40&cursor=" + cursor
+		}
+	}
+	assert.Equal(t, 150, seen)
+
+	rr, rollup := doRequest(a, "GET", "/cities/1/temperatures/rollup?bucket=1d", nil)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rollups := rollup["rollups"].([]interface{})
+	if assert.Len(t, rollups, 1) {
+		bucket := rollups[0].(map[string]interface{})
+		assert.EqualValues(t, 150, bucket["count"])
+		assert.EqualValues(t, 30, bucket["max"])
+		assert.EqualValues(t, 25, bucket["avg_max"])
+	}
+}
+
+func TestIntegrationWebhooks(t *testing.T) {
+	forEachBackend(t, testWebhooks)
+}
+
+func testWebhooks(t *testing.T, a *App) {
+	rr, _ := doRequest(a, "POST", "/cities", map[string]interface{}{"name": "Berlin", "latitude": 52.52, "longitude": 13.405})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+
+	rr, webhook := doRequest(a, "POST", "/webhooks", map[string]interface{}{"city_id": 1, "callback_url": "https://my.service.com/high-temperature"})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.EqualValues(t, 1, webhook["id"])
+
+	rr, _ = doRequest(a, "POST", "/webhooks", map[string]interface{}{"city_id": 2, "callback_url": "https://my.service.com/high-temperature"})
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr, _ = doRequest(a, "DELETE", "/webhooks/1", nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	rr, _ = doRequest(a, "DELETE", "/webhooks/1", nil)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	rr, _ = doRequest(a, "POST", "/webhooks", map[string]interface{}{"city_id": 1, "callback_url": "https://my.service.com/other"})
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	rr, _ = doRequest(a, "DELETE", "/cities/1?cascade=true", nil)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	webhooks, err := a.Store.GetWebhooks()
+	assert.Nil(t, err)
+	assert.Empty(t, webhooks)
+}
@@ -0,0 +1,236 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+// mergePatch applies an RFC 7396 JSON Merge Patch to target
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = mergePatch(targetObject[key], value)
+	}
+	return targetObject
+}
+
+// patchOperation is one operation of an RFC 6902 JSON Patch
+type patchOperation struct {
+	Op    string           `json:"op"`
+	Path  string           `json:"path"`
+	From  string           `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+// jsonPatch applies an RFC 6902 JSON Patch to doc. Operations are applied in
+// order and the whole patch fails if any of them does.
+func jsonPatch(doc interface{}, operations []patchOperation) (interface{}, error) {
+	var err error
+	for _, op := range operations {
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("Missing value for %s operation", op.Op)
+			}
+			var value interface{}
+			if err := json.Unmarshal(*op.Value, &value); err != nil {
+				return nil, err
+			}
+			switch op.Op {
+			case "add":
+				doc, err = pointerAdd(doc, op.Path, value)
+			case "replace":
+				if doc, _, err = pointerRemove(doc, op.Path); err == nil {
+					doc, err = pointerAdd(doc, op.Path, value)
+				}
+			case "test":
+				var current interface{}
+				if current, err = pointerGet(doc, op.Path); err == nil && !reflect.DeepEqual(current, value) {
+					err = fmt.Errorf("Test failed for path %s", op.Path)
+				}
+			}
+		case "remove":
+			doc, _, err = pointerRemove(doc, op.Path)
+		case "move":
+			var value interface{}
+			if doc, value, err = pointerRemove(doc, op.From); err == nil {
+				doc, err = pointerAdd(doc, op.Path, value)
+			}
+		case "copy":
+			var value interface{}
+			if value, err = pointerGet(doc, op.From); err == nil {
+				doc, err = pointerAdd(doc, op.Path, value)
+			}
+		default:
+			err = fmt.Errorf("Invalid patch operation '%s'", op.Op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+// splitPointer splits an RFC 6901 JSON Pointer into its reference tokens
+func splitPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("Invalid path '%s'", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+func arrayIndex(token string, length int, appending bool) (int, error) {
+	if appending && token == "-" {
+		return length, nil
+	}
+	index, err := strconv.Atoi(token)
+	limit := length
+	if appending {
+		limit++
+	}
+	if err != nil || index < 0 || index >= limit {
+		return 0, fmt.Errorf("Invalid array index '%s'", token)
+	}
+	return index, nil
+}
+
+func pointerGet(doc interface{}, pointer string) (interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("Path '%s' does not exist", pointer)
+			}
+			doc = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, fmt.Errorf("Path '%s' does not exist", pointer)
+		}
+	}
+	return doc, nil
+}
+
+// pointerUpdate replaces the parent of the location pointer refers to with
+// the result of update, which gets the parent and the last token
+func pointerUpdate(doc interface{}, pointer string, update func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	tokens, err := splitPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("Patching the whole document is not supported")
+	}
+	parentPointer := ""
+	for _, token := range tokens[:len(tokens)-1] {
+		parentPointer += "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+	}
+	parent, err := pointerGet(doc, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+	updated, err := update(parent, tokens[len(tokens)-1])
+	if err != nil {
+		return nil, err
+	}
+	if parentPointer == "" {
+		return updated, nil
+	}
+	// arrays may have been reallocated, so the new parent is stored back
+	return pointerUpdate(doc, parentPointer, func(grandparent interface{}, token string) (interface{}, error) {
+		switch node := grandparent.(type) {
+		case map[string]interface{}:
+			node[token] = updated
+			return node, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			node[index] = updated
+			return node, nil
+		}
+		return nil, fmt.Errorf("Path '%s' does not exist", parentPointer)
+	})
+}
+
+func pointerAdd(doc interface{}, pointer string, value interface{}) (interface{}, error) {
+	return pointerUpdate(doc, pointer, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("Path '%s' does not exist", pointer)
+	})
+}
+
+func pointerRemove(doc interface{}, pointer string) (interface{}, interface{}, error) {
+	var removed interface{}
+	doc, err := pointerUpdate(doc, pointer, func(parent interface{}, token string) (interface{}, error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("Path '%s' does not exist", pointer)
+			}
+			removed = value
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[index]
+			return append(node[:index], node[index+1:]...), nil
+		}
+		return nil, fmt.Errorf("Path '%s' does not exist", pointer)
+	})
+	return doc, removed, err
+}
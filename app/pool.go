@@ -0,0 +1,200 @@
+package app
+
+import (
+	"fmt"
+	"github.com/Deewai/finleap/model"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+)
+
+// BackpressurePolicy is what happens when a delivery is queued while the
+// delivery queue is full
+type BackpressurePolicy string
+
+const (
+	// Block waits for a worker to take a queued delivery
+	Block BackpressurePolicy = "block"
+	// DropOldest drops the oldest queued delivery. It stays in the outbox and
+	// is delivered once its claim ends.
+	DropOldest BackpressurePolicy = "drop-oldest"
+	// Reject waits like Block, and new readings are answered with 503 until
+	// the queue has room again
+	Reject BackpressurePolicy = "reject"
+)
+
+const (
+	defaultWebhookWorkers        = 10
+	defaultWebhookWorkersPerHost = 2
+	defaultWebhookQueueSize      = 1000
+)
+
+// ParseBackpressurePolicy returns the BackpressurePolicy named name, Block
+// when it is empty
+func ParseBackpressurePolicy(name string) (BackpressurePolicy, error) {
+	switch policy := BackpressurePolicy(name); policy {
+	case "":
+		return Block, nil
+	case Block, DropOldest, Reject:
+		return policy, nil
+	}
+	return "", fmt.Errorf("Unsupported backpressure policy '%s'", name)
+}
+
+// deliveryPool queues the claimed deliveries for the workers. A worker takes
+// the oldest delivery whose host isn't already served by perHost workers, so
+// that a slow host holds up its own deliveries only. A delivery claimed again
+// while it is queued or in progress is queued once.
+type deliveryPool struct {
+	lock    sync.Mutex
+	changed *sync.Cond
+	queue   []model.OutboxEntry
+	size    int
+	perHost int
+	policy  BackpressurePolicy
+	// active counts the deliveries in progress per host
+	active map[string]int
+	// pending holds the outbox ids of the queued deliveries and of the ones
+	// in progress
+	pending map[int]bool
+}
+
+func newDeliveryPool(size, perHost int, policy BackpressurePolicy) *deliveryPool {
+	if size < 1 {
+		size = defaultWebhookQueueSize
+	}
+	if perHost < 1 {
+		perHost = defaultWebhookWorkersPerHost
+	}
+	if policy == "" {
+		policy = Block
+	}
+	p := &deliveryPool{size: size, perHost: perHost, policy: policy, active: make(map[string]int), pending: make(map[int]bool)}
+	p.changed = sync.NewCond(&p.lock)
+	return p
+}
+
+// callbackHost returns the host deliveries to callbackURL are limited by
+func callbackHost(callbackURL string) string {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// push queues entry, applying the policy when the queue is full. It returns
+// false when the entry is queued or in progress already.
+func (p *deliveryPool) push(entry model.OutboxEntry) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pending[entry.ID] {
+		return false
+	}
+	if len(p.queue) >= p.size && p.policy == DropOldest {
+		log.Printf("delivery queue full, delivery %d is dropped until its claim ends", p.queue[0].ID)
+		delete(p.pending, p.queue[0].ID)
+		p.queue = p.queue[1:]
+	}
+	for len(p.queue) >= p.size {
+		p.changed.Wait()
+		if p.pending[entry.ID] {
+			return false
+		}
+	}
+	p.queue = append(p.queue, entry)
+	p.pending[entry.ID] = true
+	p.changed.Broadcast()
+	return true
+}
+
+// pop takes the oldest queued delivery whose host has room for another
+// one, waiting until there is one. The delivery is reported with done.
+func (p *deliveryPool) pop() (model.OutboxEntry, string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for {
+		for i, entry := range p.queue {
+			host := callbackHost(entry.Webhook.CallbackURL)
+			if p.active[host] < p.perHost {
+				p.queue = append(p.queue[:i:i], p.queue[i+1:]...)
+				p.active[host]++
+				p.changed.Broadcast()
+				return entry, host
+			}
+		}
+		p.changed.Wait()
+	}
+}
+
+// done reports the delivery id to host taken with pop as finished
+func (p *deliveryPool) done(id int, host string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.pending, id)
+	p.active[host]--
+	if p.active[host] <= 0 {
+		delete(p.active, host)
+	}
+	p.changed.Broadcast()
+}
+
+// pendingIDs returns the outbox ids of the deliveries queued or in progress
+func (p *deliveryPool) pendingIDs() []int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ids := make([]int, 0, len(p.pending))
+	for id := range p.pending {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// rejecting reports whether new readings are to be rejected
+func (p *deliveryPool) rejecting() bool {
+	if p == nil || p.policy != Reject {
+		return false
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.queue) >= p.size
+}
+
+// rejectWhenBusy answers with 503 and returns true when the delivery queue is
+// full and new readings are rejected
+func (a *App) rejectWhenBusy(w http.ResponseWriter) bool {
+	if !a.deliveries.rejecting() {
+		return false
+	}
+	w.Header().Set("Retry-After", "1")
+	respondWithError(w, Error{Code: http.StatusServiceUnavailable, Error: "Webhook delivery queue is full, retry later"})
+	return true
+}
+
+// startDeliveries starts the workers delivering webhooks and the routine
+// feeding them from the outbox
+func (a *App) startDeliveries() {
+	a.deliveries = newDeliveryPool(a.WebhookQueueSize, a.WebhookWorkersPerHost, a.WebhookBackpressure)
+	workers := a.WebhookWorkers
+	if workers < 1 {
+		workers = defaultWebhookWorkers
+	}
+	for i := 0; i < workers; i++ {
+		go a.deliveryWorker()
+	}
+	go a.webhookRoutine()
+	go a.extendClaimsRoutine()
+}
+
+func (a *App) deliveryWorker() {
+	for {
+		entry, host := a.deliveries.pop()
+		if err := a.sendEntry(entry); err != nil {
+			log.Printf("webhook %d: %v", entry.Webhook.ID, err)
+		}
+		a.deliveries.done(entry.ID, host)
+	}
+}
@@ -0,0 +1,213 @@
+package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Deewai/finleap/model"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func entryTo(id int, url string) model.OutboxEntry {
+	return model.OutboxEntry{ID: id, Webhook: model.Webhook{ID: id, CityID: 1, CallbackURL: url}}
+}
+
+// popping starts n workers taking deliveries from p and returns the ids of
+// the deliveries they take
+func popping(p *deliveryPool, n int) chan int {
+	ids := make(chan int, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			entry, _ := p.pop()
+			ids <- entry.ID
+		}()
+	}
+	return ids
+}
+
+// received returns the ids taken until none is for a moment
+func received(ids chan int) []int {
+	result := []int{}
+	for {
+		select {
+		case id := <-ids:
+			result = append(result, id)
+		case <-time.After(100 * time.Millisecond):
+			return result
+		}
+	}
+}
+
+func TestParseBackpressurePolicy(t *testing.T) {
+	for name, policy := range map[string]BackpressurePolicy{"": Block, "block": Block, "drop-oldest": DropOldest, "reject": Reject} {
+		parsed, err := ParseBackpressurePolicy(name)
+		assert.Nil(t, err)
+		assert.Equal(t, policy, parsed)
+	}
+	_, err := ParseBackpressurePolicy("drop-newest")
+	assert.NotNil(t, err)
+}
+
+func TestDeliveryPoolLimitsDeliveriesPerHost(t *testing.T) {
+	p := newDeliveryPool(10, 2, Block)
+	for i, url := range []string{"http://slow.com/a", "http://slow.com/b", "http://slow.com/c", "http://fast.com/a"} {
+		p.push(entryTo(i+1, url))
+	}
+	ids := popping(p, 4)
+	// the third delivery to slow.com waits for one of the first two
+	assert.ElementsMatch(t, []int{1, 2, 4}, received(ids))
+	p.done(1, "slow.com")
+	assert.Equal(t, []int{3}, received(ids))
+}
+
+func TestDeliveryPoolQueuesEntriesOnce(t *testing.T) {
+	p := newDeliveryPool(10, 1, DropOldest)
+	assert.True(t, p.push(entryTo(1, "http://slow.com/a")))
+	assert.True(t, p.push(entryTo(2, "http://slow.com/b")))
+	assert.Equal(t, []int{1}, received(popping(p, 1)))
+	// both are claimed again while one is in progress and the other queued
+	assert.False(t, p.push(entryTo(1, "http://slow.com/a")))
+	assert.False(t, p.push(entryTo(2, "http://slow.com/b")))
+	p.done(1, "slow.com")
+	assert.Equal(t, []int{2}, received(popping(p, 2)))
+	// a finished delivery can be queued again
+	assert.True(t, p.push(entryTo(1, "http://slow.com/a")))
+
+	// so can a dropped one
+	p = newDeliveryPool(1, 1, DropOldest)
+	assert.True(t, p.push(entryTo(1, "http://slow.com/a")))
+	assert.True(t, p.push(entryTo(2, "http://slow.com/b")))
+	assert.True(t, p.push(entryTo(1, "http://slow.com/a")))
+}
+
+func TestDeliveryWorkersDeliverEachEntryOnceToBlockedHost(t *testing.T) {
+	release := make(chan struct{})
+	var lock sync.Mutex
+	requests := map[string]int{}
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests[r.URL.Path]++
+		lock.Unlock()
+		<-release
+	}))
+	defer blocked.Close()
+	DisableMockups()
+	defer StartMockups()
+
+	store := model.NewMemoryStore()
+	assert.Nil(t, store.CreateCity(&model.City{Name: "Berlin"}))
+	for _, path := range []string{"/a", "/b", "/c"} {
+		assert.Nil(t, store.CreateWebhook(&model.Webhook{CityID: 1, CallbackURL: blocked.URL + path}))
+	}
+	assert.Nil(t, store.CreateTemperature(&model.Temperature{CityID: 1, Max: 20, Min: 10, Timestamp: 10000}))
+	a := &App{Store: store, WebhookMaxAttempts: 1}
+	a.deliveries = newDeliveryPool(10, 1, Block)
+	for i := 0; i < 3; i++ {
+		go a.deliveryWorker()
+	}
+	// every poll claims the entries again, as their claims have ended while
+	// the host is blocked
+	for poll := int64(1); poll <= 5; poll++ {
+		entries, err := store.ClaimOutbox(poll*1000, poll*1000, 10)
+		assert.Nil(t, err)
+		assert.Len(t, entries, 3)
+		for _, entry := range entries {
+			assert.Equal(t, poll == 1, a.deliveries.push(entry))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	assert.Eventually(t, func() bool {
+		for id := 1; id <= 3; id++ {
+			if deliveries, _ := store.ListDeliveries(model.DeliveryQuery{WebhookID: id, Limit: 10}); len(deliveries) == 0 {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, map[string]int{"/a": 1, "/b": 1, "/c": 1}, requests)
+}
+
+func TestDeliveryPoolBackpressure(t *testing.T) {
+	p := newDeliveryPool(2, 2, DropOldest)
+	for i := 1; i <= 3; i++ {
+		p.push(entryTo(i, "http://my.service.com"))
+	}
+	assert.ElementsMatch(t, []int{2, 3}, received(popping(p, 2)))
+
+	p = newDeliveryPool(1, 2, Block)
+	p.push(entryTo(1, "http://my.service.com"))
+	pushed := make(chan bool)
+	go func() {
+		p.push(entryTo(2, "http://my.service.com"))
+		pushed <- true
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("a full queue took another delivery")
+	case <-time.After(50 * time.Millisecond):
+	}
+	entry, _ := p.pop()
+	assert.Equal(t, 1, entry.ID)
+	<-pushed
+
+	p = newDeliveryPool(1, 2, Reject)
+	assert.False(t, p.rejecting())
+	p.push(entryTo(1, "http://my.service.com"))
+	assert.True(t, p.rejecting())
+}
+
+func TestHandleCreateTemperatureRejectedWhenQueueFull(t *testing.T) {
+	a := App{}
+	a.deliveries = newDeliveryPool(1, 1, Reject)
+	a.deliveries.push(entryTo(1, "http://my.service.com"))
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	for _, path := range []string{"/temperatures", "/temperatures/batch"} {
+		body, _ := json.Marshal(map[string]interface{}{"city_id": 1, "max": 30, "min": 10})
+		req, _ := http.NewRequest("POST", path, bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+		assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+	}
+}
+
+func TestDeliveryWorkersAreNotHeldUpBySlowHost(t *testing.T) {
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer slow.Close()
+	defer close(release)
+	delivered := make(chan bool)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- true
+	}))
+	defer fast.Close()
+	DisableMockups()
+	defer StartMockups()
+
+	store := model.NewMemoryStore()
+	assert.Nil(t, store.CreateCity(&model.City{Name: "Berlin"}))
+	for _, url := range []string{slow.URL + "/a", slow.URL + "/b", slow.URL + "/c", fast.URL} {
+		assert.Nil(t, store.CreateWebhook(&model.Webhook{CityID: 1, CallbackURL: url}))
+	}
+	assert.Nil(t, store.CreateTemperature(&model.Temperature{CityID: 1, Max: 20, Min: 10, Timestamp: 10000}))
+	a := &App{Store: store, WebhookWorkers: 2, WebhookWorkersPerHost: 1}
+	a.newTemperature = make(chan model.Temperature, 1)
+	a.startDeliveries()
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a slow host held up the others")
+	}
+}
@@ -1,69 +1,582 @@
 package app
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/Deewai/finleap/forecast"
 	"github.com/Deewai/finleap/model"
+	"io"
+	"log"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
-func (a *App) sendTemperature(temp model.Temperature) error {
-	invalidError := errors.New("Missing fields in temperature object")
-	if temp.CityID == 0 || temp.Timestamp == 0 {
-		return invalidError
-	}
-	receiverUrls := []string{}
-	a.Webhooks.lock.Lock()
-	for _, hook := range a.Webhooks.Webhooks {
-		if hook.CityID == temp.CityID {
-			receiverUrls = append(receiverUrls, hook.CallbackURL)
-		}
-	}
-	a.Webhooks.lock.Unlock()
-	if len(receiverUrls) == 0 {
-		return nil
-	}
-	requestBody, _ := json.Marshal(map[string]interface{}{
-		"city_id":   temp.CityID,
-		"max":       temp.Max,
-		"min":       temp.Min,
-		"Timestamp": temp.Timestamp,
-	})
-	for _, url := range receiverUrls {
-		_, err := a.sendRequest(url, requestBody)
-		if err != nil {
-			return err
-		}
+// defaultTimestampSkew is how far in the future a measurement time may be
+// when App.TimestampSkew is not set
+const defaultTimestampSkew = 5 * time.Minute
+
+type temperaturePayload struct {
+	CityID int     `json:"city_id"`
+	Max    float64 `json:"max"`
+	Min    float64 `json:"min"`
+	// Unit is the unit of Max and Min, Celsius when empty
+	Unit string `json:"unit"`
+	// Timestamp is the optional measurement time, either a unix timestamp or
+	// an RFC 3339 string
+	Timestamp json.RawMessage `json:"timestamp"`
+}
+
+// parseTimestamp reads a unix timestamp or an RFC 3339 string. ok is false
+// when raw holds no timestamp.
+func parseTimestamp(raw json.RawMessage) (timestamp int64, ok bool, err error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, false, nil
+	}
+	if err := json.Unmarshal(raw, &timestamp); err == nil {
+		return timestamp, true, nil
+	}
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return 0, false, errors.New("must be a unix timestamp or an RFC 3339 string")
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, false, errors.New("must be a unix timestamp or an RFC 3339 string")
+	}
+	return parsed.Unix(), true, nil
+}
+
+// checkTimestamp reports why a measurement time is outside the accepted window
+// around now, or returns nil
+func (a *App) checkTimestamp(timestamp int64, now time.Time) error {
+	// the unix time 0 can't be stored, and stands for no bound when listing
+	if timestamp <= 0 {
+		return errors.New("must be after the unix epoch")
+	}
+	skew := a.TimestampSkew
+	if skew == 0 {
+		skew = defaultTimestampSkew
+	}
+	if timestamp > now.Add(skew).Unix() {
+		return fmt.Errorf("must not be more than %v in the future", skew)
+	}
+	if a.TimestampMaxAge > 0 && timestamp < now.Add(-a.TimestampMaxAge).Unix() {
+		return fmt.Errorf("must not be more than %v in the past", a.TimestampMaxAge)
 	}
 	return nil
 }
 
+// temperature validates payload and returns the reading it describes,
+// received at now
+func (a *App) temperature(payload temperaturePayload, now time.Time) (*model.Temperature, []FieldError) {
+	fields := []FieldError{}
+	if payload.CityID <= 0 {
+		fields = append(fields, FieldError{Field: "city_id", Error: "is required"})
+	}
+	unit := model.Celsius
+	if payload.Unit != "" {
+		var err error
+		if unit, err = model.ParseUnit(payload.Unit); err != nil {
+			fields = append(fields, FieldError{Field: "unit", Error: err.Error()})
+		}
+	}
+	// readings are stored in Celsius
+	temperature := &model.Temperature{CityID: payload.CityID, Max: unit.ToCelsius(payload.Max), Min: unit.ToCelsius(payload.Min), Timestamp: now.Unix(), ReceivedAt: now.Unix()}
+	if err := model.CheckCelsius(temperature.Max); err != nil {
+		fields = append(fields, FieldError{Field: "max", Error: err.Error()})
+	}
+	if err := model.CheckCelsius(temperature.Min); err != nil {
+		fields = append(fields, FieldError{Field: "min", Error: err.Error()})
+	}
+	timestamp, ok, err := parseTimestamp(payload.Timestamp)
+	if err == nil && ok {
+		err = a.checkTimestamp(timestamp, now)
+		temperature.Timestamp = timestamp
+	}
+	if err != nil {
+		fields = append(fields, FieldError{Field: "timestamp", Error: err.Error()})
+	}
+	return temperature, fields
+}
+
 //handler for "/temperatures" POST endpoint
 func (a *App) handleCreateTemperature(w http.ResponseWriter, r *http.Request) {
-	var temperature *model.Temperature
+	if a.rejectWhenBusy(w) {
+		return
+	}
+	unit, err := responseUnit(r)
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: err.Error()})
+		return
+	}
+	var payload temperaturePayload
 	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&temperature); err != nil {
+	if err := decoder.Decode(&payload); err != nil {
 		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid resquest payload")})
 		return
 	}
-	if temperature.CityID == 0 {
+	if payload.CityID == 0 {
 		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid city id %v", r.FormValue("city_id"))})
 		return
 	}
 	defer r.Body.Close()
-	temperature.Timestamp = time.Now().Unix()
-	err := temperature.Create(a.DB)
+	temperature, fields := a.temperature(payload, time.Now())
+	if len(fields) > 0 {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: "Invalid temperature", Fields: fields})
+		return
+	}
+	// like in batches, readings of unknown and deleted cities are rejected
+	err = a.Store.GetCity(&model.City{ID: temperature.CityID})
+	if err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			respondWithError(w, Error{Code: http.StatusNotFound, Error: err.Error()})
+			return
+		}
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	err = a.Store.CreateTemperature(temperature)
 	if err != nil {
 		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
 		return
 	}
-	a.newTemperature <- *temperature
-	respondWithJSON(w, http.StatusCreated, temperature)
+	a.forecasts.invalidate(temperature.CityID)
+	a.notifyWebhooks(*temperature)
+	respondWithJSON(w, http.StatusCreated, temperature.In(unit))
+}
+
+const (
+	// maxTemperatureBatch is the number of readings POST /temperatures/batch
+	// accepts at once
+	maxTemperatureBatch = 10000
+	ndjsonContentType   = "application/x-ndjson"
+)
+
+// temperatureResult is the outcome for one reading of a batch
+type temperatureResult struct {
+	Index       int                `json:"index"`
+	Status      string             `json:"status"`
+	Temperature *model.Temperature `json:"temperature,omitempty"`
+	Error       string             `json:"error,omitempty"`
+	Fields      []FieldError       `json:"fields,omitempty"`
+}
+
+type temperatureBatch struct {
+	Accepted int                 `json:"accepted"`
+	Rejected int                 `json:"rejected"`
+	Results  []temperatureResult `json:"results"`
+}
+
+// decodeTemperatureBatch splits body into its readings. It is a JSON array,
+// or an NDJSON stream when contentType says so.
+func decodeTemperatureBatch(body io.Reader, contentType string) ([]json.RawMessage, error) {
+	items := []json.RawMessage{}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType == ndjsonContentType {
+		scanner := bufio.NewScanner(body)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			if len(items) == maxTemperatureBatch {
+				return nil, fmt.Errorf("Too many readings, at most %d are accepted", maxTemperatureBatch)
+			}
+			items = append(items, json.RawMessage(append([]byte{}, line...)))
+		}
+		return items, scanner.Err()
+	}
+	decoder := json.NewDecoder(body)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return nil, errors.New("Expected a JSON array of readings")
+	}
+	for decoder.More() {
+		if len(items) == maxTemperatureBatch {
+			return nil, fmt.Errorf("Too many readings, at most %d are accepted", maxTemperatureBatch)
+		}
+		var item json.RawMessage
+		if err := decoder.Decode(&item); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+//handler for "/temperatures/batch" POST endpoint
+func (a *App) handleCreateTemperatureBatch(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if a.rejectWhenBusy(w) {
+		return
+	}
+	unit, err := responseUnit(r)
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: err.Error()})
+		return
+	}
+	items, err := decodeTemperatureBatch(r.Body, r.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: err.Error()})
+		return
+	}
+	now := time.Now()
+	batch := temperatureBatch{Results: make([]temperatureResult, len(items))}
+	accepted := []*model.Temperature{}
+	// cities maps the city ids seen so far to whether they exist
+	cities := map[int]bool{}
+	for i, item := range items {
+		result := &batch.Results[i]
+		result.Index = i
+		result.Status = "rejected"
+		var payload temperaturePayload
+		if err := json.Unmarshal(item, &payload); err != nil {
+			result.Error = "Invalid JSON"
+			continue
+		}
+		temperature, fields := a.temperature(payload, now)
+		if len(fields) == 0 {
+			exists, ok := cities[payload.CityID]
+			if !ok {
+				err := a.Store.GetCity(&model.City{ID: payload.CityID})
+				if err != nil && !strings.Contains(err.Error(), "no rows in result set") {
+					respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+					return
+				}
+				exists = err == nil
+				cities[payload.CityID] = exists
+			}
+			if !exists {
+				fields = append(fields, FieldError{Field: "city_id", Error: "City doesn't exist"})
+			}
+		}
+		if len(fields) > 0 {
+			result.Error = "Invalid temperature"
+			result.Fields = fields
+			continue
+		}
+		result.Status = "accepted"
+		result.Temperature = temperature
+		accepted = append(accepted, temperature)
+	}
+	if len(accepted) > 0 {
+		if err := a.Store.CreateTemperatures(accepted); err != nil {
+			respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+			return
+		}
+	}
+	invalidated := map[int]bool{}
+	for _, temperature := range accepted {
+		if !invalidated[temperature.CityID] {
+			invalidated[temperature.CityID] = true
+			a.forecasts.invalidate(temperature.CityID)
+		}
+	}
+	batch.Accepted = len(accepted)
+	batch.Rejected = len(items) - len(accepted)
+	for i := range batch.Results {
+		if t := batch.Results[i].Temperature; t != nil {
+			converted := t.In(unit)
+			batch.Results[i].Temperature = &converted
+		}
+	}
+	for _, temperature := range accepted {
+		a.notifyWebhooks(*temperature)
+	}
+	respondWithJSON(w, http.StatusOK, batch)
+}
+
+const (
+	defaultTemperaturePageSize = 100
+	maxTemperaturePageSize     = 1000
+	csvContentType             = "text/csv"
+)
+
+// temperatureCursor points after the last reading of a page of
+// GET /cities/{id}/temperatures
+type temperatureCursor struct {
+	Timestamp int64 `json:"t"`
+	ID        int   `json:"i"`
+}
+
+type temperaturePage struct {
+	Temperatures []model.Temperature `json:"temperatures"`
+	NextCursor   string              `json:"next_cursor,omitempty"`
+}
+
+func encodeTemperatureCursor(c temperatureCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeTemperatureCursor(s string) (temperatureCursor, error) {
+	var c temperatureCursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, errors.New("Invalid cursor")
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, errors.New("Invalid cursor")
+	}
+	return c, nil
+}
+
+// parseTime reads a query parameter holding a unix timestamp or an RFC 3339
+// string
+func parseTime(value string) (int64, error) {
+	if timestamp, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return timestamp, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, err
+	}
+	return parsed.Unix(), nil
+}
+
+// respondWithTemperatureCSV writes page as CSV, the cursor of the next page
+// goes in the X-Next-Cursor header
+func respondWithTemperatureCSV(w http.ResponseWriter, page temperaturePage) {
+	w.Header().Set("Content-Type", csvContentType+"; charset=utf-8")
+	if page.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+	w.WriteHeader(http.StatusOK)
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "city_id", "max", "min", "unit", "timestamp", "received_at"})
+	for _, t := range page.Temperatures {
+		writer.Write([]string{
+			strconv.Itoa(t.ID),
+			strconv.Itoa(t.CityID),
+			strconv.FormatFloat(t.Max, 'f', -1, 64),
+			strconv.FormatFloat(t.Min, 'f', -1, 64),
+			string(t.Unit),
+			strconv.FormatInt(t.Timestamp, 10),
+			strconv.FormatInt(t.ReceivedAt, 10),
+		})
+	}
+	writer.Flush()
+	// the status is sent already, a failed write can only be logged
+	if err := writer.Error(); err != nil {
+		log.Printf("failed to write CSV response: %v", err)
+	}
+}
+
+//handler for "/cities/:id/temperatures" GET endpoint
+func (a *App) handleListTemperatures(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid city id %v", params["id"])})
+		return
+	}
+	unit, err := responseUnit(r)
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: err.Error()})
+		return
+	}
+	values := r.URL.Query()
+	query := model.TemperatureQuery{CityID: id, Limit: defaultTemperaturePageSize}
+	for name, bound := range map[string]*int64{"from": &query.From, "to": &query.To} {
+		if value := values.Get(name); value != "" {
+			if *bound, err = parseTime(value); err != nil {
+				respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid %s value '%v'", name, value)})
+				return
+			}
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid limit value '%v'", limit)})
+			return
+		}
+		if n > maxTemperaturePageSize {
+			n = maxTemperaturePageSize
+		}
+		query.Limit = n
+	}
+	if cursor := values.Get("cursor"); cursor != "" {
+		c, err := decodeTemperatureCursor(cursor)
+		if err != nil {
+			respondWithError(w, Error{Code: http.StatusBadRequest, Error: err.Error()})
+			return
+		}
+		query.After = &model.Temperature{ID: c.ID, Timestamp: c.Timestamp}
+	}
+	err = a.Store.GetCity(&model.City{ID: id})
+	if err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			respondWithError(w, Error{Code: http.StatusNotFound, Error: err.Error()})
+			return
+		}
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	// ask for one more reading than the page holds to know whether a next page exists
+	pageSize := query.Limit
+	query.Limit++
+	temperatures, err := a.Store.ListTemperatures(query)
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	page := temperaturePage{Temperatures: temperatures}
+	if len(temperatures) > pageSize {
+		page.Temperatures = temperatures[:pageSize]
+		last := page.Temperatures[pageSize-1]
+		page.NextCursor = encodeTemperatureCursor(temperatureCursor{Timestamp: last.Timestamp, ID: last.ID})
+	}
+	for i, t := range page.Temperatures {
+		page.Temperatures[i] = t.In(unit)
+	}
+	if negotiate(r, "application/json", csvContentType) == csvContentType {
+		respondWithTemperatureCSV(w, page)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, page)
+}
+
+const (
+	defaultRollupBucket = "1h"
+	// defaultRollupBuckets is the number of buckets returned when from is
+	// not given
+	defaultRollupBuckets = 24
+	maxRollupBuckets     = 10000
+)
+
+type rollupPage struct {
+	CityID  int            `json:"city_id"`
+	Bucket  string         `json:"bucket"`
+	From    int64          `json:"from"`
+	To      int64          `json:"to"`
+	Unit    model.Unit     `json:"unit"`
+	Rollups []model.Rollup `json:"rollups"`
+}
+
+//handler for "/cities/:id/temperatures/rollup" GET endpoint
+func (a *App) handleTemperatureRollup(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid city id %v", params["id"])})
+		return
+	}
+	values := r.URL.Query()
+	bucket := values.Get("bucket")
+	if bucket == "" {
+		bucket = defaultRollupBucket
+	}
+	size, err := parseWindow(bucket)
+	if err == nil {
+		_, err = model.RollupResolution(int64(size / time.Second))
+	}
+	if err != nil || size%time.Second != 0 {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid bucket value '%v', it must be a whole number of hours", bucket)})
+		return
+	}
+	seconds := int64(size / time.Second)
+	page := rollupPage{CityID: id, Bucket: bucket, To: time.Now().Unix()}
+	if page.Unit, err = responseUnit(r); err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: err.Error()})
+		return
+	}
+	if value := values.Get("to"); value != "" {
+		if page.To, err = parseTime(value); err != nil {
+			respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid to value '%v'", value)})
+			return
+		}
+	}
+	page.From = page.To - defaultRollupBuckets*seconds
+	if value := values.Get("from"); value != "" {
+		if page.From, err = parseTime(value); err != nil {
+			respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid from value '%v'", value)})
+			return
+		}
+	}
+	if page.From >= page.To {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: "from must be before to"})
+		return
+	}
+	if (page.To-page.From)/seconds > maxRollupBuckets {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Too many buckets, at most %d are returned", maxRollupBuckets)})
+		return
+	}
+	err = a.Store.GetCity(&model.City{ID: id})
+	if err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			respondWithError(w, Error{Code: http.StatusNotFound, Error: err.Error()})
+			return
+		}
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	page.Rollups, err = a.Store.ListRollups(id, seconds, page.From, page.To)
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	for i, rollup := range page.Rollups {
+		page.Rollups[i] = rollup.In(page.Unit)
+	}
+	respondWithJSON(w, http.StatusOK, page)
+}
+
+const (
+	defaultForecastWindow = "24h"
+	maxForecastWindow     = 366 * 24 * time.Hour
+	// forecasting models are trained on a longer window by default, daily
+	// seasonality needs two days of readings at least
+	defaultModelWindow     = "7d"
+	defaultForecastModel   = "holt-winters"
+	defaultForecastHorizon = "24h"
+	maxForecastHorizon     = 7 * 24 * time.Hour
+	// forecastStep is the interval the readings are resampled at and the
+	// predictions are made for
+	forecastStep = time.Hour
+)
+
+// parseWindow reads a duration such as 6h or 7d. Days are added on top of
+// the units time.ParseDuration knows.
+func parseWindow(value string) (time.Duration, error) {
+	if strings.HasSuffix(value, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(value)
+}
+
+// parseForecastWindow reads the window a forecast looks back on
+func parseForecastWindow(window string) (time.Duration, error) {
+	lookback, err := parseWindow(window)
+	if err != nil || lookback <= 0 || lookback > maxForecastWindow {
+		return 0, fmt.Errorf("Invalid window value '%v'", window)
+	}
+	return lookback, nil
+}
+
+// parseForecastAggregation reads the aggregation of a forecast, the mean
+// when value is empty
+func parseForecastAggregation(value string) (model.Aggregation, error) {
+	if value == "" {
+		return model.Mean, nil
+	}
+	return model.ParseAggregation(value)
 }
 
 //handler for "/forecasts/:city_id" GET endpoint
@@ -74,20 +587,237 @@ func (a *App) handleForecast(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid city id %v", params["city_id"])})
 		return
 	}
-	timestamp24HoursAgo := time.Now().AddDate(0, 0, -1).Unix()
-	temperatures, err := model.GetTemperatures(a.DB, CityID, timestamp24HoursAgo)
+	unit, err := responseUnit(r)
 	if err != nil {
-		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: err.Error()})
+		return
+	}
+	values := r.URL.Query()
+	name, horizon := values.Get("model"), values.Get("horizon")
+	predicting := name != "" || horizon != ""
+	window := values.Get("window")
+	if window == "" {
+		window = defaultForecastWindow
+		if predicting {
+			window = defaultModelWindow
+		}
+	}
+	lookback, err := parseForecastWindow(window)
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: err.Error()})
+		return
+	}
+	if predicting {
+		a.handlePrediction(w, predictionForecast{CityID: CityID, Model: name, Window: window, Horizon: horizon, Unit: unit}, lookback)
+		return
+	}
+	agg, err := parseForecastAggregation(values.Get("agg"))
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: err.Error()})
 		return
 	}
 	var forecast model.Forecast
-	var totalMin int
-	var totalMax int
-	total := len(temperatures)
-	for _, temp := range temperatures {
-		totalMax += temp.Max
-		totalMin += temp.Min
-	}
-	forecast = model.Forecast{CityID: CityID, Max: float32(totalMax) / float32(total), Min: float32(totalMin) / float32(total), Sample: total}
-	respondWithJSON(w, http.StatusOK, forecast)
+	entry, ok := a.forecasts.get(CityID, window+":"+string(agg), &forecast)
+	if !ok {
+		// an unknown city is told apart from a city without readings in the
+		// window. Deleting a city invalidates its forecasts, so a cached one
+		// is of an existing city.
+		err = a.Store.GetCity(&model.City{ID: CityID})
+		if err != nil {
+			if strings.Contains(err.Error(), "no rows in result set") {
+				respondWithError(w, Error{Code: http.StatusNotFound, Error: err.Error()})
+				return
+			}
+			respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+			return
+		}
+		forecast, err = a.Store.AggregateTemperatures(CityID, time.Now().Add(-lookback).Unix(), agg)
+		if err != nil {
+			respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+			return
+		}
+		forecast.Window = window
+		forecast.Aggregation = agg
+		a.forecasts.set(entry, forecast)
+	}
+	respondWithJSON(w, http.StatusOK, forecast.In(unit))
+}
+
+// maxForecastCities is the number of cities a multi-city forecast may list
+const maxForecastCities = 1000
+
+// parseCityIDs reads a comma separated list of city ids, leaving out
+// duplicates
+func parseCityIDs(value string) ([]int, error) {
+	ids := []int{}
+	seen := map[int]bool{}
+	for _, field := range strings.Split(value, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("Invalid city id '%v'", field)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) > maxForecastCities {
+		return nil, fmt.Errorf("Too many city ids, at most %d are accepted", maxForecastCities)
+	}
+	return ids, nil
+}
+
+//handler for "/forecasts" GET endpoint
+func (a *App) handleForecasts(w http.ResponseWriter, r *http.Request) {
+	unit, err := responseUnit(r)
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: err.Error()})
+		return
+	}
+	values := r.URL.Query()
+	if values.Get("model") != "" || values.Get("horizon") != "" {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: "model and horizon are only supported by the forecast of a single city"})
+		return
+	}
+	// without city_ids every city is forecast
+	var cityIDs []int
+	if _, ok := values["city_ids"]; ok {
+		if cityIDs, err = parseCityIDs(values.Get("city_ids")); err != nil {
+			respondWithError(w, Error{Code: http.StatusBadRequest, Error: err.Error()})
+			return
+		}
+	}
+	window := values.Get("window")
+	if window == "" {
+		window = defaultForecastWindow
+	}
+	lookback, err := parseForecastWindow(window)
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: err.Error()})
+		return
+	}
+	agg, err := parseForecastAggregation(values.Get("agg"))
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: err.Error()})
+		return
+	}
+	forecasts, err := a.Store.AggregateCityTemperatures(cityIDs, time.Now().Add(-lookback).Unix(), agg)
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	// the forecasts are keyed by city id, a city that can't be forecast
+	// gets its error instead
+	response := map[int]interface{}{}
+	for id, forecast := range forecasts {
+		forecast.Window = window
+		forecast.Aggregation = agg
+		response[id] = forecast.In(unit)
+	}
+	for _, id := range cityIDs {
+		if _, ok := forecasts[id]; !ok {
+			response[id] = Error{Code: http.StatusNotFound, Error: fmt.Sprintf("City %d doesn't exist", id)}
+		}
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// temperaturePrediction is the predicted max and min of the hour starting at
+// Timestamp
+type temperaturePrediction struct {
+	Timestamp int64               `json:"timestamp"`
+	Max       forecast.Prediction `json:"max"`
+	Min       forecast.Prediction `json:"min"`
+}
+
+type predictionForecast struct {
+	CityID  int        `json:"city_id"`
+	Model   string     `json:"model"`
+	Window  string     `json:"window"`
+	Horizon string     `json:"horizon"`
+	Unit    model.Unit `json:"unit"`
+	// Sample is the number of readings the model was trained on
+	Sample      int                     `json:"sample"`
+	Predictions []temperaturePrediction `json:"predictions"`
+}
+
+// predictionIn converts a prediction in Celsius to unit
+func predictionIn(p forecast.Prediction, unit model.Unit) forecast.Prediction {
+	return forecast.Prediction{
+		Value: model.Round(unit.FromCelsius(p.Value)),
+		Lower: model.Round(unit.FromCelsius(p.Lower)),
+		Upper: model.Round(unit.FromCelsius(p.Upper)),
+	}
+}
+
+// handlePrediction trains the model of p on the hourly averages of the
+// lookback window and predicts the hours following the current one up to
+// the horizon of p
+func (a *App) handlePrediction(w http.ResponseWriter, p predictionForecast, lookback time.Duration) {
+	if p.Model == "" {
+		p.Model = defaultForecastModel
+	}
+	forecaster, err := forecast.New(p.Model)
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: err.Error()})
+		return
+	}
+	if p.Horizon == "" {
+		p.Horizon = defaultForecastHorizon
+	}
+	horizon, err := parseWindow(p.Horizon)
+	if err != nil || horizon < forecastStep || horizon > maxForecastHorizon {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid horizon value '%v', it must be between 1h and 7d", p.Horizon)})
+		return
+	}
+	err = a.Store.GetCity(&model.City{ID: p.CityID})
+	if err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			respondWithError(w, Error{Code: http.StatusNotFound, Error: err.Error()})
+			return
+		}
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	step := int64(forecastStep / time.Second)
+	now := time.Now().Unix()
+	rollups, err := a.Store.ListRollups(p.CityID, step, now-int64(lookback/time.Second), now)
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	maxPoints := make([]forecast.Point, len(rollups))
+	minPoints := make([]forecast.Point, len(rollups))
+	for i, rollup := range rollups {
+		p.Sample += rollup.Count
+		maxPoints[i] = forecast.Point{Time: rollup.Start, Value: rollup.AvgMax}
+		minPoints[i] = forecast.Point{Time: rollup.Start, Value: rollup.AvgMin}
+	}
+	// like the summaries, a window without readings is a sample of 0 without
+	// predictions rather than an error
+	if len(rollups) == 0 {
+		respondWithJSON(w, http.StatusOK, p)
+		return
+	}
+	// the predictions start with the hour after the current one, the hours
+	// between it and the last reading are predicted and dropped
+	steps := int((horizon + forecastStep - 1) / forecastStep)
+	skip := int((now - now%step - rollups[len(rollups)-1].Start) / step)
+	predictions := [2][]forecast.Prediction{}
+	for i, points := range [2][]forecast.Point{maxPoints, minPoints} {
+		predictions[i], err = forecaster.Forecast(forecast.Resample(points, step), skip+steps)
+		if err != nil {
+			respondWithError(w, Error{Code: http.StatusUnprocessableEntity, Error: fmt.Sprintf("%v, %s needs more readings in the %s window", err, p.Model, p.Window)})
+			return
+		}
+	}
+	p.Predictions = make([]temperaturePrediction, steps)
+	for i := range p.Predictions {
+		p.Predictions[i] = temperaturePrediction{
+			Timestamp: now - now%step + int64(i+1)*step,
+			Max:       predictionIn(predictions[0][skip+i], p.Unit),
+			Min:       predictionIn(predictions[1][skip+i], p.Unit),
+		}
+	}
+	respondWithJSON(w, http.StatusOK, p)
 }
@@ -3,110 +3,21 @@ package app
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/Deewai/finleap/model"
-	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestSendTemperatureMissingFields(t *testing.T) {
-	a := App{}
-	err := a.sendTemperature(model.Temperature{})
-	assert.NotNil(t, err)
-	assert.EqualValues(t, errors.New("Missing fields in temperature object"), err)
-}
-
-func TestSendTemperatureCorrectFieldsNoMockUrl(t *testing.T) {
-	a := App{}
-	FlushMockups()
-	a.Webhooks.Webhooks = []*model.Webhook{
-		&model.Webhook{
-			ID:          1,
-			CityID:      1,
-			CallbackURL: "https://my.service.com/high-temperature",
-		},
-	}
-	err := a.sendTemperature(model.Temperature{
-		CityID:    1,
-		Min:       10,
-		Max:       20,
-		Timestamp: 10000,
-	})
-	assert.NotNil(t, err)
-	assert.EqualValues(t, errors.New("No mockup found for given request"), err)
-}
-
-func TestSendTemperatureCorrectFieldsNoWebhook(t *testing.T) {
-	a := App{}
-	err := a.sendTemperature(model.Temperature{
-		CityID:    1,
-		Min:       10,
-		Max:       20,
-		Timestamp: 10000,
-	})
-	assert.Nil(t, err)
-}
-
-func TestSendTemperatureCorrectFieldsInvalidUrl(t *testing.T) {
-	a := App{}
-	FlushMockups()
-	a.Webhooks.Webhooks = []*model.Webhook{
-		&model.Webhook{
-			ID:          1,
-			CityID:      1,
-			CallbackURL: "https://my.service.com/high-temperature",
-		},
-	}
-	AddMockups(mock{
-		url:        "https://my.service.com/high-temperature",
-		httpMethod: http.MethodPost,
-		err:        errors.New("invalid response"),
-	})
-	err := a.sendTemperature(model.Temperature{
-		CityID:    1,
-		Min:       10,
-		Max:       20,
-		Timestamp: 10000,
-	})
-	assert.NotNil(t, err)
-	assert.EqualValues(t, errors.New("invalid response"), err)
-}
-
-func TestSendTemperatureCorrectFieldsValidUrl(t *testing.T) {
-	a := App{}
-	FlushMockups()
-	a.Webhooks.Webhooks = []*model.Webhook{
-		&model.Webhook{
-			ID:          1,
-			CityID:      1,
-			CallbackURL: "https://my.service.com/high-temperature",
-		},
-	}
-	AddMockups(mock{
-		url:        "https://my.service.com/high-temperature",
-		httpMethod: http.MethodPost,
-		response: &http.Response{
-			StatusCode: http.StatusOK,
-			Body:       ioutil.NopCloser(strings.NewReader(`"message":"success"`)),
-		},
-	})
-	err := a.sendTemperature(model.Temperature{
-		CityID:    1,
-		Min:       10,
-		Max:       20,
-		Timestamp: 10000,
-	})
-	assert.Nil(t, err)
-}
-
 func TestHandleCreateTemperatureInvalidHttpMethod(t *testing.T) {
 	a := App{}
 	a.Router = mux.NewRouter()
@@ -134,8 +45,11 @@ func TestHandleCreateTemperatureWithDatabaseError(t *testing.T) {
 	}
 	defer db.Close()
 	a := App{}
-	a.DB = db
+	a.Store = model.NewMySQLStore(db)
+	expectGetCity(mock)
+	mock.ExpectBegin()
 	mock.ExpectExec("INSERT INTO temperatures").WillReturnError(fmt.Errorf("a database error"))
+	mock.ExpectRollback()
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
 	req, _ := http.NewRequest("POST", "/temperatures", bytes.NewBuffer([]byte(`{"city_id":1,"max":40,"min":10}`)))
@@ -144,6 +58,44 @@ func TestHandleCreateTemperatureWithDatabaseError(t *testing.T) {
 	assert.Equal(t, http.StatusInternalServerError, rr.Code)
 }
 
+func TestHandleCreateTemperatureOfDeletedCity(t *testing.T) {
+	store := model.NewMemoryStore()
+	assert.Nil(t, store.CreateCity(&model.City{Name: "Berlin"}))
+	assert.Nil(t, store.DeleteCity(&model.City{ID: 1}))
+	a := App{Store: store}
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	for _, body := range []string{`{"city_id":1,"max":40,"min":10}`, `{"city_id":2,"max":40,"min":10}`} {
+		req, _ := http.NewRequest("POST", "/temperatures", bytes.NewBuffer([]byte(body)))
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code, body)
+	}
+	temperatures, err := store.GetTemperatures(1, 0)
+	assert.Nil(t, err)
+	assert.Empty(t, temperatures)
+}
+
+// expectCreateTemperature expects the city of a reading to be looked up, and
+// the reading to be inserted, added to the outbox and rolled up in a
+// transaction. It returns the expected insert of the reading.
+func expectCreateTemperature(mock sqlmock.Sqlmock) *sqlmock.ExpectedExec {
+	expectGetCity(mock)
+	mock.ExpectBegin()
+	insert := mock.ExpectExec("INSERT INTO temperatures\\(")
+	mock.ExpectExec("INSERT INTO webhook_outbox").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO temperature_rollups").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO temperature_rollups").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	return insert
+}
+
+// expectGetCity expects city 1 to be looked up and found
+func expectGetCity(mock sqlmock.Sqlmock) {
+	mock.ExpectPrepare("^SELECT (.+) FROM cities (.+)").ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude"}).AddRow("Berlin", 52.520008, 13.404954))
+}
+
 func TestHandleCreateTemperatureWithValidFormData(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -151,11 +103,9 @@ func TestHandleCreateTemperatureWithValidFormData(t *testing.T) {
 	}
 	defer db.Close()
 	a := App{}
-	a.DB = db
-	a.Webhooks.Webhooks = nil
-	a.newTemperature = make(chan model.Temperature)
-	go a.webhookRoutine()
-	mock.ExpectExec("INSERT INTO temperatures").WillReturnResult(sqlmock.NewResult(1, 1))
+	a.Store = model.NewMySQLStore(db)
+	a.newTemperature = make(chan model.Temperature, 1)
+	expectCreateTemperature(mock).WillReturnResult(sqlmock.NewResult(1, 1))
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
 	req, _ := http.NewRequest("POST", "/temperatures", bytes.NewBuffer([]byte(`{"city_id":1,"max":40,"min":10}`)))
@@ -170,6 +120,435 @@ func TestHandleCreateTemperatureWithValidFormData(t *testing.T) {
 	assert.EqualValues(t, 10, m["min"])
 }
 
+func TestHandleCreateTemperatureWithTimestamp(t *testing.T) {
+	measured := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	timestamps := map[string]string{
+		"unix":     strconv.FormatInt(measured.Unix(), 10),
+		"RFC 3339": `"` + measured.Format(time.RFC3339) + `"`,
+	}
+	for name, timestamp := range timestamps {
+		t.Run(name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			a := App{}
+			a.Store = model.NewMySQLStore(db)
+			a.newTemperature = make(chan model.Temperature, 1)
+			expectCreateTemperature(mock).
+				WithArgs(1, 40.0, 10.0, measured.Unix(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			a.Router = mux.NewRouter()
+			a.initializeRoutes()
+			req, _ := http.NewRequest("POST", "/temperatures", bytes.NewBuffer([]byte(`{"city_id":1,"max":40,"min":10,"timestamp":`+timestamp+`}`)))
+			rr := httptest.NewRecorder()
+			a.Router.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusCreated, rr.Code)
+			var m map[string]interface{}
+			json.Unmarshal(rr.Body.Bytes(), &m)
+			assert.EqualValues(t, measured.Unix(), m["timestamp"])
+			assert.InDelta(t, time.Now().Unix(), m["received_at"], 5)
+			assert.Nil(t, mock.ExpectationsWereMet())
+			sent := <-a.newTemperature
+			assert.Equal(t, measured.Unix(), sent.Timestamp)
+		})
+	}
+}
+
+func TestHandleCreateTemperatureWithUnit(t *testing.T) {
+	store := model.NewMemoryStore()
+	store.CreateCity(&model.City{Name: "Berlin"})
+	a := App{}
+	a.Store = store
+	a.newTemperature = make(chan model.Temperature, 1)
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("POST", "/temperatures?unit=K", bytes.NewBuffer([]byte(`{"city_id":1,"max":68.9,"min":14,"unit":"F"}`)))
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var m map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &m)
+	assert.Equal(t, 293.65, m["max"])
+	assert.Equal(t, 263.15, m["min"])
+	assert.Equal(t, "K", m["unit"])
+	// the reading is stored in Celsius
+	sent := <-a.newTemperature
+	assert.InDelta(t, 20.5, sent.Max, 1e-9)
+	assert.InDelta(t, -10, sent.Min, 1e-9)
+}
+
+func TestHandleCreateTemperatureWithInvalidUnit(t *testing.T) {
+	bodies := map[string]string{
+		"unknown unit":        `{"city_id":1,"max":40,"min":10,"unit":"R"}`,
+		"below absolute zero": `{"city_id":1,"max":10,"min":-1,"unit":"K"}`,
+	}
+	for name, body := range bodies {
+		t.Run(name, func(t *testing.T) {
+			a := App{}
+			a.Router = mux.NewRouter()
+			a.initializeRoutes()
+			req, _ := http.NewRequest("POST", "/temperatures", bytes.NewBuffer([]byte(body)))
+			rr := httptest.NewRecorder()
+			a.Router.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+			var e Error
+			json.Unmarshal(rr.Body.Bytes(), &e)
+			assert.Len(t, e.Fields, 1)
+		})
+	}
+	a := App{}
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("POST", "/temperatures?unit=R", bytes.NewBuffer([]byte(`{"city_id":1,"max":40,"min":10}`)))
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestHandleCreateTemperatureWithInvalidTimestamp(t *testing.T) {
+	now := time.Now()
+	timestamps := map[string]string{
+		"not a time":   `"yesterday"`,
+		"wrong type":   `true`,
+		"in an hour":   strconv.FormatInt(now.Add(time.Hour).Unix(), 10),
+		"a year ago":   `"` + now.AddDate(-1, 0, 0).Format(time.RFC3339) + `"`,
+		"fractional":   `1580000000.5`,
+		"no time zone": `"2020-01-26T00:53:20"`,
+	}
+	for name, timestamp := range timestamps {
+		t.Run(name, func(t *testing.T) {
+			a := App{TimestampMaxAge: 30 * 24 * time.Hour}
+			a.Router = mux.NewRouter()
+			a.initializeRoutes()
+			req, _ := http.NewRequest("POST", "/temperatures", bytes.NewBuffer([]byte(`{"city_id":1,"max":40,"min":10,"timestamp":`+timestamp+`}`)))
+			rr := httptest.NewRecorder()
+			a.Router.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+			var e Error
+			json.Unmarshal(rr.Body.Bytes(), &e)
+			if assert.Len(t, e.Fields, 1) {
+				assert.Equal(t, "timestamp", e.Fields[0].Field)
+			}
+		})
+	}
+}
+
+func TestHandleCreateTemperatureBeforeEpoch(t *testing.T) {
+	timestamps := map[string]string{
+		"zero":             `0`,
+		"negative":         `-1`,
+		"epoch":            `"1970-01-01T00:00:00Z"`,
+		"before the epoch": `"1969-12-31T23:59:59Z"`,
+	}
+	for name, timestamp := range timestamps {
+		t.Run(name, func(t *testing.T) {
+			// without a maximum age
+			a := App{}
+			a.Router = mux.NewRouter()
+			a.initializeRoutes()
+			req, _ := http.NewRequest("POST", "/temperatures", bytes.NewBuffer([]byte(`{"city_id":1,"max":40,"min":10,"timestamp":`+timestamp+`}`)))
+			rr := httptest.NewRecorder()
+			a.Router.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusBadRequest, rr.Code)
+			var e Error
+			json.Unmarshal(rr.Body.Bytes(), &e)
+			assert.Equal(t, []FieldError{{Field: "timestamp", Error: "must be after the unix epoch"}}, e.Fields)
+		})
+	}
+}
+
+func TestHandleCreateTemperatureWithinSkew(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	a := App{TimestampSkew: 2 * time.Hour}
+	a.Store = model.NewMySQLStore(db)
+	a.newTemperature = make(chan model.Temperature, 1)
+	expectCreateTemperature(mock).WillReturnResult(sqlmock.NewResult(1, 1))
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	timestamp := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	req, _ := http.NewRequest("POST", "/temperatures", bytes.NewBuffer([]byte(`{"city_id":1,"max":40,"min":10,"timestamp":`+timestamp+`}`)))
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+}
+
+func TestHandleCreateTemperatureBatch(t *testing.T) {
+	bodies := map[string]string{
+		"application/json": `[
+			{"city_id":1,"max":40,"min":10,"timestamp":1580000000},
+			{"max":40,"min":10},
+			"reading",
+			{"city_id":2,"max":40,"min":10},
+			{"city_id":1,"max":30,"min":5}
+		]`,
+		ndjsonContentType: `{"city_id":1,"max":40,"min":10,"timestamp":1580000000}
+{"max":40,"min":10}
+{"city_id":1,
+{"city_id":2,"max":40,"min":10}
+
+{"city_id":1,"max":30,"min":5}
+`,
+	}
+	for contentType, body := range bodies {
+		t.Run(contentType, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			a := App{}
+			a.Store = model.NewMySQLStore(db)
+			a.newTemperature = make(chan model.Temperature, 2)
+			mock.ExpectPrepare("^SELECT (.+) FROM cities (.+)").ExpectQuery().WithArgs(1).
+				WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude"}).AddRow("Berlin", 52.520008, 13.404954))
+			mock.ExpectQuery("^SELECT (.+) FROM cities (.+)").WithArgs(2).
+				WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude"}))
+			mock.ExpectBegin()
+			mock.ExpectExec("INSERT INTO temperatures(.+) VALUES(.+), (.+)$").
+				WithArgs(1, 40.0, 10.0, int64(1580000000), sqlmock.AnyArg(), 1, 30.0, 5.0, sqlmock.AnyArg(), sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(7, 2))
+			mock.ExpectExec("INSERT INTO webhook_outbox").WithArgs(7, 8).WillReturnResult(sqlmock.NewResult(0, 0))
+			// the readings fall in different hours and days
+			for i := 0; i < 4; i++ {
+				mock.ExpectExec("INSERT INTO temperature_rollups").WillReturnResult(sqlmock.NewResult(0, 1))
+			}
+			mock.ExpectCommit()
+			a.Router = mux.NewRouter()
+			a.initializeRoutes()
+			req, _ := http.NewRequest("POST", "/temperatures/batch", strings.NewReader(body))
+			req.Header.Set("Content-Type", contentType)
+			rr := httptest.NewRecorder()
+			a.Router.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusOK, rr.Code)
+			assert.Nil(t, mock.ExpectationsWereMet())
+
+			var batch temperatureBatch
+			json.Unmarshal(rr.Body.Bytes(), &batch)
+			assert.Equal(t, 2, batch.Accepted)
+			assert.Equal(t, 3, batch.Rejected)
+			statuses := []string{}
+			for _, result := range batch.Results {
+				statuses = append(statuses, result.Status)
+			}
+			assert.Equal(t, []string{"accepted", "rejected", "rejected", "rejected", "accepted"}, statuses)
+			assert.Equal(t, 7, batch.Results[0].Temperature.ID)
+			assert.Equal(t, 8, batch.Results[4].Temperature.ID)
+			assert.Equal(t, []FieldError{{Field: "city_id", Error: "is required"}}, batch.Results[1].Fields)
+			assert.Equal(t, "Invalid JSON", batch.Results[2].Error)
+			assert.Equal(t, []FieldError{{Field: "city_id", Error: "City doesn't exist"}}, batch.Results[3].Fields)
+
+			assert.Equal(t, 7, (<-a.newTemperature).ID)
+			assert.Equal(t, 8, (<-a.newTemperature).ID)
+		})
+	}
+}
+
+func TestHandleCreateTemperatureBatchInvalidBody(t *testing.T) {
+	bodies := []string{`{"city_id":1,"max":40,"min":10}`, `[{"city_id":1`, ``}
+	for _, body := range bodies {
+		a := App{}
+		a.Router = mux.NewRouter()
+		a.initializeRoutes()
+		req, _ := http.NewRequest("POST", "/temperatures/batch", strings.NewReader(body))
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, body)
+	}
+}
+
+func TestHandleCreateTemperatureBatchWithDatabaseError(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	a := App{}
+	a.Store = model.NewMySQLStore(db)
+	mock.ExpectPrepare("^SELECT (.+) FROM cities (.+)").ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude"}).AddRow("Berlin", 52.520008, 13.404954))
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO temperatures").WillReturnError(fmt.Errorf("a database error"))
+	mock.ExpectRollback()
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("POST", "/temperatures/batch", strings.NewReader(`[{"city_id":1,"max":40,"min":10}]`))
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusInternalServerError, rr.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestHandleListTemperaturesInvalidParams(t *testing.T) {
+	for _, url := range []string{
+		"/cities/me/temperatures",
+		"/cities/1/temperatures?from=yesterday",
+		"/cities/1/temperatures?to=2020-01-26",
+		"/cities/1/temperatures?limit=0",
+		"/cities/1/temperatures?cursor=!!",
+	} {
+		a := App{}
+		a.Router = mux.NewRouter()
+		a.initializeRoutes()
+		req, _ := http.NewRequest("GET", url, nil)
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, url)
+	}
+}
+
+func TestHandleListTemperaturesNotExistingCity(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	a := App{}
+	a.Store = model.NewMySQLStore(db)
+	mock.ExpectPrepare("^SELECT (.+) FROM cities (.+)").ExpectQuery().WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude"}))
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("GET", "/cities/1/temperatures", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+// newTemperatureListApp returns an App whose store lists two readings of
+// city 1, with a third one signalling a next page
+func newTemperatureListApp(t *testing.T) (*App, sqlmock.Sqlmock) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	a := &App{}
+	a.Store = model.NewMySQLStore(db)
+	mock.ExpectPrepare("^SELECT (.+) FROM cities (.+)").ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude"}).AddRow("Berlin", 52.520008, 13.404954))
+	mock.ExpectPrepare(regexp.QuoteMeta("SELECT id, city_id, max, min, UNIX_TIMESTAMP(timestamp), UNIX_TIMESTAMP(received_at) FROM temperatures WHERE city_id = ? AND timestamp >= FROM_UNIXTIME(?) AND (timestamp > FROM_UNIXTIME(?) OR (timestamp = FROM_UNIXTIME(?) AND id > ?)) ORDER BY timestamp, id LIMIT ?")).
+		ExpectQuery().
+		WithArgs(1, int64(1580000000), int64(1580000100), int64(1580000100), 4, 3).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "city_id", "max", "min", "timestamp", "received_at"}).
+			AddRow(5, 1, 30, 10, 1580000200, 1580000900).
+			AddRow(2, 1, 25, 8, 1580000300, 1580000900).
+			AddRow(7, 1, 20, 5, 1580000400, 1580000900))
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	return a, mock
+}
+
+const temperatureListURL = "/cities/1/temperatures?from=2020-01-26T00:53:20Z&limit=2&cursor=eyJ0IjoxNTgwMDAwMTAwLCJpIjo0fQ"
+
+func TestHandleListTemperatures(t *testing.T) {
+	a, mock := newTemperatureListApp(t)
+	req, _ := http.NewRequest("GET", temperatureListURL, nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	var page temperaturePage
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	assert.Equal(t, []model.Temperature{
+		{ID: 5, CityID: 1, Max: 30, Min: 10, Unit: model.Celsius, Timestamp: 1580000200, ReceivedAt: 1580000900},
+		{ID: 2, CityID: 1, Max: 25, Min: 8, Unit: model.Celsius, Timestamp: 1580000300, ReceivedAt: 1580000900},
+	}, page.Temperatures)
+	cursor, err := decodeTemperatureCursor(page.NextCursor)
+	assert.Nil(t, err)
+	assert.Equal(t, temperatureCursor{Timestamp: 1580000300, ID: 2}, cursor)
+}
+
+func TestHandleListTemperaturesAsCSV(t *testing.T) {
+	a, mock := newTemperatureListApp(t)
+	req, _ := http.NewRequest("GET", temperatureListURL, nil)
+	req.Header.Set("Accept", "application/json;q=0.5, text/csv")
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Equal(t, "text/csv; charset=utf-8", rr.Header().Get("Content-Type"))
+	assert.Equal(t, encodeTemperatureCursor(temperatureCursor{Timestamp: 1580000300, ID: 2}), rr.Header().Get("X-Next-Cursor"))
+	assert.Equal(t, "id,city_id,max,min,unit,timestamp,received_at\n"+
+		"5,1,30,10,C,1580000200,1580000900\n"+
+		"2,1,25,8,C,1580000300,1580000900\n", rr.Body.String())
+}
+
+func TestNegotiate(t *testing.T) {
+	for accept, expected := range map[string]string{
+		"":                                     "application/json",
+		"text/csv":                             "text/csv",
+		"text/*":                               "text/csv",
+		"*/*":                                  "application/json",
+		"text/html":                            "application/json",
+		"text/csv;q=0.2, application/json":     "application/json",
+		"application/json;q=0.2, text/csv":     "text/csv",
+		"application/json;q=bad, text/csv;q=0": "application/json",
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", accept)
+		assert.Equal(t, expected, negotiate(req, "application/json", "text/csv"), accept)
+	}
+}
+
+func TestHandleTemperatureRollupInvalidParams(t *testing.T) {
+	for _, url := range []string{
+		"/cities/me/temperatures/rollup",
+		"/cities/1/temperatures/rollup?bucket=30m",
+		"/cities/1/temperatures/rollup?bucket=90m",
+		"/cities/1/temperatures/rollup?bucket=hourly",
+		"/cities/1/temperatures/rollup?from=yesterday",
+		"/cities/1/temperatures/rollup?from=1580000000&to=1570000000",
+		"/cities/1/temperatures/rollup?from=0&to=1580000000",
+	} {
+		a := App{}
+		a.Router = mux.NewRouter()
+		a.initializeRoutes()
+		req, _ := http.NewRequest("GET", url, nil)
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, url)
+	}
+}
+
+func TestHandleTemperatureRollup(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	a := App{}
+	a.Store = model.NewMySQLStore(db)
+	mock.ExpectPrepare("^SELECT (.+) FROM cities (.+)").ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"name", "latitude", "longitude"}).AddRow("Berlin", 52.520008, 13.404954))
+	// 6h buckets are grouped from the hourly rollups
+	mock.ExpectPrepare("^SELECT bucket_start - bucket_start % \\?, (.+) FROM temperature_rollups (.+) GROUP BY 1 ORDER BY 1$").ExpectQuery().
+		WithArgs(int64(6*3600), 1, int64(3600), int64(1579996800), int64(1580018400)).
+		WillReturnRows(sqlmock.NewRows([]string{"start", "readings", "sum_max", "sum_min", "min_min", "max_max"}).
+			AddRow(1579996800, 4, 100, 30, 5, 30))
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("GET", "/cities/1/temperatures/rollup?bucket=6h&from=2020-01-26T00:00:00Z&to=2020-01-26T06:00:00Z", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	var page rollupPage
+	json.Unmarshal(rr.Body.Bytes(), &page)
+	assert.Equal(t, rollupPage{
+		CityID:  1,
+		Bucket:  "6h",
+		From:    1579996800,
+		To:      1580018400,
+		Unit:    model.Celsius,
+		Rollups: []model.Rollup{{Start: 1579996800, Count: 4, Min: 5, Max: 30, AvgMax: 25, AvgMin: 7.5}},
+	}, page)
+}
+
 func TestHandleForecastWithInValidCityID(t *testing.T) {
 	a := App{}
 	a.Router = mux.NewRouter()
@@ -181,14 +560,26 @@ func TestHandleForecastWithInValidCityID(t *testing.T) {
 }
 
 func TestHandleForecastWithNotExistingCityID(t *testing.T) {
+	a := App{}
+	a.Store = model.NewMemoryStore()
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("GET", "/forecasts/1", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestHandleForecastWithStoreError(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 	}
 	defer db.Close()
 	a := App{}
-	a.DB = db
-	mock.ExpectQuery("^SELECT (.+) FROM temperatures (.+)").WillReturnError(fmt.Errorf("City data doesn't exist"))
+	a.Store = model.NewMySQLStore(db)
+	expectGetCity(mock)
+	mock.ExpectPrepare("^SELECT (.+) FROM temperatures (.+)").ExpectQuery().WillReturnError(fmt.Errorf("City data doesn't exist"))
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
 	req, _ := http.NewRequest("GET", "/forecasts/1", nil)
@@ -200,6 +591,27 @@ func TestHandleForecastWithNotExistingCityID(t *testing.T) {
 	assert.EqualValues(t, "City data doesn't exist", m["error"])
 }
 
+func TestHandleForecastWithEmptySample(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	a := App{}
+	a.Store = model.NewMySQLStore(db)
+	expectGetCity(mock)
+	mock.ExpectPrepare("^SELECT COUNT(.+) FROM temperatures").ExpectQuery().
+		WillReturnRows(sqlmock.NewRows([]string{"count", "max", "min"}).AddRow(0, nil, nil))
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("GET", "/forecasts/1", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.JSONEq(t, `{"city_id":1,"max":null,"min":null,"unit":"C","sample":0,"window":"24h","agg":"mean"}`, rr.Body.String())
+}
+
 func TestHandleForecastWithValidCityID(t *testing.T) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
@@ -207,11 +619,11 @@ func TestHandleForecastWithValidCityID(t *testing.T) {
 	}
 	defer db.Close()
 	a := App{}
-	a.DB = db
-	rows := sqlmock.NewRows([]string{"id", "city_id", "max", "min"}).
-		AddRow(1, 1, 30, 10).
-		AddRow(1, 1, 20, 5)
-	mock.ExpectQuery("^SELECT (.+) FROM temperatures (.+)").WillReturnRows(rows)
+	a.Store = model.NewMySQLStore(db)
+	expectGetCity(mock)
+	rows := sqlmock.NewRows([]string{"count", "max", "min"}).AddRow(2, 25, 7.5)
+	mock.ExpectPrepare(regexp.QuoteMeta("SELECT COUNT(*), AVG(max), AVG(min) FROM temperatures WHERE city_id = ? AND timestamp >= FROM_UNIXTIME(?)")).
+		ExpectQuery().WillReturnRows(rows)
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
 	req, _ := http.NewRequest("GET", "/forecasts/1", nil)
@@ -224,4 +636,210 @@ func TestHandleForecastWithValidCityID(t *testing.T) {
 	assert.EqualValues(t, 25, m["max"])
 	assert.EqualValues(t, 7.5, m["min"])
 	assert.EqualValues(t, 2, m["sample"])
+	assert.EqualValues(t, "24h", m["window"])
+	assert.EqualValues(t, "mean", m["agg"])
+}
+
+func TestHandleForecastWithWindowAndMedian(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	a := App{}
+	a.Store = model.NewMySQLStore(db)
+	expectGetCity(mock)
+	mock.ExpectPrepare("^SELECT COUNT(.+) FROM temperatures").ExpectQuery().
+		WithArgs(1, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"count", "max", "min"}).AddRow(4, 25, 7.5))
+	// the median of 4 readings lies between the 2nd and 3rd smallest
+	mock.ExpectPrepare(regexp.QuoteMeta("SELECT max FROM temperatures WHERE city_id = ? AND timestamp >= FROM_UNIXTIME(?) ORDER BY max LIMIT 2 OFFSET ?")).
+		ExpectQuery().WithArgs(1, sqlmock.AnyArg(), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(20).AddRow(30))
+	mock.ExpectPrepare(regexp.QuoteMeta("SELECT min FROM temperatures WHERE city_id = ? AND timestamp >= FROM_UNIXTIME(?) ORDER BY min LIMIT 2 OFFSET ?")).
+		ExpectQuery().WithArgs(1, sqlmock.AnyArg(), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"min"}).AddRow(5).AddRow(6))
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("GET", "/forecasts/1?window=7d&agg=median", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	var forecast model.Forecast
+	json.Unmarshal(rr.Body.Bytes(), &forecast)
+	assert.Equal(t, model.Forecast{CityID: 1, Max: 25, Min: 5.5, Unit: model.Celsius, Sample: 4, Window: "7d", Aggregation: model.Median}, forecast)
+}
+
+func TestHandleForecastWithInvalidParams(t *testing.T) {
+	for _, url := range []string{
+		"/forecasts/1?window=yesterday",
+		"/forecasts/1?window=-6h",
+		"/forecasts/1?window=400d",
+		"/forecasts/1?agg=mode",
+	} {
+		a := App{}
+		a.Router = mux.NewRouter()
+		a.initializeRoutes()
+		req, _ := http.NewRequest("GET", url, nil)
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, url)
+	}
+}
+
+func TestHandleForecastWithModel(t *testing.T) {
+	store := model.NewMemoryStore()
+	city := &model.City{Name: "Berlin", Latitude: 52.520008, Longitude: 13.404954}
+	store.CreateCity(city)
+	// readings rising by 2 degrees an hour over the last three hours
+	hour := time.Now().Unix() - time.Now().Unix()%3600
+	for i := int64(0); i < 3; i++ {
+		store.CreateTemperature(&model.Temperature{CityID: city.ID, Max: float64(10 + 2*i), Min: float64(i), Timestamp: hour - (3-i)*3600})
+	}
+	a := App{}
+	a.Store = store
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("GET", "/forecasts/1?model=linear-trend&horizon=2h", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var p predictionForecast
+	json.Unmarshal(rr.Body.Bytes(), &p)
+	assert.Equal(t, 1, p.CityID)
+	assert.Equal(t, "linear-trend", p.Model)
+	assert.Equal(t, "7d", p.Window)
+	assert.Equal(t, "2h", p.Horizon)
+	assert.Equal(t, 3, p.Sample)
+	if assert.Len(t, p.Predictions, 2) {
+		// the current hour is predicted and skipped
+		assert.Equal(t, hour+3600, p.Predictions[0].Timestamp)
+		assert.InDelta(t, 18, p.Predictions[0].Max.Value, 1e-9)
+		assert.InDelta(t, 4, p.Predictions[0].Min.Value, 1e-9)
+		assert.Equal(t, hour+7200, p.Predictions[1].Timestamp)
+		assert.InDelta(t, 20, p.Predictions[1].Max.Value, 1e-9)
+		assert.InDelta(t, 5, p.Predictions[1].Min.Value, 1e-9)
+	}
+
+	// holt-winters needs two days of hourly readings
+	req, _ = http.NewRequest("GET", "/forecasts/1?horizon=6h", nil)
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnprocessableEntity, rr.Code)
+
+	req, _ = http.NewRequest("GET", "/forecasts/2?model=linear-trend", nil)
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestHandleForecastWithInvalidModelParams(t *testing.T) {
+	for _, url := range []string{
+		"/forecasts/1?model=arima",
+		"/forecasts/1?horizon=tomorrow",
+		"/forecasts/1?horizon=30m",
+		"/forecasts/1?horizon=8d",
+		"/forecasts/1?model=linear-trend&window=400d",
+	} {
+		a := App{}
+		a.Router = mux.NewRouter()
+		a.initializeRoutes()
+		req, _ := http.NewRequest("GET", url, nil)
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, url)
+	}
+}
+
+func TestHandleForecastInUnit(t *testing.T) {
+	store := model.NewMemoryStore()
+	store.CreateCity(&model.City{Name: "Berlin"})
+	store.CreateTemperature(&model.Temperature{CityID: 1, Max: 30, Min: 10, Timestamp: time.Now().Unix()})
+	a := App{}
+	a.Store = store
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	headers := map[string]http.Header{
+		"/forecasts/1?unit=F": nil,
+		"/forecasts/1":        {"Accept": {"text/html, application/json; unit=fahrenheit"}},
+	}
+	for url, header := range headers {
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header = header
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `{"city_id":1,"max":86,"min":50,"unit":"F","sample":1,"window":"24h","agg":"mean"}`, rr.Body.String())
+	}
+
+	req, _ := http.NewRequest("GET", "/forecasts/1?unit=R", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestHandleForecasts(t *testing.T) {
+	store := model.NewMemoryStore()
+	for _, name := range []string{"Berlin", "Hamburg"} {
+		store.CreateCity(&model.City{Name: name})
+	}
+	now := time.Now().Unix()
+	store.CreateTemperature(&model.Temperature{CityID: 1, Max: 30, Min: 10, Timestamp: now})
+	store.CreateTemperature(&model.Temperature{CityID: 1, Max: 20, Min: 5, Timestamp: now})
+	a := App{}
+	a.Store = store
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("GET", "/forecasts?city_ids=1,2,9,1&agg=max-of-maxes", nil)
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{
+		"1": {"city_id": 1, "max": 30, "min": 10, "unit": "C", "sample": 2, "window": "24h", "agg": "max-of-maxes"},
+		"2": {"city_id": 2, "max": null, "min": null, "unit": "C", "sample": 0, "window": "24h", "agg": "max-of-maxes"},
+		"9": {"code": 404, "error": "City 9 doesn't exist"}
+	}`, rr.Body.String())
+
+	req, _ = http.NewRequest("GET", "/forecasts", nil)
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var m map[string]model.Forecast
+	json.Unmarshal(rr.Body.Bytes(), &m)
+	assert.Len(t, m, 2)
+	assert.Equal(t, model.Forecast{CityID: 1, Max: 25, Min: 7.5, Unit: model.Celsius, Sample: 2, Window: "24h", Aggregation: model.Mean}, m["1"])
+}
+
+func TestHandleForecastsWithInvalidParams(t *testing.T) {
+	for _, url := range []string{
+		"/forecasts?city_ids=",
+		"/forecasts?city_ids=1,me",
+		"/forecasts?city_ids=1,-2",
+		"/forecasts?city_ids=1&window=yesterday",
+		"/forecasts?city_ids=1&agg=mode",
+		"/forecasts?city_ids=1&model=linear-trend",
+	} {
+		a := App{}
+		a.Router = mux.NewRouter()
+		a.initializeRoutes()
+		req, _ := http.NewRequest("GET", url, nil)
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, url)
+	}
+}
+
+func TestParseWindow(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"6h":  6 * time.Hour,
+		"90m": 90 * time.Minute,
+		"7d":  7 * 24 * time.Hour,
+	} {
+		window, err := parseWindow(value)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, window)
+	}
+	_, err := parseWindow("1.5d")
+	assert.NotNil(t, err)
 }
@@ -2,89 +2,54 @@ package app
 
 import (
 	"encoding/json"
-	"errors"
 	"fmt"
 	"github.com/Deewai/finleap/model"
-	"log"
+	"github.com/Deewai/finleap/signature"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gorilla/mux"
 )
 
-type webhookAction struct {
-	action  string
-	webhook *model.Webhook
-}
+const (
+	// defaultWebhookSecretOverlap is how long the replaced secret of a webhook
+	// still signs its deliveries, giving the receiver time to switch
+	defaultWebhookSecretOverlap = 24 * time.Hour
+	maxWebhookSecretOverlap     = 7 * 24 * time.Hour
+	defaultDeliveryPageSize     = 50
+	maxDeliveryPageSize         = 500
+)
 
-func (a *App) webhookStoreRoutine() {
-	for {
-		webhook := <-a.webhookChan
-		if webhook.action == "add" {
-			err := a.addWebhook(webhook.webhook)
-			if err != nil {
-				log.Println(err.Error())
-			}
-		} else {
-			err := a.deleteWebhook(webhook.webhook)
-			if err != nil {
-				log.Println(err.Error())
-			}
-		}
-	}
+type deliveryPage struct {
+	Deliveries []model.Delivery `json:"deliveries"`
+	NextCursor string           `json:"next_cursor,omitempty"`
 }
 
+// webhookRoutine queues the deliveries in the outbox for the workers. It
+// looks for new ones when a reading is created and every outboxPollInterval,
+// which also picks up the deliveries claimed by an instance that stopped
+// before completing them.
 func (a *App) webhookRoutine() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
 	for {
-		temp := <-a.newTemperature
-		err := a.sendTemperature(temp)
-		if err != nil {
-			log.Println(err.Error())
+		a.deliverOutbox()
+		select {
+		case <-a.newTemperature:
+		case <-ticker.C:
 		}
 	}
 }
 
-func (a *App) restoreWebhooks() {
-	webhooks, err := model.GetWebhooks(a.DB)
-	if err != nil {
-		log.Println(err.Error())
-		return
-	}
-	for _, webhook := range webhooks {
-		a.webhookChan <- webhookAction{action: "add", webhook: &webhook}
+// notifyWebhooks wakes up webhookRoutine to deliver t. The reading is in the
+// outbox already, a busy routine delivers it once it looks again.
+func (a *App) notifyWebhooks(t model.Temperature) {
+	select {
+	case a.newTemperature <- t:
+	default:
 	}
-
-}
-
-func (a *App) addWebhook(webhook *model.Webhook) error {
-	if webhook.ID == 0 || webhook.CityID == 0 || webhook.CallbackURL == "" {
-		return errors.New("Invalid webhook")
-	}
-	a.Webhooks.lock.Lock()
-	defer a.Webhooks.lock.Unlock()
-	a.Webhooks.Webhooks = append(a.Webhooks.Webhooks, webhook)
-	return nil
-}
-
-func (a *App) deleteWebhook(webhook *model.Webhook) error {
-	a.Webhooks.lock.Lock()
-	defer a.Webhooks.lock.Unlock()
-	var index int
-	var exists = false
-	for id, hook := range a.Webhooks.Webhooks {
-		if hook.ID == webhook.ID {
-			index = id
-			exists = true
-		}
-	}
-	if !exists {
-		return errors.New("Webhook not found")
-	}
-	copy(a.Webhooks.Webhooks[index:], a.Webhooks.Webhooks[index+1:])
-	a.Webhooks.Webhooks[len(a.Webhooks.Webhooks)-1] = nil
-	a.Webhooks.Webhooks = a.Webhooks.Webhooks[:len(a.Webhooks.Webhooks)-1]
-	return nil
 }
 
 //handler for "/webhooks" POST endpoint
@@ -103,13 +68,37 @@ func (a *App) handleCreateWebhook(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid callback_url value '%v'", r.FormValue("callback_url"))})
 		return
 	}
+	if webhook.Unit != "" {
+		unit, err := model.ParseUnit(string(webhook.Unit))
+		if err != nil {
+			respondWithError(w, Error{Code: http.StatusBadRequest, Error: err.Error()})
+			return
+		}
+		webhook.Unit = unit
+	}
 	defer r.Body.Close()
-	err := webhook.Create(a.DB)
+	err := a.Store.GetCity(&model.City{ID: webhook.CityID})
+	if err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			respondWithError(w, Error{Code: http.StatusNotFound, Error: err.Error()})
+			return
+		}
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	// the secret is only returned here, receivers keep it to verify the
+	// deliveries
+	secret, err := signature.NewSecret()
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	webhook.Secret, webhook.PreviousSecret, webhook.PreviousSecretExpiresAt = secret, "", 0
+	err = a.Store.CreateWebhook(webhook)
 	if err != nil {
 		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
 		return
 	}
-	a.webhookChan <- webhookAction{action: "add", webhook: webhook}
 	respondWithJSON(w, http.StatusCreated, webhook)
 }
 
@@ -122,7 +111,7 @@ func (a *App) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	webhook := &model.Webhook{ID: id}
-	err = webhook.Delete(a.DB)
+	err = a.Store.DeleteWebhook(webhook)
 	if err != nil {
 		if strings.Contains(err.Error(), "no rows in result set") {
 			respondWithError(w, Error{Code: http.StatusNotFound, Error: err.Error()})
@@ -131,6 +120,101 @@ func (a *App) handleDeleteWebhook(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
 		return
 	}
-	a.webhookChan <- webhookAction{action: "delete", webhook: webhook}
 	respondWithJSON(w, http.StatusCreated, webhook)
 }
+
+//handler for "/webhooks/:id/secret" POST endpoint
+func (a *App) handleRotateWebhookSecret(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid webhook id %v", params["id"])})
+		return
+	}
+	overlap := a.WebhookSecretOverlap
+	if overlap <= 0 {
+		overlap = defaultWebhookSecretOverlap
+	}
+	if value := r.FormValue("overlap"); value != "" {
+		overlap, err = time.ParseDuration(value)
+		if err != nil || overlap < 0 || overlap > maxWebhookSecretOverlap {
+			respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid overlap '%v', expected a duration of at most %v", value, maxWebhookSecretOverlap)})
+			return
+		}
+	}
+	secret, err := signature.NewSecret()
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	webhook := &model.Webhook{ID: id}
+	err = a.Store.RotateWebhookSecret(webhook, secret, time.Now().Add(overlap).Unix())
+	if err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			respondWithError(w, Error{Code: http.StatusNotFound, Error: err.Error()})
+			return
+		}
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	respondWithJSON(w, http.StatusOK, webhook)
+}
+
+//handler for "/webhooks/:id/deliveries" GET endpoint
+func (a *App) handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid webhook id %v", params["id"])})
+		return
+	}
+	values := r.URL.Query()
+	query := model.DeliveryQuery{WebhookID: id, Limit: defaultDeliveryPageSize}
+	// status is either the outcome of the attempts or the status code they
+	// were answered with
+	if status := values.Get("status"); status != "" {
+		switch model.DeliveryStatus(status) {
+		case model.DeliverySucceeded, model.DeliveryFailed:
+			query.Status = model.DeliveryStatus(status)
+		default:
+			code, err := strconv.Atoi(status)
+			if err != nil || code < 100 || code > 599 {
+				respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid status value '%v', expected succeeded, failed or a status code", status)})
+				return
+			}
+			query.StatusCode = code
+		}
+	}
+	if limit := values.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			respondWithError(w, Error{Code: http.StatusBadRequest, Error: fmt.Sprintf("Invalid limit value '%v'", limit)})
+			return
+		}
+		if n > maxDeliveryPageSize {
+			n = maxDeliveryPageSize
+		}
+		query.Limit = n
+	}
+	if cursor := values.Get("cursor"); cursor != "" {
+		query.Before, err = strconv.Atoi(cursor)
+		if err != nil || query.Before < 1 {
+			respondWithError(w, Error{Code: http.StatusBadRequest, Error: "Invalid cursor"})
+			return
+		}
+	}
+	// ask for one more attempt than the page holds to know whether a next page exists
+	pageSize := query.Limit
+	query.Limit++
+	deliveries, err := a.Store.ListDeliveries(query)
+	if err != nil {
+		respondWithError(w, Error{Code: http.StatusInternalServerError, Error: err.Error()})
+		return
+	}
+	page := deliveryPage{Deliveries: deliveries}
+	if len(deliveries) > pageSize {
+		page.Deliveries = deliveries[:pageSize]
+		page.NextCursor = strconv.Itoa(page.Deliveries[pageSize-1].ID)
+	}
+	respondWithJSON(w, http.StatusOK, page)
+}
@@ -5,11 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/Deewai/finleap/model"
-	"log"
 	"net/http"
 	"net/http/httptest"
-	"os"
-	"strings"
+	"regexp"
 	"time"
 
 	// "time"
@@ -20,148 +18,6 @@ import (
 	"github.com/stretchr/testify/assert"
 )
 
-func TestAddWebhookInvalidWebhook(t *testing.T) {
-	a := App{}
-	a.Webhooks.Webhooks = nil
-	a.webhookChan = make(chan webhookAction)
-	go a.webhookStoreRoutine()
-	a.webhookChan <- webhookAction{
-		action:  "add",
-		webhook: &model.Webhook{},
-	}
-	assert.Equal(t, 0, len(a.Webhooks.Webhooks))
-}
-
-func TestAddWebhookValidWebhook(t *testing.T) {
-	a := App{}
-	a.Webhooks.Webhooks = nil
-	a.webhookChan = make(chan webhookAction)
-	go a.webhookStoreRoutine()
-	a.webhookChan <- webhookAction{
-		action: "add",
-		webhook: &model.Webhook{
-			ID:          1,
-			CityID:      1,
-			CallbackURL: "http://google.com",
-		},
-	}
-	assert.Equal(t, 1, len(a.Webhooks.Webhooks))
-}
-
-func TestDeleteWebhookInvalidWebhookID(t *testing.T) {
-	a := App{}
-	a.Webhooks.Webhooks = []*model.Webhook{
-		&model.Webhook{
-			ID:          1,
-			CityID:      1,
-			CallbackURL: "http://google.com",
-		},
-	}
-	a.webhookChan = make(chan webhookAction)
-	go a.webhookStoreRoutine()
-	a.webhookChan <- webhookAction{"delete", &model.Webhook{
-		ID: 0,
-	}}
-	assert.Equal(t, 1, len(a.Webhooks.Webhooks))
-}
-
-func TestDeleteWebhookValidWebhookID(t *testing.T) {
-	a := App{}
-	a.Webhooks.Webhooks = []*model.Webhook{
-		&model.Webhook{
-			ID:          1,
-			CityID:      1,
-			CallbackURL: "http://google.com",
-		},
-	}
-	a.webhookChan = make(chan webhookAction)
-	go a.webhookStoreRoutine()
-	a.webhookChan <- webhookAction{"delete", &model.Webhook{
-		ID: 1,
-	}}
-	assert.Equal(t, 0, len(a.Webhooks.Webhooks))
-}
-
-func TestRestoreWebhooksDatabaseError(t *testing.T) {
-	var buf bytes.Buffer
-	log.SetOutput(&buf)
-	defer func() {
-		log.SetOutput(os.Stderr)
-	}()
-	a := App{}
-	a.Webhooks.Webhooks = nil
-	a.webhookChan = make(chan webhookAction)
-	go a.webhookStoreRoutine()
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
-	}
-	defer db.Close()
-	a.DB = db
-
-	mock.ExpectQuery("^SELECT (.+) FROM webhooks$").WillReturnError(fmt.Errorf("Error fetching result from database"))
-	a.restoreWebhooks()
-	assert.True(t, strings.Contains(buf.String(), "Error fetching result from database"))
-	time.Sleep(2 * time.Second)
-	assert.Equal(t, 0, len(a.Webhooks.Webhooks))
-}
-
-func TestRestoreWebhooksWhenWebhooksDoesNotExistsInDB(t *testing.T) {
-	a := App{}
-	a.Webhooks.Webhooks = nil
-	a.webhookChan = make(chan webhookAction)
-	go a.webhookStoreRoutine()
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
-	}
-	defer db.Close()
-	a.DB = db
-	rows := sqlmock.NewRows([]string{"id", "city_id", "callback_url"})
-	mock.ExpectQuery("^SELECT (.+) FROM webhooks$").WillReturnRows(rows)
-	a.restoreWebhooks()
-	time.Sleep(2 * time.Second)
-	assert.Equal(t, 0, len(a.Webhooks.Webhooks))
-}
-
-func TestRestoreWebhooksWhenWebhooksExistsInDB(t *testing.T) {
-	a := App{}
-	a.Webhooks.Webhooks = nil
-	a.webhookChan = make(chan webhookAction)
-	go a.webhookStoreRoutine()
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
-	}
-	defer db.Close()
-	a.DB = db
-	rows := sqlmock.NewRows([]string{"id", "city_id", "callback_url"}).
-		AddRow(1, 1, "http.google.com")
-
-	mock.ExpectQuery("^SELECT (.+) FROM webhooks$").WillReturnRows(rows)
-	a.restoreWebhooks()
-	//wait for goroutine to add webhook
-	time.Sleep(2 * time.Second)
-	assert.Equal(t, 1, len(a.Webhooks.Webhooks))
-	assert.Equal(t, 1, a.Webhooks.Webhooks[0].ID)
-	assert.Equal(t, 1, a.Webhooks.Webhooks[0].CityID)
-	assert.Equal(t, "http.google.com", a.Webhooks.Webhooks[0].CallbackURL)
-}
-
-func TestWebhookRoutineSendTemperatureReturnsError(t *testing.T) {
-	var buf bytes.Buffer
-	log.SetOutput(&buf)
-	defer func() {
-		log.SetOutput(os.Stderr)
-	}()
-	a := App{}
-	a.newTemperature = make(chan model.Temperature)
-	go a.webhookRoutine()
-	a.newTemperature <- model.Temperature{}
-	time.Sleep(2 * time.Second)
-	assert.True(t, strings.Contains(buf.String(), "Missing fields in temperature object"))
-}
-
 func TestHandleCreateWebhookInvalidHttpMethod(t *testing.T) {
 	a := App{}
 	a.Router = mux.NewRouter()
@@ -189,11 +45,9 @@ func TestHandleCreateWebhookValidFormData(t *testing.T) {
 	}
 	defer db.Close()
 	a := App{}
-	a.DB = db
-	a.Webhooks.Webhooks = nil
-	a.webhookChan = make(chan webhookAction)
-	go a.webhookStoreRoutine()
-	mock.ExpectExec("INSERT INTO webhooks").WillReturnResult(sqlmock.NewResult(1, 1))
+	a.Store = model.NewMySQLStore(db)
+	expectGetCity(mock)
+	mock.ExpectPrepare("INSERT INTO webhooks").ExpectExec().WillReturnResult(sqlmock.NewResult(1, 1))
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
 	req, _ := http.NewRequest("POST", "/webhooks", bytes.NewBuffer([]byte(`{"city_id":1,"callback_url":"http://google.com"}`)))
@@ -205,6 +59,54 @@ func TestHandleCreateWebhookValidFormData(t *testing.T) {
 	assert.EqualValues(t, 1, m["id"])
 	assert.EqualValues(t, 1, m["city_id"])
 	assert.Equal(t, "http://google.com", m["callback_url"])
+	assert.Regexp(t, "^[0-9a-f]{64}$", m["secret"])
+}
+
+func TestHandleCreateWebhookOfDeletedCity(t *testing.T) {
+	store := model.NewMemoryStore()
+	assert.Nil(t, store.CreateCity(&model.City{Name: "Berlin"}))
+	assert.Nil(t, store.DeleteCity(&model.City{ID: 1}))
+	a := App{Store: store}
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	for _, body := range []string{`{"city_id":1,"callback_url":"http://google.com"}`, `{"city_id":2,"callback_url":"http://google.com"}`} {
+		req, _ := http.NewRequest("POST", "/webhooks", bytes.NewBuffer([]byte(body)))
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusNotFound, rr.Code, body)
+	}
+	webhooks, err := store.GetWebhooks()
+	assert.Nil(t, err)
+	assert.Empty(t, webhooks)
+}
+
+func TestHandleCreateWebhookWithUnit(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	a := App{}
+	a.Store = model.NewMySQLStore(db)
+	expectGetCity(mock)
+	mock.ExpectPrepare("INSERT INTO webhooks").ExpectExec().
+		WithArgs(1, "http://google.com", "F", sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("POST", "/webhooks", bytes.NewBuffer([]byte(`{"city_id":1,"callback_url":"http://google.com","unit":"fahrenheit"}`)))
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var m map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &m)
+	assert.Equal(t, "F", m["unit"])
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	req, _ = http.NewRequest("POST", "/webhooks", bytes.NewBuffer([]byte(`{"city_id":1,"callback_url":"http://google.com","unit":"R"}`)))
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
 }
 
 func TestHandleDeleteWebhookInvalidHttpMethod(t *testing.T) {
@@ -224,9 +126,9 @@ func TestHandleDeleteWebhookNotExistingWebhookID(t *testing.T) {
 	}
 	defer db.Close()
 	a := App{}
-	a.DB = db
-	mock.ExpectQuery("^SELECT (.+) FROM webhooks (.+)").WillReturnError(fmt.Errorf("no rows in result set"))
-	mock.ExpectExec("DELETE FROM webhooks").WillReturnError(fmt.Errorf("no rows in result set"))
+	a.Store = model.NewMySQLStore(db)
+	mock.ExpectPrepare("^SELECT (.+) FROM webhooks (.+)").ExpectQuery().WillReturnError(fmt.Errorf("no rows in result set"))
+	mock.ExpectPrepare("DELETE FROM webhooks").ExpectExec().WillReturnError(fmt.Errorf("no rows in result set"))
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
 	req, _ := http.NewRequest("DELETE", "/webhooks/1", nil)
@@ -252,20 +154,14 @@ func TestHandleDeleteWebhookValidWebhookID(t *testing.T) {
 	}
 	defer db.Close()
 	a := App{}
-	a.DB = db
-	a.Webhooks.Webhooks = []*model.Webhook{
-		&model.Webhook{
-			ID:          1,
-			CityID:      1,
-			CallbackURL: "http://google.com",
-		},
-	}
-	a.webhookChan = make(chan webhookAction)
-	go a.webhookStoreRoutine()
-	rows := sqlmock.NewRows([]string{"id", "city_id", "callback_url"}).
-		AddRow(1, 1, "http://google.com")
-	mock.ExpectQuery("^SELECT (.+) FROM webhooks (.+)").WillReturnRows(rows)
-	mock.ExpectExec("DELETE FROM webhooks (.+) ").WillReturnResult(sqlmock.NewResult(1, 1))
+	a.Store = model.NewMySQLStore(db)
+	rows := sqlmock.NewRows([]string{"id", "city_id", "callback_url", "unit"}).
+		AddRow(1, 1, "http://google.com", "C")
+	mock.ExpectPrepare("^SELECT (.+) FROM webhooks (.+)").ExpectQuery().WillReturnRows(rows)
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM webhook_outbox").WithArgs(1).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM webhooks (.+)").WithArgs(1).WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
@@ -279,3 +175,161 @@ func TestHandleDeleteWebhookValidWebhookID(t *testing.T) {
 	assert.EqualValues(t, 1, m["city_id"])
 	assert.Equal(t, "http://google.com", m["callback_url"])
 }
+
+func TestHandleCreateWebhookHostileCallbackURLs(t *testing.T) {
+	urls := []string{
+		"http://example.com/?q=');DROP TABLE webhooks;--",
+		"http://example.com/o'fallon",
+		`http://example.com/\'); DELETE FROM cities; --`,
+	}
+	for _, url := range urls {
+		t.Run(url, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+			defer db.Close()
+			a := App{}
+			a.Store = model.NewMySQLStore(db)
+			expectGetCity(mock)
+			mock.ExpectPrepare(regexp.QuoteMeta("INSERT INTO webhooks(city_id, callback_url, unit, secret) VALUES(?, ?, ?, ?)")).
+				ExpectExec().
+				WithArgs(1, url, "C", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+			a.Router = mux.NewRouter()
+			a.initializeRoutes()
+			payload, _ := json.Marshal(map[string]interface{}{"city_id": 1, "callback_url": url})
+			req, _ := http.NewRequest("POST", "/webhooks", bytes.NewBuffer(payload))
+			rr := httptest.NewRecorder()
+			a.Router.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusCreated, rr.Code)
+			var m map[string]interface{}
+			json.Unmarshal(rr.Body.Bytes(), &m)
+			assert.Equal(t, url, m["callback_url"])
+			assert.Nil(t, mock.ExpectationsWereMet())
+		})
+	}
+}
+
+func TestHandleRotateWebhookSecret(t *testing.T) {
+	store := model.NewMemoryStore()
+	assert.Nil(t, store.CreateCity(&model.City{Name: "Berlin"}))
+	a := App{Store: store}
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	req, _ := http.NewRequest("POST", "/webhooks", bytes.NewBuffer([]byte(`{"city_id":1,"callback_url":"http://google.com"}`)))
+	rr := httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var created model.Webhook
+	json.Unmarshal(rr.Body.Bytes(), &created)
+
+	req, _ = http.NewRequest("POST", "/webhooks/1/secret?overlap=1h", nil)
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var rotated map[string]interface{}
+	json.Unmarshal(rr.Body.Bytes(), &rotated)
+	assert.Regexp(t, "^[0-9a-f]{64}$", rotated["secret"])
+	assert.NotEqual(t, created.Secret, rotated["secret"])
+	assert.InDelta(t, time.Now().Add(time.Hour).Unix(), rotated["previous_secret_expires_at"], 5)
+
+	// deliveries are signed with both secrets until the overlap ends
+	assert.Nil(t, store.CreateTemperature(&model.Temperature{CityID: 1, Max: 20, Min: 10, Timestamp: 10000}))
+	entries, err := store.ClaimOutbox(time.Now().Unix(), time.Now().Add(time.Minute).Unix(), 10)
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, []string{rotated["secret"].(string), created.Secret}, entries[0].Webhook.Secrets(time.Now().Unix()))
+		assert.Equal(t, []string{rotated["secret"].(string)}, entries[0].Webhook.Secrets(time.Now().Add(2*time.Hour).Unix()))
+	}
+
+	// the secret isn't returned again
+	req, _ = http.NewRequest("DELETE", "/webhooks/1", nil)
+	rr = httptest.NewRecorder()
+	a.Router.ServeHTTP(rr, req)
+	assert.NotContains(t, rr.Body.String(), "secret")
+}
+
+func TestHandleRotateWebhookSecretInvalidRequests(t *testing.T) {
+	a := App{Store: model.NewMemoryStore()}
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	for path, code := range map[string]int{
+		"/webhooks/abc/secret":             http.StatusBadRequest,
+		"/webhooks/1/secret?overlap=never": http.StatusBadRequest,
+		"/webhooks/1/secret?overlap=-1h":   http.StatusBadRequest,
+		"/webhooks/1/secret?overlap=720h":  http.StatusBadRequest,
+		"/webhooks/1/secret":               http.StatusNotFound,
+	} {
+		req, _ := http.NewRequest("POST", path, nil)
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		assert.Equal(t, code, rr.Code, path)
+	}
+}
+
+func TestHandleListDeliveries(t *testing.T) {
+	store := model.NewMemoryStore()
+	for i, status := range []int{503, 0, 200, 204} {
+		d := &model.Delivery{WebhookID: 1, TemperatureID: 5, Attempt: i + 1, Status: model.DeliverySucceeded, StatusCode: status, CreatedAt: 1000}
+		if status < 200 || status > 299 {
+			d.Status, d.Error = model.DeliveryFailed, "failed"
+		}
+		assert.Nil(t, store.RecordDelivery(d))
+	}
+	assert.Nil(t, store.RecordDelivery(&model.Delivery{WebhookID: 2, TemperatureID: 5, Attempt: 1, Status: model.DeliverySucceeded, StatusCode: 200}))
+	a := App{Store: store}
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	list := func(path string) (int, []int, string) {
+		req, _ := http.NewRequest("GET", path, nil)
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		var page deliveryPage
+		json.Unmarshal(rr.Body.Bytes(), &page)
+		attempts := []int{}
+		for _, d := range page.Deliveries {
+			attempts = append(attempts, d.Attempt)
+		}
+		return rr.Code, attempts, page.NextCursor
+	}
+
+	code, attempts, next := list("/webhooks/1/deliveries")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, []int{4, 3, 2, 1}, attempts)
+	assert.Empty(t, next)
+	_, attempts, _ = list("/webhooks/1/deliveries?status=failed")
+	assert.Equal(t, []int{2, 1}, attempts)
+	_, attempts, _ = list("/webhooks/1/deliveries?status=succeeded")
+	assert.Equal(t, []int{4, 3}, attempts)
+	_, attempts, _ = list("/webhooks/1/deliveries?status=503")
+	assert.Equal(t, []int{1}, attempts)
+
+	_, attempts, next = list("/webhooks/1/deliveries?limit=3")
+	assert.Equal(t, []int{4, 3, 2}, attempts)
+	_, attempts, next = list("/webhooks/1/deliveries?limit=3&cursor=" + next)
+	assert.Equal(t, []int{1}, attempts)
+	assert.Empty(t, next)
+
+	code, attempts, _ = list("/webhooks/3/deliveries")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Empty(t, attempts)
+}
+
+func TestHandleListDeliveriesInvalidRequests(t *testing.T) {
+	a := App{Store: model.NewMemoryStore()}
+	a.Router = mux.NewRouter()
+	a.initializeRoutes()
+	for _, path := range []string{
+		"/webhooks/abc/deliveries",
+		"/webhooks/1/deliveries?status=pending",
+		"/webhooks/1/deliveries?status=42",
+		"/webhooks/1/deliveries?limit=0",
+		"/webhooks/1/deliveries?cursor=abc",
+	} {
+		req, _ := http.NewRequest("GET", path, nil)
+		rr := httptest.NewRecorder()
+		a.Router.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, path)
+	}
+}
@@ -0,0 +1,17 @@
+// Package cache stores values for a limited time behind a pluggable Backend
+package cache
+
+import "time"
+
+// Backend stores byte values by key. Its operations map onto the GET, SET
+// with an expiry and DEL commands of Redis, so a Redis client can be plugged
+// in where the in-process LRU is used.
+type Backend interface {
+	// Get returns the value stored under key, false when it is missing or
+	// has expired
+	Get(key string) ([]byte, bool, error)
+	// Set stores value under key for ttl, without expiry when ttl is zero
+	Set(key string, value []byte, ttl time.Duration) error
+	// Delete removes keys, ignoring missing ones
+	Delete(keys ...string) error
+}
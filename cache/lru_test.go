@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func get(t *testing.T, c Backend, key string) string {
+	value, ok, err := c.Get(key)
+	assert.Nil(t, err)
+	if !ok {
+		return ""
+	}
+	return string(value)
+}
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	c := NewLRU(2)
+	assert.Nil(t, c.Set("a", []byte("1"), 0))
+	assert.Nil(t, c.Set("b", []byte("2"), 0))
+	// reading a makes b the least recently used
+	assert.Equal(t, "1", get(t, c, "a"))
+	assert.Nil(t, c.Set("c", []byte("3"), 0))
+	assert.Equal(t, 2, c.Len())
+	assert.Equal(t, "", get(t, c, "b"))
+	assert.Equal(t, "1", get(t, c, "a"))
+	assert.Equal(t, "3", get(t, c, "c"))
+
+	assert.Nil(t, c.Set("a", []byte("4"), 0))
+	assert.Equal(t, "4", get(t, c, "a"))
+	assert.Equal(t, 2, c.Len())
+}
+
+func TestLRUExpires(t *testing.T) {
+	now := time.Unix(1580000000, 0)
+	c := NewLRU(10)
+	c.now = func() time.Time { return now }
+	assert.Nil(t, c.Set("a", []byte("1"), time.Minute))
+	assert.Nil(t, c.Set("b", []byte("2"), 0))
+	now = now.Add(59 * time.Second)
+	assert.Equal(t, "1", get(t, c, "a"))
+	now = now.Add(time.Second)
+	assert.Equal(t, "", get(t, c, "a"))
+	assert.Equal(t, 1, c.Len())
+	// entries without a ttl never expire
+	now = now.Add(24 * time.Hour)
+	assert.Equal(t, "2", get(t, c, "b"))
+}
+
+func TestLRUDelete(t *testing.T) {
+	c := NewLRU(10)
+	assert.Nil(t, c.Set("a", []byte("1"), 0))
+	assert.Nil(t, c.Set("b", []byte("2"), 0))
+	assert.Nil(t, c.Delete("a", "missing"))
+	assert.Equal(t, "", get(t, c, "a"))
+	assert.Equal(t, "2", get(t, c, "b"))
+	assert.Equal(t, 1, c.Len())
+}
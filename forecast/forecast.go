@@ -0,0 +1,97 @@
+// Package forecast predicts future values of regularly sampled series
+package forecast
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// z95 is the standard normal quantile of 95% confidence intervals
+const z95 = 1.959964
+
+// ErrNotEnoughData is returned when a series is too short for a Forecaster
+var ErrNotEnoughData = errors.New("Not enough data to forecast")
+
+// Prediction is a predicted value with its 95% confidence interval
+type Prediction struct {
+	Value float64 `json:"value"`
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+}
+
+// Forecaster predicts a series
+type Forecaster interface {
+	// Forecast fits series, observed at a regular step, and predicts the
+	// values 1 to horizon steps after its last one
+	Forecast(series []float64, horizon int) ([]Prediction, error)
+}
+
+var forecasters = map[string]func() Forecaster{}
+
+// Register makes a Forecaster available to New under name
+func Register(name string, newForecaster func() Forecaster) {
+	forecasters[name] = newForecaster
+}
+
+// New returns the Forecaster registered under name
+func New(name string) (Forecaster, error) {
+	newForecaster, ok := forecasters[name]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported forecasting model '%s'", name)
+	}
+	return newForecaster(), nil
+}
+
+// Names lists the registered Forecasters
+func Names() []string {
+	names := []string{}
+	for name := range forecasters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// predict returns the prediction value with the interval of a normal
+// error of standard deviation stdDev
+func predict(value, stdDev float64) Prediction {
+	return Prediction{Value: value, Lower: value - z95*stdDev, Upper: value + z95*stdDev}
+}
+
+// rmse returns the root mean square of errors
+func rmse(errors []float64) float64 {
+	if len(errors) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, e := range errors {
+		sum += e * e
+	}
+	return math.Sqrt(sum / float64(len(errors)))
+}
+
+// Point is a value observed at a unix time
+type Point struct {
+	Time  int64
+	Value float64
+}
+
+// Resample turns points, ordered by time and aligned to step, into a series
+// sampled every step seconds from the first point to the last. Gaps are
+// filled by linear interpolation.
+func Resample(points []Point, step int64) []float64 {
+	series := []float64{}
+	for i, p := range points {
+		if i > 0 {
+			previous := points[i-1]
+			gap := (p.Time - previous.Time) / step
+			for j := int64(1); j < gap; j++ {
+				series = append(series, previous.Value+(p.Value-previous.Value)*float64(j)/float64(gap))
+			}
+		}
+		series = append(series, p.Value)
+	}
+	return series
+}
@@ -0,0 +1,80 @@
+package forecast
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	assert.Equal(t, []string{"exponential-smoothing", "holt-winters", "linear-trend"}, Names())
+	for _, name := range Names() {
+		f, err := New(name)
+		assert.Nil(t, err)
+		assert.NotNil(t, f)
+	}
+	_, err := New("arima")
+	assert.NotNil(t, err)
+}
+
+func TestResample(t *testing.T) {
+	assert.Equal(t, []float64{}, Resample(nil, 3600))
+	points := []Point{{Time: 0, Value: 10}, {Time: 3600, Value: 12}, {Time: 4 * 3600, Value: 18}}
+	assert.Equal(t, []float64{10, 12, 14, 16, 18}, Resample(points, 3600))
+}
+
+func TestLinearTrend(t *testing.T) {
+	predictions, err := LinearTrend{}.Forecast([]float64{1, 3, 5, 7}, 2)
+	assert.Nil(t, err)
+	assert.Len(t, predictions, 2)
+	assert.InDelta(t, 9, predictions[0].Value, 1e-9)
+	assert.InDelta(t, 11, predictions[1].Value, 1e-9)
+	// a perfect fit leaves no uncertainty
+	assert.InDelta(t, 9, predictions[0].Lower, 1e-9)
+
+	predictions, err = LinearTrend{}.Forecast([]float64{1, 4, 5, 8, 9}, 3)
+	assert.Nil(t, err)
+	for i, p := range predictions {
+		assert.True(t, p.Lower < p.Value && p.Value < p.Upper)
+		if i > 0 {
+			assert.True(t, p.Upper-p.Lower > predictions[i-1].Upper-predictions[i-1].Lower)
+		}
+	}
+
+	_, err = LinearTrend{}.Forecast([]float64{1, 2}, 1)
+	assert.Equal(t, ErrNotEnoughData, err)
+}
+
+func TestExponentialSmoothing(t *testing.T) {
+	predictions, err := ExponentialSmoothing{Alpha: 0.5}.Forecast([]float64{10, 20, 10, 20}, 2)
+	assert.Nil(t, err)
+	// levels 10, 15, 12.5, 16.25
+	assert.Equal(t, 16.25, predictions[0].Value)
+	assert.Equal(t, 16.25, predictions[1].Value)
+	assert.True(t, predictions[1].Upper-predictions[1].Lower > predictions[0].Upper-predictions[0].Lower)
+
+	_, err = ExponentialSmoothing{Alpha: 0.5}.Forecast([]float64{10}, 1)
+	assert.Equal(t, ErrNotEnoughData, err)
+}
+
+func TestHoltWinters(t *testing.T) {
+	// a daily cycle on an hourly series rising by a tenth of a degree an hour
+	series := []float64{}
+	for i := 0; i < 4*24; i++ {
+		series = append(series, 15+0.1*float64(i)+5*math.Sin(2*math.Pi*float64(i)/24))
+	}
+	f := HoltWinters{Alpha: 0.3, Beta: 0.05, Gamma: 0.3, Period: 24}
+	predictions, err := f.Forecast(series, 24)
+	assert.Nil(t, err)
+	assert.Len(t, predictions, 24)
+	for h, p := range predictions {
+		i := len(series) + h
+		expected := 15 + 0.1*float64(i) + 5*math.Sin(2*math.Pi*float64(i)/24)
+		assert.InDelta(t, expected, p.Value, 0.5)
+		assert.True(t, p.Lower <= p.Value && p.Value <= p.Upper)
+	}
+
+	_, err = f.Forecast(series[:47], 1)
+	assert.Equal(t, ErrNotEnoughData, err)
+}
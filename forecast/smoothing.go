@@ -0,0 +1,99 @@
+package forecast
+
+import "math"
+
+func init() {
+	Register("exponential-smoothing", func() Forecaster { return ExponentialSmoothing{Alpha: 0.5} })
+	// hourly series repeat every 24 steps
+	Register("holt-winters", func() Forecaster { return HoltWinters{Alpha: 0.3, Beta: 0.05, Gamma: 0.3, Period: 24} })
+}
+
+// ExponentialSmoothing is simple exponential smoothing. Its forecast is a
+// level following the series with the smoothing factor Alpha.
+type ExponentialSmoothing struct {
+	Alpha float64
+}
+
+// Forecast implements Forecaster
+func (f ExponentialSmoothing) Forecast(series []float64, horizon int) ([]Prediction, error) {
+	if len(series) < 2 {
+		return nil, ErrNotEnoughData
+	}
+	level := series[0]
+	errors := make([]float64, 0, len(series)-1)
+	for _, value := range series[1:] {
+		errors = append(errors, value-level)
+		level += f.Alpha * (value - level)
+	}
+	sigma := rmse(errors)
+	predictions := make([]Prediction, horizon)
+	for h := 1; h <= horizon; h++ {
+		predictions[h-1] = predict(level, sigma*math.Sqrt(1+float64(h-1)*f.Alpha*f.Alpha))
+	}
+	return predictions, nil
+}
+
+// HoltWinters is additive triple exponential smoothing. Alpha smooths the
+// level, Beta the trend and Gamma the seasonal component, which repeats every
+// Period steps.
+type HoltWinters struct {
+	Alpha  float64
+	Beta   float64
+	Gamma  float64
+	Period int
+}
+
+// Forecast implements Forecaster. The series must cover two periods, the
+// first two initialize the level, the trend and the seasonal component.
+func (f HoltWinters) Forecast(series []float64, horizon int) ([]Prediction, error) {
+	m := f.Period
+	if m < 1 || len(series) < 2*m {
+		return nil, ErrNotEnoughData
+	}
+	first, second := mean(series[:m]), mean(series[m:2*m])
+	trend := (second - first) / float64(m)
+	// the seasonal component is what is left of the first two periods once
+	// the trend through their means is removed
+	season := make([]float64, m)
+	for i := range season {
+		offset := float64(i) - float64(m-1)/2
+		season[i] = (series[i] - (first + trend*offset) + series[m+i] - (second + trend*offset)) / 2
+	}
+	level := first + trend*float64(m-1)/2
+	errors := make([]float64, 0, len(series)-m)
+	for t := m; t < len(series); t++ {
+		value, s := series[t], season[t%m]
+		errors = append(errors, value-(level+trend+s))
+		previous := level
+		level = f.Alpha*(value-s) + (1-f.Alpha)*(level+trend)
+		trend = f.Beta*(level-previous) + (1-f.Beta)*trend
+		season[t%m] = f.Gamma*(value-level) + (1-f.Gamma)*s
+	}
+	sigma := rmse(errors)
+	n := len(series)
+	predictions := make([]Prediction, horizon)
+	// the variance of h steps ahead sums the weights the smoothing carries
+	// the errors of the steps in between with
+	variance := 1.0
+	for h := 1; h <= horizon; h++ {
+		if h > 1 {
+			j := h - 1
+			c := f.Alpha * (1 + float64(j)*f.Beta)
+			if j%m == 0 {
+				c += f.Gamma * (1 - f.Alpha)
+			}
+			variance += c * c
+		}
+		value := level + float64(h)*trend + season[(n-1+h)%m]
+		predictions[h-1] = predict(value, sigma*math.Sqrt(variance))
+	}
+	return predictions, nil
+}
+
+func mean(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
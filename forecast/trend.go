@@ -0,0 +1,39 @@
+package forecast
+
+import "math"
+
+func init() {
+	Register("linear-trend", func() Forecaster { return LinearTrend{} })
+}
+
+// LinearTrend fits a least squares line through the series and extends it
+type LinearTrend struct{}
+
+// Forecast implements Forecaster
+func (LinearTrend) Forecast(series []float64, horizon int) ([]Prediction, error) {
+	n := len(series)
+	if n < 3 {
+		return nil, ErrNotEnoughData
+	}
+	xMean, yMean := float64(n-1)/2, mean(series)
+	var sxx, sxy float64
+	for x, y := range series {
+		sxx += (float64(x) - xMean) * (float64(x) - xMean)
+		sxy += (float64(x) - xMean) * (y - yMean)
+	}
+	slope := sxy / sxx
+	intercept := yMean - slope*xMean
+	var sse float64
+	for x, y := range series {
+		e := y - (intercept + slope*float64(x))
+		sse += e * e
+	}
+	sigma := math.Sqrt(sse / float64(n-2))
+	predictions := make([]Prediction, horizon)
+	for h := 1; h <= horizon; h++ {
+		x := float64(n - 1 + h)
+		se := sigma * math.Sqrt(1+1/float64(n)+(x-xMean)*(x-xMean)/sxx)
+		predictions[h-1] = predict(intercept+slope*x, se)
+	}
+	return predictions, nil
+}
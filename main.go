@@ -2,13 +2,83 @@ package main
 
 import (
 	"github.com/Deewai/finleap/app"
+	"github.com/Deewai/finleap/model"
+	"log"
+	"math/rand"
 	"os"
+	"strconv"
+	"time"
 )
 
+// database returns the driver and data source name to use. DB_DRIVER and
+// DB_DSN take precedence, otherwise MySQL is configured from MYSQL_*.
+func database() (string, string) {
+	driver := os.Getenv("DB_DRIVER")
+	if driver == "" {
+		driver = "mysql"
+	}
+	dsn := os.Getenv("DB_DSN")
+	if dsn == "" && driver == "mysql" {
+		dsn = model.MySQLDSN(os.Getenv("MYSQL_HOST"), os.Getenv("MYSQL_PORT"), os.Getenv("MYSQL_USER"), os.Getenv("MYSQL_PASSWORD"), os.Getenv("MYSQL_DATABASE"))
+	}
+	return driver, dsn
+}
+
+// duration reads the environment variable name as a time.Duration, zero when
+// it is empty
+func duration(name string) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return d
+}
+
+// integer reads the environment variable name as an int, zero when it is
+// empty
+func integer(name string) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", name, err)
+	}
+	return n
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
 	a := app.App{}
+	a.TimestampSkew = duration("TEMPERATURE_MAX_SKEW")
+	a.TimestampMaxAge = duration("TEMPERATURE_MAX_AGE")
+	a.ForecastCacheTTL = duration("FORECAST_CACHE_TTL")
+	a.WebhookMaxAttempts = integer("WEBHOOK_MAX_ATTEMPTS")
+	a.WebhookRetryDelay = duration("WEBHOOK_RETRY_DELAY")
+	a.WebhookMaxRetryDelay = duration("WEBHOOK_MAX_RETRY_DELAY")
+	a.WebhookWorkers = integer("WEBHOOK_WORKERS")
+	a.WebhookWorkersPerHost = integer("WEBHOOK_WORKERS_PER_HOST")
+	a.WebhookQueueSize = integer("WEBHOOK_QUEUE_SIZE")
+	a.WebhookTimeout = duration("WEBHOOK_TIMEOUT")
+	a.WebhookSecretOverlap = duration("WEBHOOK_SECRET_OVERLAP")
+	a.WebhookDeliveryRetention = duration("WEBHOOK_DELIVERY_RETENTION")
+	policy, err := app.ParseBackpressurePolicy(os.Getenv("WEBHOOK_BACKPRESSURE"))
+	if err != nil {
+		log.Fatalf("Invalid WEBHOOK_BACKPRESSURE: %v", err)
+	}
+	a.WebhookBackpressure = policy
+	// seed the jitter of webhook retries
+	rand.Seed(time.Now().UnixNano())
 	// Make sure environment variables are set
-	a.Initialize(os.Getenv("MYSQL_HOST"), os.Getenv("MYSQL_PORT"), os.Getenv("MYSQL_USER"), os.Getenv("MYSQL_PASSWORD"), os.Getenv("MYSQL_DATABASE"))
+	a.Initialize(database())
 
 	a.Run(":3000")
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Deewai/finleap/model"
+	"log"
+	"strconv"
+)
+
+const migrateUsage = "usage: main migrate up|down [steps]|status"
+
+// migrate runs the "migrate" subcommand against the configured database
+func migrate(args []string) {
+	if len(args) == 0 {
+		log.Fatal(migrateUsage)
+	}
+	driver, dsn := database()
+	db, err := model.Open(driver, dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	migrator, err := model.NewMigrator(db, driver)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch args[0] {
+	case "up":
+		migrations, err := migrator.Up()
+		for _, migration := range migrations {
+			fmt.Printf("applied %d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("Invalid steps value %v", args[1])
+			}
+		}
+		migrations, err := migrator.Down(steps)
+		for _, migration := range migrations {
+			fmt.Printf("reverted %d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "status":
+		statuses, err := migrator.Status()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, status := range statuses {
+			if status.Applied {
+				fmt.Printf("%d_%s\tapplied at %s\n", status.Version, status.Name, status.AppliedAt.Format("2006-01-02 15:04:05"))
+			} else {
+				fmt.Printf("%d_%s\tpending\n", status.Version, status.Name)
+			}
+		}
+	default:
+		log.Fatal(migrateUsage)
+	}
+}
@@ -0,0 +1,65 @@
+package model
+
+import (
+	"fmt"
+	"math"
+)
+
+// Aggregation is a function summarizing the readings of a forecast window.
+// It is applied to the max and the min of the readings separately.
+type Aggregation string
+
+const (
+	Mean   Aggregation = "mean"
+	Median Aggregation = "median"
+	P90    Aggregation = "p90"
+	// MinOfMins and MaxOfMaxes are the lowest and the highest readings
+	MinOfMins  Aggregation = "min-of-mins"
+	MaxOfMaxes Aggregation = "max-of-maxes"
+	// StdDev is the population standard deviation
+	StdDev Aggregation = "stddev"
+)
+
+// Aggregations lists every supported Aggregation
+var Aggregations = []Aggregation{Mean, Median, P90, MinOfMins, MaxOfMaxes, StdDev}
+
+// ParseAggregation returns the Aggregation named name
+func ParseAggregation(name string) (Aggregation, error) {
+	for _, agg := range Aggregations {
+		if string(agg) == name {
+			return agg, nil
+		}
+	}
+	return "", fmt.Errorf("Unsupported aggregation '%s'", name)
+}
+
+// percentileRank is the percentile a percentile aggregation computes
+func (agg Aggregation) percentileRank() (float64, bool) {
+	switch agg {
+	case Median:
+		return 0.5, true
+	case P90:
+		return 0.9, true
+	}
+	return 0, false
+}
+
+// percentileOffset returns the offset of the lower of the two sorted values
+// the percentile p of n values is interpolated from, and the weight of the
+// upper one
+func percentileOffset(p float64, n int) (int, float64) {
+	position := p * float64(n-1)
+	lower := math.Floor(position)
+	return int(lower), position - lower
+}
+
+// interpolate returns the value at weight between lower and upper
+func interpolate(lower, upper, weight float64) float64 {
+	return lower + (upper-lower)*weight
+}
+
+// stdDev returns the standard deviation of values whose mean is mean and
+// whose squares have the mean meanOfSquares
+func stdDev(mean, meanOfSquares float64) float64 {
+	return math.Sqrt(math.Max(0, meanOfSquares-mean*mean))
+}
@@ -0,0 +1,36 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAggregation(t *testing.T) {
+	for _, agg := range Aggregations {
+		parsed, err := ParseAggregation(string(agg))
+		assert.Nil(t, err)
+		assert.Equal(t, agg, parsed)
+	}
+	_, err := ParseAggregation("average")
+	assert.NotNil(t, err)
+}
+
+func TestAggregate(t *testing.T) {
+	assert.Equal(t, 7.0, aggregate([]float64{7}, Median))
+	assert.Equal(t, 7.0, aggregate([]float64{7}, P90))
+	assert.Equal(t, 0.0, aggregate([]float64{7}, StdDev))
+	assert.Equal(t, 2.5, aggregate([]float64{4, 1, 3, 2}, Median))
+	assert.InDelta(t, 9.1, aggregate([]float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, P90), 0.0001)
+	assert.Equal(t, 2.0, aggregate([]float64{2, 4, 4, 4, 5, 5, 7, 9}, StdDev))
+}
+
+func TestForecastMarshalJSON(t *testing.T) {
+	data, err := json.Marshal(Forecast{CityID: 1, Window: "24h", Aggregation: Mean})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"city_id":1,"max":null,"min":null,"sample":0,"window":"24h","agg":"mean"}`, string(data))
+	data, err = json.Marshal(Forecast{CityID: 1, Max: 25, Min: 7.5, Sample: 2})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"city_id":1,"max":25,"min":7.5,"sample":2}`, string(data))
+}
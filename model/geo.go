@@ -0,0 +1,93 @@
+package model
+
+import (
+	"math"
+	"sort"
+)
+
+// earthRadiusKm is the mean radius of the earth
+const earthRadiusKm = 6371.0
+
+// GeoBox is a latitude/longitude rectangle. MinLon is greater than MaxLon
+// when the box crosses the antimeridian.
+type GeoBox struct {
+	MinLat float64
+	MaxLat float64
+	MinLon float64
+	MaxLon float64
+}
+
+// NearbyCity is a city with its distance to a searched point
+type NearbyCity struct {
+	City
+	DistanceKm float64 `json:"distance_km"`
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
+
+func degrees(radians float64) float64 {
+	return radians * 180 / math.Pi
+}
+
+// Distance returns the great-circle distance in km between two coordinates
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	dLat := radians(lat2 - lat1)
+	dLon := radians(lon2 - lon1)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(radians(lat1))*math.Cos(radians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// BoundingBox returns the smallest GeoBox holding every point within
+// radiusKm of lat, lon
+func BoundingBox(lat, lon, radiusKm float64) GeoBox {
+	dLat := degrees(radiusKm / earthRadiusKm)
+	box := GeoBox{MinLat: lat - dLat, MaxLat: lat + dLat, MinLon: -180, MaxLon: 180}
+	if box.MinLat <= -90 || box.MaxLat >= 90 {
+		// the circle holds a pole, so it spans every longitude
+		box.MinLat = math.Max(box.MinLat, -90)
+		box.MaxLat = math.Min(box.MaxLat, 90)
+		return box
+	}
+	dLon := degrees(math.Asin(math.Min(1, math.Sin(radiusKm/earthRadiusKm)/math.Cos(radians(lat)))))
+	if dLon >= 180 {
+		return box
+	}
+	box.MinLon = lon - dLon
+	box.MaxLon = lon + dLon
+	if box.MinLon < -180 {
+		box.MinLon += 360
+	}
+	if box.MaxLon > 180 {
+		box.MaxLon -= 360
+	}
+	return box
+}
+
+// FindNearbyCities returns up to limit cities within radiusKm of lat, lon,
+// nearest first. Candidates come from the bounding box of the circle so the
+// store can answer from its coordinates index.
+func FindNearbyCities(store CityStore, lat, lon, radiusKm float64, limit int) ([]NearbyCity, error) {
+	candidates, err := store.FindCitiesInBox(BoundingBox(lat, lon, radiusKm))
+	if err != nil {
+		return nil, err
+	}
+	nearby := []NearbyCity{}
+	for _, city := range candidates {
+		distance := Distance(lat, lon, float64(city.Latitude), float64(city.Longitude))
+		if distance <= radiusKm {
+			nearby = append(nearby, NearbyCity{City: city, DistanceKm: distance})
+		}
+	}
+	sort.Slice(nearby, func(i, j int) bool {
+		if nearby[i].DistanceKm != nearby[j].DistanceKm {
+			return nearby[i].DistanceKm < nearby[j].DistanceKm
+		}
+		return nearby[i].ID < nearby[j].ID
+	})
+	if len(nearby) > limit {
+		nearby = nearby[:limit]
+	}
+	return nearby, nil
+}
@@ -0,0 +1,66 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDistance(t *testing.T) {
+	assert.InDelta(t, 255.3, Distance(52.520008, 13.404954, 53.551086, 9.993682), 1)
+	assert.InDelta(t, 0, Distance(10, 20, 10, 20), 0.0001)
+	assert.InDelta(t, 20015, Distance(0, 0, 0, 180), 1)
+}
+
+func TestBoundingBox(t *testing.T) {
+	box := BoundingBox(52.52, 13.405, 100)
+	assert.InDelta(t, 51.62, box.MinLat, 0.01)
+	assert.InDelta(t, 53.42, box.MaxLat, 0.01)
+	assert.True(t, box.MinLon < 13.405 && box.MaxLon > 13.405)
+	// the corners of the box lie outside the radius, its edges on it
+	assert.InDelta(t, 100, Distance(52.52, 13.405, box.MaxLat, 13.405), 0.1)
+}
+
+func TestBoundingBoxAcrossAntimeridian(t *testing.T) {
+	box := BoundingBox(-17.7, 179.9, 100)
+	assert.True(t, box.MinLon > box.MaxLon)
+	assert.InDelta(t, -179.15, box.MaxLon, 0.1)
+}
+
+func TestBoundingBoxAroundPole(t *testing.T) {
+	box := BoundingBox(89.5, 0, 100)
+	assert.Equal(t, GeoBox{MinLat: box.MinLat, MaxLat: 90, MinLon: -180, MaxLon: 180}, box)
+}
+
+func TestFindNearbyCities(t *testing.T) {
+	s := NewMemoryStore()
+	for _, city := range []City{
+		{Name: "Berlin", Latitude: 52.520008, Longitude: 13.404954},
+		{Name: "Potsdam", Latitude: 52.390569, Longitude: 13.064473},
+		{Name: "Hamburg", Latitude: 53.551086, Longitude: 9.993682},
+		{Name: "Suva", Latitude: -18.124809, Longitude: 178.450079},
+		{Name: "Apia", Latitude: -13.833333, Longitude: -171.766667},
+	} {
+		city := city
+		assert.Nil(t, s.CreateCity(&city))
+	}
+	nearby, err := FindNearbyCities(s, 52.39, 13.06, 300, 10)
+	assert.Nil(t, err)
+	if assert.Len(t, nearby, 3) {
+		assert.Equal(t, "Potsdam", nearby[0].Name)
+		assert.Equal(t, "Berlin", nearby[1].Name)
+		assert.Equal(t, "Hamburg", nearby[2].Name)
+		assert.InDelta(t, 27.5, nearby[1].DistanceKm, 0.5)
+	}
+	nearby, err = FindNearbyCities(s, 52.39, 13.06, 300, 1)
+	assert.Nil(t, err)
+	assert.Len(t, nearby, 1)
+
+	// Apia is found across the antimeridian
+	nearby, err = FindNearbyCities(s, -16, 179.9, 1200, 10)
+	assert.Nil(t, err)
+	if assert.Len(t, nearby, 2) {
+		assert.Equal(t, "Suva", nearby[0].Name)
+		assert.Equal(t, "Apia", nearby[1].Name)
+	}
+}
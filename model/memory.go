@@ -0,0 +1,553 @@
+package model
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	errDuplicateCityName = errors.New("Duplicate entry for city name")
+	errCityNotExist      = errors.New("City doesn't exist")
+)
+
+// MemoryStore is a Store kept in process memory. It enforces the same
+// constraints as the SQL schema and is meant for tests and local runs.
+type MemoryStore struct {
+	lock              sync.Mutex
+	cities            map[int]City
+	temperatures      map[int]Temperature
+	webhooks          map[int]Webhook
+	deletedCities     map[int]bool
+	outbox            map[int]*memoryOutboxEntry
+	deliveries        []Delivery
+	lastCityID        int
+	lastTemperatureID int
+	lastWebhookID     int
+	lastOutboxID      int
+	lastDeliveryID    int
+}
+
+type memoryOutboxEntry struct {
+	id            int
+	webhookID     int
+	temperatureID int
+	claimedUntil  int64
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		cities:        make(map[int]City),
+		temperatures:  make(map[int]Temperature),
+		webhooks:      make(map[int]Webhook),
+		deletedCities: make(map[int]bool),
+		outbox:        make(map[int]*memoryOutboxEntry),
+	}
+}
+
+func (s *MemoryStore) nameTaken(name string, id int) bool {
+	for _, city := range s.cities {
+		if city.Name == name && city.ID != id && !s.deletedCities[city.ID] {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) CreateCity(c *City) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.nameTaken(c.Name, 0) {
+		return errDuplicateCityName
+	}
+	s.lastCityID++
+	c.ID = s.lastCityID
+	s.cities[c.ID] = *c
+	return nil
+}
+
+func (s *MemoryStore) GetCity(c *City) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	city, ok := s.cities[c.ID]
+	if !ok || s.deletedCities[c.ID] {
+		return sql.ErrNoRows
+	}
+	*c = city
+	return nil
+}
+
+// cityBefore reports whether a sorts before b when ordered by sortBy
+func cityBefore(a, b City, sortBy string) bool {
+	if sortBy == "name" && a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.ID < b.ID
+}
+
+func (s *MemoryStore) ListCities(q CityQuery) ([]City, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	prefix := strings.ToLower(q.NamePrefix)
+	cities := []City{}
+	for _, city := range s.cities {
+		if s.deletedCities[city.ID] || !strings.HasPrefix(strings.ToLower(city.Name), prefix) {
+			continue
+		}
+		if q.After != nil {
+			if q.Descending && !cityBefore(city, *q.After, q.SortBy) {
+				continue
+			}
+			if !q.Descending && !cityBefore(*q.After, city, q.SortBy) {
+				continue
+			}
+		}
+		cities = append(cities, city)
+	}
+	sort.Slice(cities, func(i, j int) bool {
+		if q.Descending {
+			return cityBefore(cities[j], cities[i], q.SortBy)
+		}
+		return cityBefore(cities[i], cities[j], q.SortBy)
+	})
+	if len(cities) > q.Limit {
+		cities = cities[:q.Limit]
+	}
+	return cities, nil
+}
+
+func (s *MemoryStore) FindCitiesInBox(box GeoBox) ([]City, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	cities := []City{}
+	for _, city := range s.cities {
+		if s.deletedCities[city.ID] {
+			continue
+		}
+		lat, lon := float64(city.Latitude), float64(city.Longitude)
+		if lat < box.MinLat || lat > box.MaxLat {
+			continue
+		}
+		if box.MinLon <= box.MaxLon && (lon < box.MinLon || lon > box.MaxLon) {
+			continue
+		}
+		if box.MinLon > box.MaxLon && lon < box.MinLon && lon > box.MaxLon {
+			continue
+		}
+		cities = append(cities, city)
+	}
+	sort.Slice(cities, func(i, j int) bool { return cities[i].ID < cities[j].ID })
+	return cities, nil
+}
+
+func (s *MemoryStore) UpdateCity(c *City) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.cities[c.ID]; !ok || s.deletedCities[c.ID] {
+		return sql.ErrNoRows
+	}
+	if s.nameTaken(c.Name, c.ID) {
+		return errDuplicateCityName
+	}
+	s.cities[c.ID] = *c
+	return nil
+}
+
+func (s *MemoryStore) DeleteCity(c *City) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	city, ok := s.cities[c.ID]
+	if !ok || s.deletedCities[c.ID] {
+		return sql.ErrNoRows
+	}
+	*c = city
+	s.deletedCities[c.ID] = true
+	return nil
+}
+
+func (s *MemoryStore) DeleteCityCascade(c *City) ([]Webhook, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	city, ok := s.cities[c.ID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	for id, t := range s.temperatures {
+		if t.CityID == c.ID {
+			delete(s.temperatures, id)
+		}
+	}
+	webhooks := []Webhook{}
+	for id, w := range s.webhooks {
+		if w.CityID == c.ID {
+			webhooks = append(webhooks, withoutSecrets(w))
+			delete(s.webhooks, id)
+			s.deleteOutbox(id)
+		}
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+	*c = city
+	delete(s.cities, c.ID)
+	delete(s.deletedCities, c.ID)
+	return webhooks, nil
+}
+
+func (s *MemoryStore) RestoreCity(c *City) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.deletedCities[c.ID] {
+		return sql.ErrNoRows
+	}
+	if s.nameTaken(s.cities[c.ID].Name, c.ID) {
+		return ErrCityNameTaken
+	}
+	*c = s.cities[c.ID]
+	delete(s.deletedCities, c.ID)
+	return nil
+}
+
+func (s *MemoryStore) CreateTemperature(t *Temperature) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.cities[t.CityID]; !ok {
+		return errCityNotExist
+	}
+	s.lastTemperatureID++
+	t.ID = s.lastTemperatureID
+	s.temperatures[t.ID] = *t
+	s.addToOutbox(t)
+	return nil
+}
+
+func (s *MemoryStore) CreateTemperatures(temperatures []*Temperature) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, t := range temperatures {
+		if _, ok := s.cities[t.CityID]; !ok {
+			return errCityNotExist
+		}
+	}
+	for _, t := range temperatures {
+		s.lastTemperatureID++
+		t.ID = s.lastTemperatureID
+		s.temperatures[t.ID] = *t
+		s.addToOutbox(t)
+	}
+	return nil
+}
+
+// addToOutbox adds the stored t to the outbox once for every webhook of its
+// city
+func (s *MemoryStore) addToOutbox(t *Temperature) {
+	ids := []int{}
+	for id, w := range s.webhooks {
+		if w.CityID == t.CityID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		s.lastOutboxID++
+		s.outbox[s.lastOutboxID] = &memoryOutboxEntry{id: s.lastOutboxID, webhookID: id, temperatureID: t.ID}
+	}
+}
+
+func (s *MemoryStore) GetTemperatures(cityID int, timestamp int64) ([]Temperature, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	temperatures := []Temperature{}
+	for _, t := range s.temperatures {
+		if t.CityID == cityID && t.Timestamp >= timestamp {
+			temperatures = append(temperatures, t)
+		}
+	}
+	sort.Slice(temperatures, func(i, j int) bool { return temperatures[i].ID < temperatures[j].ID })
+	return temperatures, nil
+}
+
+func (s *MemoryStore) AggregateTemperatures(cityID int, from int64, agg Aggregation) (Forecast, error) {
+	forecast := Forecast{CityID: cityID}
+	if _, err := ParseAggregation(string(agg)); err != nil {
+		return forecast, err
+	}
+	temperatures, err := s.GetTemperatures(cityID, from)
+	if err != nil || len(temperatures) == 0 {
+		return forecast, err
+	}
+	forecast.Sample = len(temperatures)
+	maxes, mins := []float64{}, []float64{}
+	for _, t := range temperatures {
+		maxes = append(maxes, t.Max)
+		mins = append(mins, t.Min)
+	}
+	forecast.Max, forecast.Min = aggregate(maxes, agg), aggregate(mins, agg)
+	return forecast, nil
+}
+
+func (s *MemoryStore) AggregateCityTemperatures(cityIDs []int, from int64, agg Aggregation) (map[int]Forecast, error) {
+	if _, err := ParseAggregation(string(agg)); err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	if cityIDs == nil {
+		for id := range s.cities {
+			cityIDs = append(cityIDs, id)
+		}
+	}
+	found := []int{}
+	for _, id := range cityIDs {
+		if _, ok := s.cities[id]; ok && !s.deletedCities[id] {
+			found = append(found, id)
+		}
+	}
+	s.lock.Unlock()
+	forecasts := map[int]Forecast{}
+	for _, id := range found {
+		forecast, err := s.AggregateTemperatures(id, from, agg)
+		if err != nil {
+			return nil, err
+		}
+		forecasts[id] = forecast
+	}
+	return forecasts, nil
+}
+
+// aggregate summarizes values, which mustn't be empty, with agg
+func aggregate(values []float64, agg Aggregation) float64 {
+	sort.Float64s(values)
+	var sum, squares float64
+	for _, v := range values {
+		sum += v
+		squares += v * v
+	}
+	mean := sum / float64(len(values))
+	if p, ok := agg.percentileRank(); ok {
+		offset, weight := percentileOffset(p, len(values))
+		upper := offset
+		if upper+1 < len(values) {
+			upper++
+		}
+		return interpolate(values[offset], values[upper], weight)
+	}
+	switch agg {
+	case MinOfMins:
+		return values[0]
+	case MaxOfMaxes:
+		return values[len(values)-1]
+	case StdDev:
+		return stdDev(mean, squares/float64(len(values)))
+	}
+	return mean
+}
+
+func (s *MemoryStore) ListRollups(cityID int, bucket, from, to int64) ([]Rollup, error) {
+	if _, err := RollupResolution(bucket); err != nil {
+		return nil, err
+	}
+	from, to = bucketRange(bucket, from, to)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	rows := map[int64]*rollupRow{}
+	starts := []int64{}
+	for _, t := range s.temperatures {
+		start := bucketStart(t.Timestamp, bucket)
+		if t.CityID != cityID || start < from || start >= to {
+			continue
+		}
+		row, ok := rows[start]
+		if !ok {
+			row = &rollupRow{}
+			rows[start] = row
+			starts = append(starts, start)
+		}
+		row.add(rollupRow{readings: 1, sumMax: t.Max, sumMin: t.Min, minMin: t.Min, maxMax: t.Max})
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	rollups := []Rollup{}
+	for _, start := range starts {
+		rollups = append(rollups, rows[start].rollup(start))
+	}
+	return rollups, nil
+}
+
+// temperatureBefore reports whether a was measured before b
+func temperatureBefore(a, b Temperature) bool {
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp < b.Timestamp
+	}
+	return a.ID < b.ID
+}
+
+func (s *MemoryStore) ListTemperatures(q TemperatureQuery) ([]Temperature, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	temperatures := []Temperature{}
+	for _, t := range s.temperatures {
+		if t.CityID != q.CityID || (q.From != 0 && t.Timestamp < q.From) || (q.To != 0 && t.Timestamp >= q.To) {
+			continue
+		}
+		if q.After != nil && !temperatureBefore(*q.After, t) {
+			continue
+		}
+		temperatures = append(temperatures, t)
+	}
+	sort.Slice(temperatures, func(i, j int) bool { return temperatureBefore(temperatures[i], temperatures[j]) })
+	if len(temperatures) > q.Limit {
+		temperatures = temperatures[:q.Limit]
+	}
+	return temperatures, nil
+}
+
+func (s *MemoryStore) CreateWebhook(w *Webhook) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.cities[w.CityID]; !ok {
+		return errCityNotExist
+	}
+	if w.Unit == "" {
+		w.Unit = Celsius
+	}
+	s.lastWebhookID++
+	w.ID = s.lastWebhookID
+	s.webhooks[w.ID] = *w
+	return nil
+}
+
+func (s *MemoryStore) GetWebhooks() ([]Webhook, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	webhooks := []Webhook{}
+	for _, w := range s.webhooks {
+		webhooks = append(webhooks, withoutSecrets(w))
+	}
+	sort.Slice(webhooks, func(i, j int) bool { return webhooks[i].ID < webhooks[j].ID })
+	return webhooks, nil
+}
+
+func (s *MemoryStore) DeleteWebhook(w *Webhook) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	webhook, ok := s.webhooks[w.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	*w = withoutSecrets(webhook)
+	delete(s.webhooks, w.ID)
+	s.deleteOutbox(w.ID)
+	return nil
+}
+
+// withoutSecrets returns w without the secrets, which are only read with the
+// deliveries
+func withoutSecrets(w Webhook) Webhook {
+	w.Secret, w.PreviousSecret, w.PreviousSecretExpiresAt = "", "", 0
+	return w
+}
+
+func (s *MemoryStore) RotateWebhookSecret(w *Webhook, secret string, previousExpiresAt int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	webhook, ok := s.webhooks[w.ID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	webhook.PreviousSecret, webhook.PreviousSecretExpiresAt = webhook.Secret, previousExpiresAt
+	if webhook.Secret == "" {
+		webhook.PreviousSecretExpiresAt = 0
+	}
+	webhook.Secret = secret
+	s.webhooks[w.ID] = webhook
+	*w = webhook
+	w.PreviousSecret = ""
+	return nil
+}
+
+// deleteOutbox removes the deliveries to the webhook webhookID
+func (s *MemoryStore) deleteOutbox(webhookID int) {
+	for id, e := range s.outbox {
+		if e.webhookID == webhookID {
+			delete(s.outbox, id)
+		}
+	}
+}
+
+func (s *MemoryStore) ClaimOutbox(now, until int64, limit int) ([]OutboxEntry, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	claimable := []*memoryOutboxEntry{}
+	for _, e := range s.outbox {
+		if e.claimedUntil < now {
+			claimable = append(claimable, e)
+		}
+	}
+	sort.Slice(claimable, func(i, j int) bool { return claimable[i].id < claimable[j].id })
+	if len(claimable) > limit {
+		claimable = claimable[:limit]
+	}
+	entries := []OutboxEntry{}
+	for _, e := range claimable {
+		e.claimedUntil = until
+		entries = append(entries, OutboxEntry{ID: e.id, Webhook: s.webhooks[e.webhookID], Temperature: s.temperatures[e.temperatureID]})
+	}
+	return entries, nil
+}
+
+func (s *MemoryStore) ExtendOutboxClaim(ids []int, until int64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, id := range ids {
+		if e, ok := s.outbox[id]; ok {
+			e.claimedUntil = until
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) CompleteOutbox(id int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.outbox, id)
+	return nil
+}
+
+func (s *MemoryStore) RecordDelivery(d *Delivery) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastDeliveryID++
+	d.ID = s.lastDeliveryID
+	s.deliveries = append(s.deliveries, *d)
+	return nil
+}
+
+func (s *MemoryStore) ListDeliveries(q DeliveryQuery) ([]Delivery, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	deliveries := []Delivery{}
+	for i := len(s.deliveries) - 1; i >= 0 && len(deliveries) < q.Limit; i-- {
+		d := s.deliveries[i]
+		if d.WebhookID != q.WebhookID || (q.Status != "" && d.Status != q.Status) || (q.StatusCode != 0 && d.StatusCode != q.StatusCode) {
+			continue
+		}
+		if q.Before != 0 && d.ID >= q.Before {
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+func (s *MemoryStore) PruneDeliveries(before int64) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	kept := []Delivery{}
+	for _, d := range s.deliveries {
+		if d.CreatedAt >= before {
+			kept = append(kept, d)
+		}
+	}
+	pruned := int64(len(s.deliveries) - len(kept))
+	s.deliveries = kept
+	return pruned, nil
+}
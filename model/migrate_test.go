@@ -0,0 +1,277 @@
+package model
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMigrationsOrdersByVersion(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/0002_add_index.up.sql":      {Data: []byte("CREATE INDEX i ON t(c);")},
+		"m/0002_add_index.down.sql":    {Data: []byte("DROP INDEX i ON t;")},
+		"m/0001_create_table.up.sql":   {Data: []byte("CREATE TABLE t (c INT);")},
+		"m/0001_create_table.down.sql": {Data: []byte("DROP TABLE t;")},
+		"m/README.md":                  {Data: []byte("ignored")},
+	}
+	migrations, err := LoadMigrations(fsys, "m")
+	assert.Nil(t, err)
+	if assert.Len(t, migrations, 2) {
+		assert.Equal(t, Migration{Version: 1, Name: "create_table", Up: "CREATE TABLE t (c INT);", Down: "DROP TABLE t;"}, migrations[0])
+		assert.Equal(t, 2, migrations[1].Version)
+		assert.Equal(t, "add_index", migrations[1].Name)
+	}
+}
+
+func TestLoadMigrationsMissingUpFile(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/0001_create_table.down.sql": {Data: []byte("DROP TABLE t;")},
+	}
+	_, err := LoadMigrations(fsys, "m")
+	assert.EqualError(t, err, "Migration 1_create_table has no up file")
+}
+
+func TestLoadMigrationsInvalidVersion(t *testing.T) {
+	fsys := fstest.MapFS{
+		"m/first_create_table.up.sql": {Data: []byte("CREATE TABLE t (c INT);")},
+	}
+	_, err := LoadMigrations(fsys, "m")
+	assert.NotNil(t, err)
+}
+
+func TestEmbeddedMigrationsLoad(t *testing.T) {
+	var versions []int
+	for driver, d := range dialects {
+		migrations, err := LoadMigrations(migrationFiles, d.migrations)
+		assert.Nil(t, err)
+		assert.NotEmpty(t, migrations)
+		driverVersions := []int{}
+		for i, migration := range migrations {
+			assert.Equal(t, i+1, migration.Version)
+			assert.NotEmpty(t, migration.Down, "%s migration %d_%s has no down file", driver, migration.Version, migration.Name)
+			driverVersions = append(driverVersions, migration.Version)
+		}
+		if versions == nil {
+			versions = driverVersions
+		}
+		assert.Equal(t, versions, driverVersions, "%s migrations differ from the other drivers", driver)
+	}
+}
+
+func TestMigratorSQLiteUpAndDown(t *testing.T) {
+	db, err := Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a database", err)
+	}
+	defer db.Close()
+	m, err := NewMigrator(db, "sqlite")
+	assert.Nil(t, err)
+	applied, err := m.Up()
+	assert.Nil(t, err)
+	assert.Equal(t, len(m.migrations), len(applied))
+	applied, err = m.Up()
+	assert.Nil(t, err)
+	assert.Empty(t, applied)
+
+	statuses, err := m.Status()
+	assert.Nil(t, err)
+	for _, status := range statuses {
+		assert.True(t, status.Applied)
+		assert.False(t, status.AppliedAt.IsZero())
+	}
+
+	reverted, err := m.Down(len(m.migrations))
+	assert.Nil(t, err)
+	assert.Equal(t, len(m.migrations), len(reverted))
+	var count int
+	assert.Nil(t, db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name='cities'").Scan(&count))
+	assert.Equal(t, 0, count)
+}
+
+func TestRollupMigrationBackfillsReadings(t *testing.T) {
+	db, err := Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a database", err)
+	}
+	defer db.Close()
+	m, err := NewMigrator(db, "sqlite")
+	assert.Nil(t, err)
+	_, err = m.Up()
+	assert.Nil(t, err)
+	// revert migrations down to the one creating the rollup table
+	for reverted := []Migration{}; len(reverted) == 0 || reverted[0].Name != "create_temperature_rollups"; {
+		reverted, err = m.Down(1)
+		if err != nil || len(reverted) == 0 {
+			t.Fatalf("the rollup migration could not be reverted: %v", err)
+		}
+	}
+	// readings stored before the rollup table existed
+	_, err = db.Exec("INSERT INTO cities(name, latitude, longitude) VALUES('Berlin', 52.52, 13.405)")
+	assert.Nil(t, err)
+	for _, max := range []int{20, 30} {
+		_, err = db.Exec("INSERT INTO temperatures(city_id, max, min, timestamp, received_at) VALUES(1, ?, 10, datetime(1580000000, 'unixepoch'), datetime(1580000000, 'unixepoch'))", max)
+		assert.Nil(t, err)
+	}
+	_, err = m.Up()
+	assert.Nil(t, err)
+	rollups, err := NewSQLiteStore(db).ListRollups(1, 3600, 1579996800, 1580000400)
+	assert.Nil(t, err)
+	assert.Equal(t, []Rollup{{Start: 1579996800, Count: 2, Min: 10, Max: 30, AvgMax: 25, AvgMin: 10}}, rollups)
+}
+
+func TestLiveCityNamesMigrationKeepsCities(t *testing.T) {
+	db, err := Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a database", err)
+	}
+	defer db.Close()
+	m, err := NewMigrator(db, "sqlite")
+	assert.Nil(t, err)
+	_, err = m.Up()
+	assert.Nil(t, err)
+	for reverted := []Migration{}; len(reverted) == 0 || reverted[0].Name != "unique_live_city_names"; {
+		reverted, err = m.Down(1)
+		if err != nil || len(reverted) == 0 {
+			t.Fatalf("the live city names migration could not be reverted: %v", err)
+		}
+	}
+	// a deleted city, one removed with its id, and one with a reading
+	for _, name := range []string{"Berlin", "Hamburg", "Munich"} {
+		_, err = db.Exec("INSERT INTO cities(name, latitude, longitude) VALUES(?, 50, 10)", name)
+		assert.Nil(t, err)
+	}
+	_, err = db.Exec("UPDATE cities SET deleted_at=CURRENT_TIMESTAMP WHERE id=1")
+	assert.Nil(t, err)
+	_, err = db.Exec("DELETE FROM cities WHERE id=3")
+	assert.Nil(t, err)
+	_, err = db.Exec("INSERT INTO temperatures(city_id, max, min, timestamp, received_at) VALUES(2, 20, 10, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP)")
+	assert.Nil(t, err)
+	_, err = m.Up()
+	assert.Nil(t, err)
+
+	s := NewSQLiteStore(db)
+	temperatures, err := s.GetTemperatures(2, 0)
+	assert.Nil(t, err)
+	assert.Len(t, temperatures, 1)
+	city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+	assert.Nil(t, s.CreateCity(city))
+	// ids of removed cities aren't reused
+	assert.Equal(t, 4, city.ID)
+	assert.NotNil(t, s.CreateTemperature(&Temperature{CityID: 1000, Max: 20, Min: 10}))
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := `-- create the table
+CREATE TABLE t
+(
+    c INT
+);
+
+INSERT INTO t VALUES (1);
+DROP TABLE t`
+	statements := splitStatements(script)
+	assert.Equal(t, []string{"CREATE TABLE t\n(\n    c INT\n)", "INSERT INTO t VALUES (1)", "DROP TABLE t"}, statements)
+}
+
+func TestMigratorUpAppliesPendingOnly(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	m := &Migrator{db: db, dialect: mysqlDialect, migrations: []Migration{
+		{Version: 1, Name: "create_table", Up: "CREATE TABLE t (c INT);"},
+		{Version: 2, Name: "add_column", Up: "ALTER TABLE t ADD d INT;"},
+	}}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT GET_LOCK(")).WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(1))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE t ADD d INT")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").WithArgs(2, "add_column").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta("SELECT RELEASE_LOCK(")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	applied, err := m.Up()
+	assert.Nil(t, err)
+	if assert.Len(t, applied, 1) {
+		assert.Equal(t, 2, applied[0].Version)
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMigratorUpRollsBackFailedMigration(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	m := &Migrator{db: db, dialect: mysqlDialect, migrations: []Migration{
+		{Version: 1, Name: "create_table", Up: "CREATE TABLE t (c INT);"},
+	}}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT GET_LOCK(")).WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(1))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}))
+	mock.ExpectBegin()
+	mock.ExpectExec("CREATE TABLE t").WillReturnError(errors.New("test error"))
+	mock.ExpectRollback()
+	mock.ExpectExec(regexp.QuoteMeta("SELECT RELEASE_LOCK(")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	applied, err := m.Up()
+	assert.Empty(t, applied)
+	assert.EqualError(t, err, "Migration 1_create_table failed: test error")
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMigratorDownRevertsLatest(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	m := &Migrator{db: db, dialect: mysqlDialect, migrations: []Migration{
+		{Version: 1, Name: "create_table", Up: "CREATE TABLE t (c INT);", Down: "DROP TABLE t;"},
+		{Version: 2, Name: "add_column", Up: "ALTER TABLE t ADD d INT;", Down: "ALTER TABLE t DROP d;"},
+	}}
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT GET_LOCK(")).WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(1))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery("SELECT version, applied_at FROM schema_migrations").
+		WillReturnRows(sqlmock.NewRows([]string{"version", "applied_at"}).AddRow(1, time.Now()).AddRow(2, time.Now()))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE t DROP d")).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM schema_migrations").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(regexp.QuoteMeta("SELECT RELEASE_LOCK(")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	reverted, err := m.Down(1)
+	assert.Nil(t, err)
+	if assert.Len(t, reverted, 1) {
+		assert.Equal(t, 2, reverted[0].Version)
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMigratorUpWithoutLock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	m := &Migrator{db: db, dialect: mysqlDialect, migrations: []Migration{
+		{Version: 1, Name: "create_table", Up: "CREATE TABLE t (c INT);"},
+	}}
+	// GET_LOCK returns NULL when it fails, nothing is migrated then
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT GET_LOCK(")).WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(nil))
+
+	applied, err := m.Up()
+	assert.Empty(t, applied)
+	assert.Equal(t, errMigrationLock, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
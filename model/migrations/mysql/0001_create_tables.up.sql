@@ -1,5 +1,3 @@
-Use test_db;
-
 CREATE TABLE IF NOT EXISTS cities
 (
     id INT AUTO_INCREMENT PRIMARY KEY,
@@ -7,6 +5,7 @@ CREATE TABLE IF NOT EXISTS cities
     latitude FLOAT NOT NULL,
     longitude FLOAT NOT NULL
 );
+
 CREATE TABLE IF NOT EXISTS temperatures
 (
     id INT AUTO_INCREMENT PRIMARY KEY,
@@ -23,4 +22,4 @@ CREATE TABLE IF NOT EXISTS webhooks
     city_id INT NOT NULL,
     callback_url TEXT NOT NULL,
     FOREIGN KEY (city_id) REFERENCES cities(id)
-);
\ No newline at end of file
+);
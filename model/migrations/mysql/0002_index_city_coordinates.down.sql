@@ -0,0 +1 @@
+DROP INDEX cities_latitude_longitude ON cities;
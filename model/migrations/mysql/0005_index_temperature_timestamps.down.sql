@@ -0,0 +1 @@
+DROP INDEX temperatures_city_id_timestamp ON temperatures;
@@ -0,0 +1 @@
+CREATE INDEX temperatures_city_id_timestamp ON temperatures(city_id, timestamp);
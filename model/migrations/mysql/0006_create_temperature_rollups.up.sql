@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS temperature_rollups
+(
+    city_id INT NOT NULL,
+    resolution INT NOT NULL,
+    bucket_start BIGINT NOT NULL,
+    readings INT NOT NULL,
+    sum_max BIGINT NOT NULL,
+    sum_min BIGINT NOT NULL,
+    min_min INT NOT NULL,
+    max_max INT NOT NULL,
+    PRIMARY KEY (city_id, resolution, bucket_start),
+    FOREIGN KEY (city_id) REFERENCES cities(id)
+);
+
+INSERT INTO temperature_rollups(city_id, resolution, bucket_start, readings, sum_max, sum_min, min_min, max_max)
+SELECT city_id, 3600, UNIX_TIMESTAMP(timestamp) - UNIX_TIMESTAMP(timestamp) % 3600, COUNT(*), SUM(max), SUM(min), MIN(min), MAX(max)
+FROM temperatures GROUP BY 1, 3;
+
+INSERT INTO temperature_rollups(city_id, resolution, bucket_start, readings, sum_max, sum_min, min_min, max_max)
+SELECT city_id, 86400, UNIX_TIMESTAMP(timestamp) - UNIX_TIMESTAMP(timestamp) % 86400, COUNT(*), SUM(max), SUM(min), MIN(min), MAX(max)
+FROM temperatures GROUP BY 1, 3;
@@ -0,0 +1,5 @@
+ALTER TABLE webhooks DROP COLUMN unit;
+
+ALTER TABLE temperature_rollups MODIFY sum_max BIGINT NOT NULL, MODIFY sum_min BIGINT NOT NULL, MODIFY min_min INT NOT NULL, MODIFY max_max INT NOT NULL;
+
+ALTER TABLE temperatures MODIFY max INT NOT NULL, MODIFY min INT NOT NULL;
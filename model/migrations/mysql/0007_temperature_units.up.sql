@@ -0,0 +1,5 @@
+ALTER TABLE temperatures MODIFY max DOUBLE NOT NULL, MODIFY min DOUBLE NOT NULL;
+
+ALTER TABLE temperature_rollups MODIFY sum_max DOUBLE NOT NULL, MODIFY sum_min DOUBLE NOT NULL, MODIFY min_min DOUBLE NOT NULL, MODIFY max_max DOUBLE NOT NULL;
+
+ALTER TABLE webhooks ADD COLUMN unit CHAR(1) NOT NULL DEFAULT 'C';
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS webhook_outbox
+(
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    webhook_id INT NOT NULL,
+    temperature_id INT NOT NULL,
+    claimed_until BIGINT NOT NULL DEFAULT 0,
+    FOREIGN KEY (webhook_id) REFERENCES webhooks(id),
+    FOREIGN KEY (temperature_id) REFERENCES temperatures(id)
+);
+
+CREATE INDEX webhook_outbox_claimed_until ON webhook_outbox(claimed_until, id);
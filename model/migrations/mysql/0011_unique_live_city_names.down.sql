@@ -0,0 +1,7 @@
+ALTER TABLE cities ADD UNIQUE INDEX name (name);
+
+DROP INDEX cities_name ON cities;
+
+DROP INDEX cities_live_name ON cities;
+
+ALTER TABLE cities DROP COLUMN live_name;
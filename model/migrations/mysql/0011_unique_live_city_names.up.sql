@@ -0,0 +1,9 @@
+-- MySQL has no partial indexes. live_name is NULL for deleted cities, which
+-- a unique index doesn't compare, so only live cities need distinct names.
+ALTER TABLE cities ADD COLUMN live_name VARCHAR(50) AS (CASE WHEN deleted_at IS NULL THEN name END) STORED;
+
+CREATE UNIQUE INDEX cities_live_name ON cities(live_name);
+
+CREATE INDEX cities_name ON cities(name);
+
+ALTER TABLE cities DROP INDEX name;
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS webhooks;
+DROP TABLE IF EXISTS temperatures;
+DROP TABLE IF EXISTS cities;
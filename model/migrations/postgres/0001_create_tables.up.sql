@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS cities
+(
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) NOT NULL UNIQUE,
+    latitude REAL NOT NULL,
+    longitude REAL NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS temperatures
+(
+    id SERIAL PRIMARY KEY,
+    city_id INT NOT NULL REFERENCES cities(id),
+    max INT NOT NULL,
+    min INT NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhooks
+(
+    id SERIAL PRIMARY KEY,
+    city_id INT NOT NULL REFERENCES cities(id),
+    callback_url TEXT NOT NULL
+);
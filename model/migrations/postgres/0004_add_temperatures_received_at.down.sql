@@ -0,0 +1 @@
+ALTER TABLE temperatures DROP COLUMN received_at;
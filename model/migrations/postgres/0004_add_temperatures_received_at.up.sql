@@ -0,0 +1,3 @@
+ALTER TABLE temperatures ADD COLUMN received_at TIMESTAMPTZ NULL DEFAULT NULL;
+
+UPDATE temperatures SET received_at = timestamp;
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS temperatures_city_id_timestamp;
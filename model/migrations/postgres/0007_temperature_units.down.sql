@@ -0,0 +1,5 @@
+ALTER TABLE webhooks DROP COLUMN unit;
+
+ALTER TABLE temperature_rollups ALTER COLUMN sum_max TYPE BIGINT USING ROUND(sum_max), ALTER COLUMN sum_min TYPE BIGINT USING ROUND(sum_min), ALTER COLUMN min_min TYPE INT USING ROUND(min_min), ALTER COLUMN max_max TYPE INT USING ROUND(max_max);
+
+ALTER TABLE temperatures ALTER COLUMN max TYPE INT USING ROUND(max), ALTER COLUMN min TYPE INT USING ROUND(min);
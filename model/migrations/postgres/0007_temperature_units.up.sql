@@ -0,0 +1,5 @@
+ALTER TABLE temperatures ALTER COLUMN max TYPE DOUBLE PRECISION, ALTER COLUMN min TYPE DOUBLE PRECISION;
+
+ALTER TABLE temperature_rollups ALTER COLUMN sum_max TYPE DOUBLE PRECISION, ALTER COLUMN sum_min TYPE DOUBLE PRECISION, ALTER COLUMN min_min TYPE DOUBLE PRECISION, ALTER COLUMN max_max TYPE DOUBLE PRECISION;
+
+ALTER TABLE webhooks ADD COLUMN unit CHAR(1) NOT NULL DEFAULT 'C';
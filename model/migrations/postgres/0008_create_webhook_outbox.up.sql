@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS webhook_outbox
+(
+    id SERIAL PRIMARY KEY,
+    webhook_id INT NOT NULL REFERENCES webhooks(id),
+    temperature_id INT NOT NULL REFERENCES temperatures(id),
+    claimed_until BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX webhook_outbox_claimed_until ON webhook_outbox(claimed_until, id);
@@ -0,0 +1 @@
+ALTER TABLE webhooks DROP COLUMN previous_secret_expires_at, DROP COLUMN previous_secret, DROP COLUMN secret;
@@ -0,0 +1 @@
+ALTER TABLE webhooks ADD COLUMN secret VARCHAR(64) NOT NULL DEFAULT '', ADD COLUMN previous_secret VARCHAR(64) NOT NULL DEFAULT '', ADD COLUMN previous_secret_expires_at BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,3 @@
+DROP INDEX cities_live_name;
+
+ALTER TABLE cities ADD CONSTRAINT cities_name_key UNIQUE (name);
@@ -0,0 +1,3 @@
+ALTER TABLE cities DROP CONSTRAINT cities_name_key;
+
+CREATE UNIQUE INDEX cities_live_name ON cities(name) WHERE deleted_at IS NULL;
@@ -0,0 +1,25 @@
+CREATE TABLE IF NOT EXISTS cities
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(50) NOT NULL UNIQUE,
+    latitude REAL NOT NULL,
+    longitude REAL NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS temperatures
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    city_id INTEGER NOT NULL,
+    max INTEGER NOT NULL,
+    min INTEGER NOT NULL,
+    timestamp TIMESTAMP NOT NULL,
+    FOREIGN KEY (city_id) REFERENCES cities(id)
+);
+
+CREATE TABLE IF NOT EXISTS webhooks
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    city_id INTEGER NOT NULL,
+    callback_url TEXT NOT NULL,
+    FOREIGN KEY (city_id) REFERENCES cities(id)
+);
@@ -0,0 +1 @@
+DROP INDEX IF EXISTS cities_latitude_longitude;
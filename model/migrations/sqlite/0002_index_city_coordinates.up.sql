@@ -0,0 +1 @@
+CREATE INDEX cities_latitude_longitude ON cities(latitude, longitude);
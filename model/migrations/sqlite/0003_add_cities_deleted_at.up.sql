@@ -0,0 +1 @@
+ALTER TABLE cities ADD COLUMN deleted_at TIMESTAMP NULL DEFAULT NULL;
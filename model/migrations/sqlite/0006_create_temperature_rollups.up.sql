@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS temperature_rollups
+(
+    city_id INTEGER NOT NULL,
+    resolution INTEGER NOT NULL,
+    bucket_start INTEGER NOT NULL,
+    readings INTEGER NOT NULL,
+    sum_max INTEGER NOT NULL,
+    sum_min INTEGER NOT NULL,
+    min_min INTEGER NOT NULL,
+    max_max INTEGER NOT NULL,
+    PRIMARY KEY (city_id, resolution, bucket_start),
+    FOREIGN KEY (city_id) REFERENCES cities(id)
+);
+
+INSERT INTO temperature_rollups(city_id, resolution, bucket_start, readings, sum_max, sum_min, min_min, max_max)
+SELECT city_id, 3600, CAST(strftime('%s', timestamp) AS INTEGER) - CAST(strftime('%s', timestamp) AS INTEGER) % 3600, COUNT(*), SUM(max), SUM(min), MIN(min), MAX(max)
+FROM temperatures GROUP BY 1, 3;
+
+INSERT INTO temperature_rollups(city_id, resolution, bucket_start, readings, sum_max, sum_min, min_min, max_max)
+SELECT city_id, 86400, CAST(strftime('%s', timestamp) AS INTEGER) - CAST(strftime('%s', timestamp) AS INTEGER) % 86400, COUNT(*), SUM(max), SUM(min), MIN(min), MAX(max)
+FROM temperatures GROUP BY 1, 3;
@@ -0,0 +1,3 @@
+-- INTEGER columns keep the decimals of REAL values in SQLite, the
+-- temperature columns are left as they are
+ALTER TABLE webhooks ADD COLUMN unit CHAR(1) NOT NULL DEFAULT 'C';
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS webhook_outbox
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    webhook_id INTEGER NOT NULL,
+    temperature_id INTEGER NOT NULL,
+    claimed_until INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY (webhook_id) REFERENCES webhooks(id),
+    FOREIGN KEY (temperature_id) REFERENCES temperatures(id)
+);
+
+CREATE INDEX webhook_outbox_claimed_until ON webhook_outbox(claimed_until, id);
@@ -0,0 +1,3 @@
+ALTER TABLE webhooks ADD COLUMN secret VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE webhooks ADD COLUMN previous_secret VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE webhooks ADD COLUMN previous_secret_expires_at INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,19 @@
+-- the log outlives the webhooks and readings it mentions until it is pruned,
+-- so it has no foreign keys
+CREATE TABLE IF NOT EXISTS webhook_deliveries
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    webhook_id INTEGER NOT NULL,
+    temperature_id INTEGER NOT NULL,
+    attempt INTEGER NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    status_code INTEGER NOT NULL,
+    latency_ms INTEGER NOT NULL,
+    response TEXT NOT NULL,
+    error TEXT NOT NULL,
+    created_at INTEGER NOT NULL
+);
+
+CREATE INDEX webhook_deliveries_webhook ON webhook_deliveries(webhook_id, id);
+
+CREATE INDEX webhook_deliveries_created_at ON webhook_deliveries(created_at);
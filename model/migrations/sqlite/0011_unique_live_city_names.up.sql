@@ -0,0 +1,33 @@
+-- The UNIQUE constraint of cities.name can only be dropped by rebuilding the
+-- table. Foreign keys are checked on commit, once the rows the other tables
+-- refer to are back, and the id sequence is kept so ids aren't reused.
+PRAGMA defer_foreign_keys = ON;
+
+CREATE TABLE cities_copy AS SELECT id, name, latitude, longitude, deleted_at FROM cities;
+
+CREATE TABLE cities_sequence AS SELECT seq FROM sqlite_sequence WHERE name = 'cities';
+
+DROP TABLE cities;
+
+CREATE TABLE cities
+(
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(50) NOT NULL,
+    latitude REAL NOT NULL,
+    longitude REAL NOT NULL,
+    deleted_at TIMESTAMP NULL DEFAULT NULL
+);
+
+INSERT INTO cities(id, name, latitude, longitude, deleted_at) SELECT id, name, latitude, longitude, deleted_at FROM cities_copy;
+
+DELETE FROM sqlite_sequence WHERE name = 'cities';
+
+INSERT INTO sqlite_sequence(name, seq) SELECT 'cities', seq FROM cities_sequence;
+
+DROP TABLE cities_copy;
+
+DROP TABLE cities_sequence;
+
+CREATE INDEX cities_latitude_longitude ON cities(latitude, longitude);
+
+CREATE UNIQUE INDEX cities_live_name ON cities(name) WHERE deleted_at IS NULL;
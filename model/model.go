@@ -2,8 +2,13 @@ package model
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"strings"
+
+	_ "modernc.org/sqlite"
 )
 
 type Conn struct {
@@ -22,146 +27,158 @@ type City struct {
 }
 
 type Temperature struct {
-	ID        int   `json:"id"`
-	CityID    int   `json:"city_id"`
-	Max       int   `json:"max"`
-	Min       int   `json:"min"`
-	Timestamp int64 `json:"timestamp"`
+	ID     int     `json:"id"`
+	CityID int     `json:"city_id"`
+	Max    float64 `json:"max"`
+	Min    float64 `json:"min"`
+	// Unit is the unit of Max and Min. Stored readings are in Celsius.
+	Unit Unit `json:"unit,omitempty"`
+	// Timestamp is when the reading was measured, ReceivedAt when it was
+	// ingested
+	Timestamp  int64 `json:"timestamp"`
+	ReceivedAt int64 `json:"received_at"`
 }
 
 type Forecast struct {
 	CityID int     `json:"city_id"`
-	Max    float32 `json:"max"`
-	Min    float32 `json:"min"`
-	Sample int     `json:"sample"`
+	Max    float64 `json:"max"`
+	Min    float64 `json:"min"`
+	// Unit is the unit of Max and Min. Stored readings are summarized in
+	// Celsius.
+	Unit   Unit `json:"unit,omitempty"`
+	Sample int  `json:"sample"`
+	// Window and Aggregation describe how the readings were summarized
+	Window      string      `json:"window,omitempty"`
+	Aggregation Aggregation `json:"agg,omitempty"`
+}
+
+// MarshalJSON leaves Max and Min null when there are no readings to
+// summarize
+func (f Forecast) MarshalJSON() ([]byte, error) {
+	type forecast Forecast
+	if f.Sample > 0 {
+		return json.Marshal(forecast(f))
+	}
+	return json.Marshal(struct {
+		forecast
+		Max *float64 `json:"max"`
+		Min *float64 `json:"min"`
+	}{forecast: forecast(f)})
 }
 
 type Webhook struct {
 	ID          int    `json:"id"`
 	CityID      int    `json:"city_id"`
 	CallbackURL string `json:"callback_url"`
-}
-
-func NewConn(protocol, host, port, user, password, dbname string) (*sql.DB, error) {
-	connectionString := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4,utf8&parseTime=True&loc=Local", user, password, host, port, dbname)
-
-	db, err := sql.Open(protocol, connectionString)
-	if err != nil {
-		return nil, err
+	// Unit is the unit of the temperatures delivered to the webhook
+	Unit Unit `json:"unit"`
+	// Secret signs the deliveries to the webhook. It is only returned when
+	// the webhook is created and when the secret is rotated.
+	Secret string `json:"secret,omitempty"`
+	// PreviousSecret is the secret replaced by the last rotation. Deliveries
+	// are signed with it too until the unix time PreviousSecretExpiresAt.
+	PreviousSecret          string `json:"-"`
+	PreviousSecretExpiresAt int64  `json:"previous_secret_expires_at,omitempty"`
+}
+
+// Secrets returns the secrets the deliveries to the webhook are signed with
+// at the unix time now
+func (w Webhook) Secrets(now int64) []string {
+	secrets := []string{}
+	if w.Secret != "" {
+		secrets = append(secrets, w.Secret)
 	}
-	return db, nil
-}
-
-func (c *City) Create(db *sql.DB) error {
-	sql := fmt.Sprintf("INSERT INTO cities(name, latitude, longitude) VALUES('%s', %f, %f)", c.Name, c.Latitude, c.Longitude)
-	res, err := db.Exec(sql)
-	if err != nil {
-		return err
+	if w.PreviousSecret != "" && now < w.PreviousSecretExpiresAt {
+		secrets = append(secrets, w.PreviousSecret)
 	}
-	id, err := res.LastInsertId()
-	if err != nil {
-		return err
-	}
-	c.ID = int(id)
-	return nil
+	return secrets
 }
 
-func (c *City) get(db *sql.DB) error {
-	sql := fmt.Sprintf("SELECT name, latitude, longitude FROM cities WHERE id=%d", c.ID)
-	return db.QueryRow(sql).Scan(&c.Name, &c.Latitude, &c.Longitude)
-}
+// DeliveryStatus tells whether a delivery attempt succeeded
+type DeliveryStatus string
 
-func (c *City) Update(db *sql.DB) error {
-	sql := fmt.Sprintf("UPDATE cities SET name='%s', latitude=%f, longitude=%f WHERE id=%d", c.Name, c.Latitude, c.Longitude, c.ID)
-	_, err := db.Exec(sql)
-	return err
+const (
+	DeliverySucceeded DeliveryStatus = "succeeded"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+// Delivery is an attempt to deliver a reading to a webhook
+type Delivery struct {
+	ID            int            `json:"id"`
+	WebhookID     int            `json:"webhook_id"`
+	TemperatureID int            `json:"temperature_id"`
+	Attempt       int            `json:"attempt"`
+	Status        DeliveryStatus `json:"status"`
+	// StatusCode is the status of the response, zero when there was none
+	StatusCode int `json:"status_code"`
+	// Latency is how long the attempt took in milliseconds
+	Latency int64 `json:"latency_ms"`
+	// Response is the start of the response body
+	Response string `json:"response"`
+	// Error is why the attempt failed
+	Error string `json:"error,omitempty"`
+	// CreatedAt is the unix time the attempt was made at
+	CreatedAt int64 `json:"created_at"`
+}
+
+// OutboxEntry is a reading pending delivery to a webhook
+type OutboxEntry struct {
+	ID          int
+	Webhook     Webhook
+	Temperature Temperature
+}
+
+// MySQLDSN builds the data source name of a MySQL database. Updates report
+// matched rather than changed rows so that a missing row can be detected.
+func MySQLDSN(host, port, user, password, dbname string) string {
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4,utf8&parseTime=True&loc=Local&clientFoundRows=true", user, password, host, port, dbname)
 }
 
-func (c *City) Delete(db *sql.DB) error {
-	err := c.get(db)
-	if err != nil {
-		return err
-	}
-	sql := fmt.Sprintf("DELETE FROM cities WHERE id=%d", c.ID)
-	_, err = db.Exec(sql)
-	return err
+func NewConn(protocol, host, port, user, password, dbname string) (*sql.DB, error) {
+	return Open(protocol, MySQLDSN(host, port, user, password, dbname))
 }
 
-func (t *Temperature) Create(db *sql.DB) error {
-	sql := fmt.Sprintf("INSERT INTO temperatures(city_id, max, min, timestamp) VALUES('%d', %d, %d, FROM_UNIXTIME(%d))", t.CityID, t.Max, t.Min, t.Timestamp)
-	res, err := db.Exec(sql)
+// withMySQLOptions sets the options the store relies on in a MySQL dsn:
+// timestamps are scanned into time.Time, and an update changing nothing still
+// counts the rows it matched
+func withMySQLOptions(dsn string) (string, error) {
+	config, err := mysql.ParseDSN(dsn)
 	if err != nil {
-		return err
+		return "", err
 	}
-	id, err := res.LastInsertId()
-	if err != nil {
-		return err
-	}
-	t.ID = int(id)
-	return nil
+	config.ParseTime = true
+	config.ClientFoundRows = true
+	return config.FormatDSN(), nil
 }
 
-func GetTemperatures(db *sql.DB, CityID int, timestamp int64) ([]Temperature, error) {
-	sql := fmt.Sprintf("SELECT id, city_id, max, min FROM temperatures WHERE city_id = %d AND timestamp >= FROM_UNIXTIME(%d)", CityID, timestamp)
-	rows, err := db.Query(sql)
-	if err != nil {
+// Open opens the database at dsn with driver, which is one of "mysql",
+// "sqlite" or "postgres"
+func Open(driver, dsn string) (*sql.DB, error) {
+	if _, err := dialectFor(driver); err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	temperatures := []Temperature{}
-	for rows.Next() {
-		var t Temperature
-		if err := rows.Scan(&t.ID, &t.CityID, &t.Max, &t.Min); err != nil {
+	switch driver {
+	case mysqlDialect.driver:
+		var err error
+		if dsn, err = withMySQLOptions(dsn); err != nil {
 			return nil, err
 		}
-		temperatures = append(temperatures, t)
-	}
-	return temperatures, nil
-}
-
-func (w *Webhook) Create(db *sql.DB) error {
-	sql := fmt.Sprintf("INSERT INTO webhooks(city_id, callback_url) VALUES(%d, '%s')", w.CityID, w.CallbackURL)
-	res, err := db.Exec(sql)
-	if err != nil {
-		return err
+	case sqliteDialect.driver:
+		// SQLite only enforces foreign keys when asked to on every connection
+		if strings.Contains(dsn, "?") {
+			dsn += "&_pragma=foreign_keys(1)"
+		} else {
+			dsn += "?_pragma=foreign_keys(1)"
+		}
 	}
-	id, err := res.LastInsertId()
-	if err != nil {
-		return err
-	}
-	w.ID = int(id)
-	return nil
-}
-
-func GetWebhooks(db *sql.DB) ([]Webhook, error) {
-	sql := "SELECT * FROM webhooks"
-	rows, err := db.Query(sql)
+	db, err := sql.Open(driver, dsn)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	webhooks := []Webhook{}
-	for rows.Next() {
-		var w Webhook
-		if err := rows.Scan(&w.ID, &w.CityID, &w.CallbackURL); err != nil {
-			return nil, err
-		}
-		webhooks = append(webhooks, w)
-	}
-	return webhooks, nil
-}
-
-func (w *Webhook) get(db *sql.DB) error {
-	sql := fmt.Sprintf("SELECT id, city_id, callback_url FROM webhooks WHERE id=%d", w.ID)
-	return db.QueryRow(sql).Scan(&w.ID, &w.CityID, &w.CallbackURL)
-}
-
-func (w *Webhook) Delete(db *sql.DB) error {
-	err := w.get(db)
-	if err != nil {
-		return err
+	if driver == sqliteDialect.driver {
+		// SQLite allows a single writer, and every connection to ":memory:"
+		// is a separate database
+		db.SetMaxOpenConns(1)
 	}
-	sql := fmt.Sprintf("DELETE FROM webhooks WHERE id=%d", w.ID)
-	_, err = db.Exec(sql)
-	return err
+	return db, nil
 }
@@ -0,0 +1,117 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+)
+
+// rollupResolutions are the bucket sizes in seconds the readings are rolled
+// up at as they are stored, largest first. Other bucket sizes are grouped
+// from the largest resolution dividing them.
+var rollupResolutions = []int64{24 * 3600, 3600}
+
+// Rollup summarizes the readings of a city measured in [Start, Start+bucket)
+type Rollup struct {
+	Start int64 `json:"start"`
+	Count int   `json:"count"`
+	// Min is the lowest min and Max the highest max of the readings
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	AvgMax float64 `json:"avg_max"`
+	AvgMin float64 `json:"avg_min"`
+}
+
+// RollupResolution returns the stored resolution buckets of bucket seconds
+// are grouped from
+func RollupResolution(bucket int64) (int64, error) {
+	for _, resolution := range rollupResolutions {
+		if bucket > 0 && bucket%resolution == 0 {
+			return resolution, nil
+		}
+	}
+	return 0, fmt.Errorf("Bucket must be a multiple of %ds", rollupResolutions[len(rollupResolutions)-1])
+}
+
+// bucketStart returns the start of the bucket of bucket seconds timestamp
+// falls in. Buckets are aligned to the unix epoch.
+func bucketStart(timestamp, bucket int64) int64 {
+	start := timestamp - timestamp%bucket
+	if start > timestamp {
+		start -= bucket
+	}
+	return start
+}
+
+// bucketRange widens [from, to) to whole buckets of bucket seconds
+func bucketRange(bucket, from, to int64) (int64, int64) {
+	return bucketStart(from, bucket), bucketStart(to-1, bucket) + bucket
+}
+
+// rollupKey identifies a row of the rollup table
+type rollupKey struct {
+	cityID     int
+	resolution int64
+	start      int64
+}
+
+// rollupRow holds the running totals of a rollup
+type rollupRow struct {
+	readings int
+	sumMax   float64
+	sumMin   float64
+	minMin   float64
+	maxMax   float64
+}
+
+func (r *rollupRow) add(other rollupRow) {
+	if r.readings == 0 || other.minMin < r.minMin {
+		r.minMin = other.minMin
+	}
+	if r.readings == 0 || other.maxMax > r.maxMax {
+		r.maxMax = other.maxMax
+	}
+	r.readings += other.readings
+	r.sumMax += other.sumMax
+	r.sumMin += other.sumMin
+}
+
+func (r rollupRow) rollup(start int64) Rollup {
+	return Rollup{
+		Start:  start,
+		Count:  r.readings,
+		Min:    r.minMin,
+		Max:    r.maxMax,
+		AvgMax: r.sumMax / float64(r.readings),
+		AvgMin: r.sumMin / float64(r.readings),
+	}
+}
+
+// rollupTemperatures sums temperatures up into the rollup rows of every
+// resolution, ordered by key
+func rollupTemperatures(temperatures []*Temperature) ([]rollupKey, map[rollupKey]*rollupRow) {
+	rows := map[rollupKey]*rollupRow{}
+	keys := []rollupKey{}
+	for _, t := range temperatures {
+		for _, resolution := range rollupResolutions {
+			key := rollupKey{cityID: t.CityID, resolution: resolution, start: bucketStart(t.Timestamp, resolution)}
+			row, ok := rows[key]
+			if !ok {
+				row = &rollupRow{}
+				rows[key] = row
+				keys = append(keys, key)
+			}
+			row.add(rollupRow{readings: 1, sumMax: t.Max, sumMin: t.Min, minMin: t.Min, maxMax: t.Max})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.cityID != b.cityID {
+			return a.cityID < b.cityID
+		}
+		if a.resolution != b.resolution {
+			return a.resolution < b.resolution
+		}
+		return a.start < b.start
+	})
+	return keys, rows
+}
@@ -0,0 +1,980 @@
+package model
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// dialect holds what differs between the SQL databases SQLStore supports
+type dialect struct {
+	driver string
+	// migrations is the directory of the embedded migrations for the database
+	migrations string
+	// fromUnix converts a placeholder holding a unix timestamp to a timestamp
+	fromUnix string
+	// toUnix converts the timestamp column %s to a unix timestamp
+	toUnix string
+	// numbered is set when placeholders are written $1, $2... instead of ?
+	numbered bool
+	// returning is set when inserted ids are read with RETURNING id
+	// instead of LastInsertId
+	returning bool
+	// onDuplicateKey is set when upserts are written ON DUPLICATE KEY UPDATE
+	// instead of ON CONFLICT
+	onDuplicateKey bool
+	// excluded refers to the column %s of the row an upsert failed to insert
+	excluded string
+	// least and greatest return the smallest and the largest of their arguments
+	least    string
+	greatest string
+	// lockMigrations takes the advisory lock serializing migrations, selecting
+	// 1 once it is held, and unlockMigrations releases it. Both are empty when
+	// the database has no advisory locks.
+	lockMigrations   string
+	unlockMigrations string
+}
+
+var (
+	mysqlDialect = &dialect{
+		driver:         "mysql",
+		migrations:     "migrations/mysql",
+		fromUnix:       "FROM_UNIXTIME(?)",
+		toUnix:         "UNIX_TIMESTAMP(%s)",
+		onDuplicateKey: true,
+		excluded:       "VALUES(%s)",
+		least:          "LEAST",
+		greatest:       "GREATEST",
+		// the lock is named after the database, GET_LOCK names are server wide
+		lockMigrations:   "SELECT GET_LOCK(CONCAT(DATABASE(), '.schema_migrations'), -1)",
+		unlockMigrations: "SELECT RELEASE_LOCK(CONCAT(DATABASE(), '.schema_migrations'))",
+	}
+	sqliteDialect = &dialect{
+		driver:     "sqlite",
+		migrations: "migrations/sqlite",
+		fromUnix:   "datetime(?, 'unixepoch')",
+		toUnix:     "CAST(strftime('%%s', %s) AS INTEGER)",
+		excluded:   "excluded.%s",
+		least:      "MIN",
+		greatest:   "MAX",
+		returning:  true,
+	}
+	postgresDialect = &dialect{
+		driver:     "postgres",
+		migrations: "migrations/postgres",
+		fromUnix:   "to_timestamp(?)",
+		toUnix:     "CAST(EXTRACT(EPOCH FROM %s) AS BIGINT)",
+		excluded:   "excluded.%s",
+		least:      "LEAST",
+		greatest:   "GREATEST",
+		numbered:   true,
+		returning:  true,
+		// pg_advisory_lock returns void, selecting from it yields a row
+		lockMigrations:   "SELECT 1 FROM pg_advisory_lock(hashtext('schema_migrations'))",
+		unlockMigrations: "SELECT pg_advisory_unlock(hashtext('schema_migrations'))",
+	}
+	dialects = map[string]*dialect{
+		mysqlDialect.driver:    mysqlDialect,
+		sqliteDialect.driver:   sqliteDialect,
+		postgresDialect.driver: postgresDialect,
+	}
+)
+
+// rebind rewrites the ? placeholders of query to the dialect's style
+func (d *dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// unix returns the expression reading column as a unix timestamp
+func (d *dialect) unix(column string) string {
+	return fmt.Sprintf(d.toUnix, column)
+}
+
+// excludedColumn returns the expression reading column from the row an upsert
+// failed to insert
+func (d *dialect) excludedColumn(column string) string {
+	return fmt.Sprintf(d.excluded, column)
+}
+
+// upsert returns the clause turning an INSERT into an update of the row
+// conflicting on the key columns, with the assignments set
+func (d *dialect) upsert(key string, set []string) string {
+	if d.onDuplicateKey {
+		return " ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+	}
+	return " ON CONFLICT (" + key + ") DO UPDATE SET " + strings.Join(set, ", ")
+}
+
+func dialectFor(driver string) (*dialect, error) {
+	d, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported database driver %s", driver)
+	}
+	return d, nil
+}
+
+// SQLStore is a Store backed by a SQL database
+type SQLStore struct {
+	db      *sql.DB
+	dialect *dialect
+	lock    sync.Mutex
+	stmts   map[string]*sql.Stmt
+}
+
+// NewSQLStore returns a SQLStore for db opened with driver
+func NewSQLStore(db *sql.DB, driver string) (*SQLStore, error) {
+	d, err := dialectFor(driver)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLStore{db: db, dialect: d, stmts: make(map[string]*sql.Stmt)}, nil
+}
+
+func NewMySQLStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db, dialect: mysqlDialect, stmts: make(map[string]*sql.Stmt)}
+}
+
+func NewSQLiteStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db, dialect: sqliteDialect, stmts: make(map[string]*sql.Stmt)}
+}
+
+func NewPostgresStore(db *sql.DB) *SQLStore {
+	return &SQLStore{db: db, dialect: postgresDialect, stmts: make(map[string]*sql.Stmt)}
+}
+
+// prepare returns the prepared statement for query, preparing it on the
+// underlying *sql.DB the first time it is asked for
+func (s *SQLStore) prepare(query string) (*sql.Stmt, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if stmt, ok := s.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := s.db.Prepare(s.dialect.rebind(query))
+	if err != nil {
+		return nil, err
+	}
+	s.stmts[query] = stmt
+	return stmt, nil
+}
+
+func (s *SQLStore) exec(query string, args ...interface{}) (sql.Result, error) {
+	stmt, err := s.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Exec(args...)
+}
+
+func (s *SQLStore) query(query string, args ...interface{}) (*sql.Rows, error) {
+	stmt, err := s.prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.Query(args...)
+}
+
+func (s *SQLStore) queryRow(dest []interface{}, query string, args ...interface{}) error {
+	stmt, err := s.prepare(query)
+	if err != nil {
+		return err
+	}
+	return stmt.QueryRow(args...).Scan(dest...)
+}
+
+// insert runs an INSERT statement and returns the id of the new row
+func (s *SQLStore) insert(query string, args ...interface{}) (int, error) {
+	if s.dialect.returning {
+		var id int
+		err := s.queryRow([]interface{}{&id}, query+" RETURNING id", args...)
+		return id, err
+	}
+	res, err := s.exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	return int(id), nil
+}
+
+func (s *SQLStore) CreateCity(c *City) error {
+	id, err := s.insert("INSERT INTO cities(name, latitude, longitude) VALUES(?, ?, ?)", c.Name, c.Latitude, c.Longitude)
+	if err != nil {
+		return err
+	}
+	c.ID = id
+	return nil
+}
+
+func (s *SQLStore) GetCity(c *City) error {
+	return s.queryRow([]interface{}{&c.Name, &c.Latitude, &c.Longitude}, "SELECT name, latitude, longitude FROM cities WHERE id=? AND deleted_at IS NULL", c.ID)
+}
+
+// likePrefix escapes the LIKE wildcards of prefix for use with ESCAPE '!'
+func likePrefix(prefix string) string {
+	replacer := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+	return replacer.Replace(prefix) + "%"
+}
+
+func (s *SQLStore) ListCities(q CityQuery) ([]City, error) {
+	conditions := []string{"deleted_at IS NULL"}
+	args := []interface{}{}
+	if q.NamePrefix != "" {
+		conditions = append(conditions, "LOWER(name) LIKE ? ESCAPE '!'")
+		args = append(args, likePrefix(strings.ToLower(q.NamePrefix)))
+	}
+	op, direction := ">", "ASC"
+	if q.Descending {
+		op, direction = "<", "DESC"
+	}
+	order := "id " + direction
+	if q.SortBy == "name" {
+		order = "name " + direction + ", id " + direction
+	}
+	if q.After != nil {
+		if q.SortBy == "name" {
+			conditions = append(conditions, fmt.Sprintf("(name %s ? OR (name = ? AND id %s ?))", op, op))
+			args = append(args, q.After.Name, q.After.Name, q.After.ID)
+		} else {
+			conditions = append(conditions, "id "+op+" ?")
+			args = append(args, q.After.ID)
+		}
+	}
+	query := "SELECT id, name, latitude, longitude FROM cities WHERE " + strings.Join(conditions, " AND ")
+	query += " ORDER BY " + order + " LIMIT ?"
+	args = append(args, q.Limit)
+	rows, err := s.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cities := []City{}
+	for rows.Next() {
+		var c City
+		if err := rows.Scan(&c.ID, &c.Name, &c.Latitude, &c.Longitude); err != nil {
+			return nil, err
+		}
+		cities = append(cities, c)
+	}
+	return cities, rows.Err()
+}
+
+func (s *SQLStore) FindCitiesInBox(box GeoBox) ([]City, error) {
+	query := "SELECT id, name, latitude, longitude FROM cities WHERE latitude BETWEEN ? AND ? AND longitude BETWEEN ? AND ? AND deleted_at IS NULL"
+	if box.MinLon > box.MaxLon {
+		query = "SELECT id, name, latitude, longitude FROM cities WHERE latitude BETWEEN ? AND ? AND (longitude >= ? OR longitude <= ?) AND deleted_at IS NULL"
+	}
+	rows, err := s.query(query, box.MinLat, box.MaxLat, box.MinLon, box.MaxLon)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cities := []City{}
+	for rows.Next() {
+		var c City
+		if err := rows.Scan(&c.ID, &c.Name, &c.Latitude, &c.Longitude); err != nil {
+			return nil, err
+		}
+		cities = append(cities, c)
+	}
+	return cities, rows.Err()
+}
+
+func (s *SQLStore) UpdateCity(c *City) error {
+	res, err := s.exec("UPDATE cities SET name=?, latitude=?, longitude=? WHERE id=? AND deleted_at IS NULL", c.Name, c.Latitude, c.Longitude, c.ID)
+	if err != nil {
+		return err
+	}
+	return affected(res)
+}
+
+// affected returns sql.ErrNoRows when res changed no row
+func affected(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (s *SQLStore) DeleteCity(c *City) error {
+	err := s.GetCity(c)
+	if err != nil {
+		return err
+	}
+	res, err := s.exec("UPDATE cities SET deleted_at=CURRENT_TIMESTAMP WHERE id=? AND deleted_at IS NULL", c.ID)
+	if err != nil {
+		return err
+	}
+	return affected(res)
+}
+
+func (s *SQLStore) RestoreCity(c *City) error {
+	var taken int
+	err := s.queryRow([]interface{}{&taken}, "SELECT COUNT(*) FROM cities WHERE deleted_at IS NULL AND id<>? AND name = (SELECT name FROM cities WHERE id=?)", c.ID, c.ID)
+	if err != nil {
+		return err
+	}
+	if taken > 0 {
+		return ErrCityNameTaken
+	}
+	res, err := s.exec("UPDATE cities SET deleted_at=NULL WHERE id=? AND deleted_at IS NOT NULL", c.ID)
+	if err != nil {
+		return err
+	}
+	if err := affected(res); err != nil {
+		return err
+	}
+	return s.GetCity(c)
+}
+
+func (s *SQLStore) DeleteCityCascade(c *City) ([]Webhook, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	webhooks, err := s.deleteCityCascade(tx, c)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	return webhooks, tx.Commit()
+}
+
+func (s *SQLStore) deleteCityCascade(tx *sql.Tx, c *City) ([]Webhook, error) {
+	// statements run on tx directly, preparing them on s.db would wait for a
+	// free connection while tx may hold the only one
+	err := tx.QueryRow(s.dialect.rebind("SELECT name, latitude, longitude FROM cities WHERE id=?"), c.ID).Scan(&c.Name, &c.Latitude, &c.Longitude)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := tx.Query(s.dialect.rebind("SELECT id, city_id, callback_url, unit FROM webhooks WHERE city_id=?"), c.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var w Webhook
+		if err := rows.Scan(&w.ID, &w.CityID, &w.CallbackURL, &w.Unit); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	for _, query := range []string{
+		"DELETE FROM webhook_outbox WHERE webhook_id IN (SELECT id FROM webhooks WHERE city_id=?)",
+		"DELETE FROM temperatures WHERE city_id=?",
+		"DELETE FROM temperature_rollups WHERE city_id=?",
+		"DELETE FROM webhooks WHERE city_id=?",
+		"DELETE FROM cities WHERE id=?",
+	} {
+		if _, err := tx.Exec(s.dialect.rebind(query), c.ID); err != nil {
+			return nil, err
+		}
+	}
+	return webhooks, nil
+}
+
+// CreateTemperature stores t and rolls it up in one transaction
+func (s *SQLStore) CreateTemperature(t *Temperature) error {
+	return s.CreateTemperatures([]*Temperature{t})
+}
+
+// temperatureBatchSize is the number of readings CreateTemperatures inserts,
+// and adds to the outbox, per statement
+const temperatureBatchSize = 100
+
+func (s *SQLStore) CreateTemperatures(temperatures []*Temperature) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for start := 0; start < len(temperatures); start += temperatureBatchSize {
+		end := start + temperatureBatchSize
+		if end > len(temperatures) {
+			end = len(temperatures)
+		}
+		if err := s.insertTemperatures(tx, temperatures[start:end]); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := s.insertOutbox(tx, temperatures[start:end]); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := s.upsertRollups(tx, temperatures); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertOutbox adds the stored temperatures to the outbox on tx, once for
+// every webhook of their city
+func (s *SQLStore) insertOutbox(tx *sql.Tx, temperatures []*Temperature) error {
+	ids := make([]string, len(temperatures))
+	args := make([]interface{}, len(temperatures))
+	for i, t := range temperatures {
+		ids[i] = "?"
+		args[i] = t.ID
+	}
+	query := "INSERT INTO webhook_outbox(webhook_id, temperature_id) SELECT webhooks.id, temperatures.id FROM temperatures " +
+		"JOIN webhooks ON webhooks.city_id = temperatures.city_id WHERE temperatures.id IN (" + strings.Join(ids, ", ") + ") ORDER BY temperatures.id, webhooks.id"
+	_, err := tx.Exec(s.dialect.rebind(query), args...)
+	return err
+}
+
+// upsertRollups adds temperatures to the rollup table on tx
+func (s *SQLStore) upsertRollups(tx *sql.Tx, temperatures []*Temperature) error {
+	set := []string{
+		fmt.Sprintf("readings = temperature_rollups.readings + %s", s.dialect.excludedColumn("readings")),
+		fmt.Sprintf("sum_max = temperature_rollups.sum_max + %s", s.dialect.excludedColumn("sum_max")),
+		fmt.Sprintf("sum_min = temperature_rollups.sum_min + %s", s.dialect.excludedColumn("sum_min")),
+		fmt.Sprintf("min_min = %s(temperature_rollups.min_min, %s)", s.dialect.least, s.dialect.excludedColumn("min_min")),
+		fmt.Sprintf("max_max = %s(temperature_rollups.max_max, %s)", s.dialect.greatest, s.dialect.excludedColumn("max_max")),
+	}
+	query := s.dialect.rebind("INSERT INTO temperature_rollups(city_id, resolution, bucket_start, readings, sum_max, sum_min, min_min, max_max) VALUES(?, ?, ?, ?, ?, ?, ?, ?)" +
+		s.dialect.upsert("city_id, resolution, bucket_start", set))
+	keys, rows := rollupTemperatures(temperatures)
+	for _, key := range keys {
+		row := rows[key]
+		if _, err := tx.Exec(query, key.cityID, key.resolution, key.start, row.readings, row.sumMax, row.sumMin, row.minMin, row.maxMax); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLStore) ListRollups(cityID int, bucket, from, to int64) ([]Rollup, error) {
+	resolution, err := RollupResolution(bucket)
+	if err != nil {
+		return nil, err
+	}
+	from, to = bucketRange(bucket, from, to)
+	rows, err := s.query("SELECT bucket_start - bucket_start % ?, SUM(readings), SUM(sum_max), SUM(sum_min), MIN(min_min), MAX(max_max) FROM temperature_rollups "+
+		"WHERE city_id = ? AND resolution = ? AND bucket_start >= ? AND bucket_start < ? GROUP BY 1 ORDER BY 1",
+		bucket, cityID, resolution, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rollups := []Rollup{}
+	for rows.Next() {
+		var start int64
+		var row rollupRow
+		if err := rows.Scan(&start, &row.readings, &row.sumMax, &row.sumMin, &row.minMin, &row.maxMax); err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, row.rollup(start))
+	}
+	return rollups, rows.Err()
+}
+
+// insertTemperatures inserts temperatures with a single statement on tx and
+// sets their ids. With RETURNING the ids are read back, in any order, and
+// given to the rows in ascending order, the order they were inserted in.
+// Otherwise LastInsertId is the id of the first row: MySQL allocates the ids
+// of an insert whose row count is known at once, consecutive under every
+// innodb_autoinc_lock_mode.
+func (s *SQLStore) insertTemperatures(tx *sql.Tx, temperatures []*Temperature) error {
+	row := fmt.Sprintf("(?, ?, ?, %s, %s)", s.dialect.fromUnix, s.dialect.fromUnix)
+	rows := make([]string, len(temperatures))
+	args := []interface{}{}
+	for i, t := range temperatures {
+		rows[i] = row
+		args = append(args, t.CityID, t.Max, t.Min, t.Timestamp, t.ReceivedAt)
+	}
+	query := s.dialect.rebind("INSERT INTO temperatures(city_id, max, min, timestamp, received_at) VALUES" + strings.Join(rows, ", "))
+	if s.dialect.returning {
+		result, err := tx.Query(query+" RETURNING id", args...)
+		if err != nil {
+			return err
+		}
+		defer result.Close()
+		ids := []int{}
+		for result.Next() {
+			var id int
+			if err := result.Scan(&id); err != nil {
+				return err
+			}
+			ids = append(ids, id)
+		}
+		if err := result.Err(); err != nil {
+			return err
+		}
+		if len(ids) != len(temperatures) {
+			return fmt.Errorf("Inserted %d temperatures, expected %d", len(ids), len(temperatures))
+		}
+		sort.Ints(ids)
+		for i, t := range temperatures {
+			t.ID = ids[i]
+		}
+		return nil
+	}
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for i, t := range temperatures {
+		t.ID = int(id) + i
+	}
+	return nil
+}
+
+func (s *SQLStore) GetTemperatures(cityID int, timestamp int64) ([]Temperature, error) {
+	query := fmt.Sprintf("SELECT id, city_id, max, min, %s, %s FROM temperatures WHERE city_id = ? AND timestamp >= %s",
+		s.dialect.unix("timestamp"), s.dialect.unix("received_at"), s.dialect.fromUnix)
+	rows, err := s.query(query, cityID, timestamp)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	temperatures := []Temperature{}
+	for rows.Next() {
+		var t Temperature
+		if err := rows.Scan(&t.ID, &t.CityID, &t.Max, &t.Min, &t.Timestamp, &t.ReceivedAt); err != nil {
+			return nil, err
+		}
+		temperatures = append(temperatures, t)
+	}
+	return temperatures, rows.Err()
+}
+
+// aggregateColumns returns the columns summarizing the readings with agg,
+// qualified with table when it isn't empty
+func aggregateColumns(agg Aggregation, table string) (string, error) {
+	max, min := table+"max", table+"min"
+	switch agg {
+	case Mean, Median, P90:
+		return fmt.Sprintf("AVG(%s), AVG(%s)", max, min), nil
+	case MinOfMins:
+		return fmt.Sprintf("MIN(%s), MIN(%s)", max, min), nil
+	case MaxOfMaxes:
+		return fmt.Sprintf("MAX(%s), MAX(%s)", max, min), nil
+	case StdDev:
+		return fmt.Sprintf("AVG(%[1]s), AVG(%[2]s), AVG(%[1]s * %[1]s), AVG(%[2]s * %[2]s)", max, min), nil
+	}
+	return "", fmt.Errorf("Unsupported aggregation '%s'", agg)
+}
+
+// aggregateRow is a row of aggregateColumns, NULL when there are no readings
+type aggregateRow struct {
+	max, min, maxSquares, minSquares sql.NullFloat64
+}
+
+func (r *aggregateRow) dest(agg Aggregation) []interface{} {
+	dest := []interface{}{&r.max, &r.min}
+	if agg == StdDev {
+		dest = append(dest, &r.maxSquares, &r.minSquares)
+	}
+	return dest
+}
+
+// summarize sets the max and min of f, except for the percentiles which
+// aren't known from the row alone
+func (r *aggregateRow) summarize(f *Forecast, agg Aggregation) {
+	f.Max, f.Min = r.max.Float64, r.min.Float64
+	if agg == StdDev {
+		f.Max = stdDev(r.max.Float64, r.maxSquares.Float64)
+		f.Min = stdDev(r.min.Float64, r.minSquares.Float64)
+	}
+}
+
+func (s *SQLStore) AggregateTemperatures(cityID int, from int64, agg Aggregation) (Forecast, error) {
+	forecast := Forecast{CityID: cityID}
+	where := "WHERE city_id = ? AND timestamp >= " + s.dialect.fromUnix
+	columns, err := aggregateColumns(agg, "")
+	if err != nil {
+		return forecast, err
+	}
+	var row aggregateRow
+	err = s.queryRow(append([]interface{}{&forecast.Sample}, row.dest(agg)...), "SELECT COUNT(*), "+columns+" FROM temperatures "+where, cityID, from)
+	if err != nil {
+		return forecast, err
+	}
+	row.summarize(&forecast, agg)
+	if p, ok := agg.percentileRank(); ok && forecast.Sample > 0 {
+		// the database sorts the readings of each column and only the two
+		// values the percentile lies between are read
+		offset, weight := percentileOffset(p, forecast.Sample)
+		for _, column := range []struct {
+			name  string
+			value *float64
+		}{{"max", &forecast.Max}, {"min", &forecast.Min}} {
+			rows, err := s.query("SELECT "+column.name+" FROM temperatures "+where+" ORDER BY "+column.name+" LIMIT 2 OFFSET ?", cityID, from, offset)
+			if err != nil {
+				return forecast, err
+			}
+			values := []float64{}
+			for rows.Next() {
+				var value float64
+				if err := rows.Scan(&value); err != nil {
+					rows.Close()
+					return forecast, err
+				}
+				values = append(values, value)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return forecast, err
+			}
+			if len(values) == 0 {
+				return forecast, sql.ErrNoRows
+			}
+			// the upper value is missing when the percentile is the last one
+			values = append(values, values[0])
+			*column.value = interpolate(values[0], values[1], weight)
+		}
+	}
+	return forecast, nil
+}
+
+func (s *SQLStore) AggregateCityTemperatures(cityIDs []int, from int64, agg Aggregation) (map[int]Forecast, error) {
+	columns, err := aggregateColumns(agg, "temperatures.")
+	if err != nil {
+		return nil, err
+	}
+	forecasts := map[int]Forecast{}
+	// the queries depend on the number of cities, they are run without
+	// caching a prepared statement for each
+	filter, args := "", []interface{}{}
+	if cityIDs != nil {
+		if len(cityIDs) == 0 {
+			return forecasts, nil
+		}
+		filter = " AND %s IN (?" + strings.Repeat(", ?", len(cityIDs)-1) + ")"
+		for _, id := range cityIDs {
+			args = append(args, id)
+		}
+	}
+	// cities without readings are kept by the outer join, with a sample of 0
+	query := "SELECT cities.id, COUNT(temperatures.id), " + columns + " FROM cities" +
+		" LEFT JOIN temperatures ON temperatures.city_id = cities.id AND temperatures.timestamp >= " + s.dialect.fromUnix +
+		" WHERE cities.deleted_at IS NULL" + strings.Replace(filter, "%s", "cities.id", 1) + " GROUP BY cities.id"
+	rows, err := s.db.Query(s.dialect.rebind(query), append([]interface{}{from}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var forecast Forecast
+		var row aggregateRow
+		if err := rows.Scan(append([]interface{}{&forecast.CityID, &forecast.Sample}, row.dest(agg)...)...); err != nil {
+			return nil, err
+		}
+		row.summarize(&forecast, agg)
+		forecasts[forecast.CityID] = forecast
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	p, ok := agg.percentileRank()
+	if !ok {
+		return forecasts, nil
+	}
+	filter = strings.Replace(filter, "%s", "city_id", 1)
+	for _, column := range []string{"max", "min"} {
+		values, err := s.percentileValues(column, p, filter, append([]interface{}{from}, args...))
+		if err != nil {
+			return nil, err
+		}
+		for cityID, v := range values {
+			forecast, ok := forecasts[cityID]
+			if !ok {
+				// the readings of a deleted city
+				continue
+			}
+			_, weight := percentileOffset(p, forecast.Sample)
+			// the upper value is missing when the percentile is the last one
+			// or falls on a reading
+			v = append(v, v[0])
+			value := interpolate(v[0], v[1], weight)
+			if column == "max" {
+				forecast.Max = value
+			} else {
+				forecast.Min = value
+			}
+			forecasts[cityID] = forecast
+		}
+	}
+	return forecasts, nil
+}
+
+// percentileValues returns for each city the sorted values of column the
+// percentile p of its readings lies between. The readings are ranked per
+// city in the database and only the one or two values next to the
+// percentile's position are read.
+func (s *SQLStore) percentileValues(column string, p float64, filter string, args []interface{}) (map[int][]float64, error) {
+	position := fmt.Sprintf("%g * (readings - 1)", p)
+	query := "SELECT city_id, value FROM (" +
+		"SELECT city_id, " + column + " AS value, ROW_NUMBER() OVER (PARTITION BY city_id ORDER BY " + column + ") - 1 AS ordinal, COUNT(*) OVER (PARTITION BY city_id) AS readings" +
+		" FROM temperatures WHERE timestamp >= " + s.dialect.fromUnix + filter +
+		") ranked WHERE ordinal > " + position + " - 1 AND ordinal < " + position + " + 1 ORDER BY city_id, ordinal"
+	rows, err := s.db.Query(s.dialect.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := map[int][]float64{}
+	for rows.Next() {
+		var cityID int
+		var value float64
+		if err := rows.Scan(&cityID, &value); err != nil {
+			return nil, err
+		}
+		values[cityID] = append(values[cityID], value)
+	}
+	return values, rows.Err()
+}
+
+func (s *SQLStore) ListTemperatures(q TemperatureQuery) ([]Temperature, error) {
+	conditions := []string{"city_id = ?"}
+	args := []interface{}{q.CityID}
+	if q.From != 0 {
+		conditions = append(conditions, "timestamp >= "+s.dialect.fromUnix)
+		args = append(args, q.From)
+	}
+	if q.To != 0 {
+		conditions = append(conditions, "timestamp < "+s.dialect.fromUnix)
+		args = append(args, q.To)
+	}
+	if q.After != nil {
+		conditions = append(conditions, fmt.Sprintf("(timestamp > %s OR (timestamp = %s AND id > ?))", s.dialect.fromUnix, s.dialect.fromUnix))
+		args = append(args, q.After.Timestamp, q.After.Timestamp, q.After.ID)
+	}
+	query := fmt.Sprintf("SELECT id, city_id, max, min, %s, %s FROM temperatures WHERE %s ORDER BY timestamp, id LIMIT ?",
+		s.dialect.unix("timestamp"), s.dialect.unix("received_at"), strings.Join(conditions, " AND "))
+	rows, err := s.query(query, append(args, q.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	temperatures := []Temperature{}
+	for rows.Next() {
+		var t Temperature
+		if err := rows.Scan(&t.ID, &t.CityID, &t.Max, &t.Min, &t.Timestamp, &t.ReceivedAt); err != nil {
+			return nil, err
+		}
+		temperatures = append(temperatures, t)
+	}
+	return temperatures, rows.Err()
+}
+
+func (s *SQLStore) CreateWebhook(w *Webhook) error {
+	if w.Unit == "" {
+		w.Unit = Celsius
+	}
+	id, err := s.insert("INSERT INTO webhooks(city_id, callback_url, unit, secret) VALUES(?, ?, ?, ?)", w.CityID, w.CallbackURL, w.Unit, w.Secret)
+	if err != nil {
+		return err
+	}
+	w.ID = id
+	return nil
+}
+
+func (s *SQLStore) GetWebhooks() ([]Webhook, error) {
+	rows, err := s.query("SELECT id, city_id, callback_url, unit FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	webhooks := []Webhook{}
+	for rows.Next() {
+		var w Webhook
+		if err := rows.Scan(&w.ID, &w.CityID, &w.CallbackURL, &w.Unit); err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, rows.Err()
+}
+
+func (s *SQLStore) getWebhook(w *Webhook) error {
+	return s.queryRow([]interface{}{&w.ID, &w.CityID, &w.CallbackURL, &w.Unit}, "SELECT id, city_id, callback_url, unit FROM webhooks WHERE id=?", w.ID)
+}
+
+func (s *SQLStore) DeleteWebhook(w *Webhook) error {
+	err := s.getWebhook(w)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, query := range []string{
+		"DELETE FROM webhook_outbox WHERE webhook_id=?",
+		"DELETE FROM webhooks WHERE id=?",
+	} {
+		if _, err := tx.Exec(s.dialect.rebind(query), w.ID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) RotateWebhookSecret(w *Webhook, secret string, previousExpiresAt int64) error {
+	// the assignments read the secret being replaced, MySQL evaluates them in
+	// order so it is assigned last
+	res, err := s.exec("UPDATE webhooks SET previous_secret=secret, previous_secret_expires_at=CASE WHEN secret='' THEN 0 ELSE ? END, secret=? WHERE id=?",
+		previousExpiresAt, secret, w.ID)
+	if err != nil {
+		return err
+	}
+	if err := affected(res); err != nil {
+		return err
+	}
+	w.Secret = secret
+	return s.queryRow([]interface{}{&w.ID, &w.CityID, &w.CallbackURL, &w.Unit, &w.PreviousSecretExpiresAt},
+		"SELECT id, city_id, callback_url, unit, previous_secret_expires_at FROM webhooks WHERE id=?", w.ID)
+}
+
+func (s *SQLStore) ClaimOutbox(now, until int64, limit int) ([]OutboxEntry, error) {
+	query := fmt.Sprintf("SELECT webhook_outbox.id, webhook_outbox.claimed_until, webhooks.id, webhooks.city_id, webhooks.callback_url, webhooks.unit, "+
+		"webhooks.secret, webhooks.previous_secret, webhooks.previous_secret_expires_at, temperatures.id, temperatures.city_id, temperatures.max, temperatures.min, %s, %s FROM webhook_outbox "+
+		"JOIN webhooks ON webhooks.id = webhook_outbox.webhook_id JOIN temperatures ON temperatures.id = webhook_outbox.temperature_id "+
+		"WHERE webhook_outbox.claimed_until < ? ORDER BY webhook_outbox.id LIMIT ?",
+		s.dialect.unix("temperatures.timestamp"), s.dialect.unix("temperatures.received_at"))
+	rows, err := s.query(query, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	type candidate struct {
+		entry        OutboxEntry
+		claimedUntil int64
+	}
+	candidates := []candidate{}
+	for rows.Next() {
+		var c candidate
+		e := &c.entry
+		if err := rows.Scan(&e.ID, &c.claimedUntil, &e.Webhook.ID, &e.Webhook.CityID, &e.Webhook.CallbackURL, &e.Webhook.Unit,
+			&e.Webhook.Secret, &e.Webhook.PreviousSecret, &e.Webhook.PreviousSecretExpiresAt, &e.Temperature.ID, &e.Temperature.CityID, &e.Temperature.Max, &e.Temperature.Min, &e.Temperature.Timestamp, &e.Temperature.ReceivedAt); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+	// a delivery is claimed only if nobody claimed it since it was read
+	entries := []OutboxEntry{}
+	for _, c := range candidates {
+		res, err := s.exec("UPDATE webhook_outbox SET claimed_until=? WHERE id=? AND claimed_until=?", until, c.entry.ID, c.claimedUntil)
+		if err != nil {
+			return nil, err
+		}
+		if err := affected(res); err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, c.entry)
+	}
+	return entries, nil
+}
+
+func (s *SQLStore) ExtendOutboxClaim(ids []int, until int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	// the query depends on the number of deliveries, it is run without
+	// caching a prepared statement
+	args := []interface{}{until}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	query := "UPDATE webhook_outbox SET claimed_until=? WHERE id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+	_, err := s.db.Exec(s.dialect.rebind(query), args...)
+	return err
+}
+
+func (s *SQLStore) CompleteOutbox(id int) error {
+	_, err := s.exec("DELETE FROM webhook_outbox WHERE id=?", id)
+	return err
+}
+
+func (s *SQLStore) RecordDelivery(d *Delivery) error {
+	id, err := s.insert("INSERT INTO webhook_deliveries(webhook_id, temperature_id, attempt, status, status_code, latency_ms, response, error, created_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		d.WebhookID, d.TemperatureID, d.Attempt, d.Status, d.StatusCode, d.Latency, d.Response, d.Error, d.CreatedAt)
+	if err != nil {
+		return err
+	}
+	d.ID = id
+	return nil
+}
+
+func (s *SQLStore) ListDeliveries(q DeliveryQuery) ([]Delivery, error) {
+	conditions := []string{"webhook_id = ?"}
+	args := []interface{}{q.WebhookID}
+	if q.Status != "" {
+		conditions = append(conditions, "status = ?")
+		args = append(args, q.Status)
+	}
+	if q.StatusCode != 0 {
+		conditions = append(conditions, "status_code = ?")
+		args = append(args, q.StatusCode)
+	}
+	if q.Before != 0 {
+		conditions = append(conditions, "id < ?")
+		args = append(args, q.Before)
+	}
+	query := fmt.Sprintf("SELECT id, webhook_id, temperature_id, attempt, status, status_code, latency_ms, response, error, created_at "+
+		"FROM webhook_deliveries WHERE %s ORDER BY id DESC LIMIT ?", strings.Join(conditions, " AND "))
+	rows, err := s.query(query, append(args, q.Limit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []Delivery{}
+	for rows.Next() {
+		var d Delivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.TemperatureID, &d.Attempt, &d.Status, &d.StatusCode, &d.Latency, &d.Response, &d.Error, &d.CreatedAt); err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+func (s *SQLStore) PruneDeliveries(before int64) (int64, error) {
+	res, err := s.exec("DELETE FROM webhook_deliveries WHERE created_at < ?", before)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
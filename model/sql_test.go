@@ -0,0 +1,148 @@
+package model
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenBareMySQLDSN(t *testing.T) {
+	db, err := Open("mysql", "docker:docker@tcp(localhost:3306)/test_db")
+	assert.Nil(t, err)
+	db.Close()
+
+	dsn, err := withMySQLOptions("docker:docker@tcp(localhost:3306)/test_db?charset=utf8mb4")
+	assert.Nil(t, err)
+	config, err := mysql.ParseDSN(dsn)
+	assert.Nil(t, err)
+	assert.True(t, config.ParseTime)
+	assert.True(t, config.ClientFoundRows)
+	assert.Equal(t, "utf8mb4", config.Params["charset"])
+	// options already in the dsn are kept
+	dsn, err = withMySQLOptions(MySQLDSN("localhost", "3306", "docker", "docker", "test_db"))
+	assert.Nil(t, err)
+	config, _ = mysql.ParseDSN(dsn)
+	assert.True(t, config.ParseTime)
+	assert.True(t, config.ClientFoundRows)
+
+	_, err = Open("mysql", "not a dsn")
+	assert.NotNil(t, err)
+}
+
+func TestMySQLStoreReusesPreparedStatements(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := NewMySQLStore(db)
+	prep := mock.ExpectPrepare(regexp.QuoteMeta("INSERT INTO cities(name, latitude, longitude) VALUES(?, ?, ?)"))
+	prep.ExpectExec().WithArgs("Berlin", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	prep.ExpectExec().WithArgs("O'Fallon", sqlmock.AnyArg(), sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(2, 1))
+
+	berlin := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+	assert.Nil(t, s.CreateCity(berlin))
+	ofallon := &City{Name: "O'Fallon", Latitude: 38.59, Longitude: -90.24}
+	assert.Nil(t, s.CreateCity(ofallon))
+	assert.Equal(t, 1, berlin.ID)
+	assert.Equal(t, 2, ofallon.ID)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestDialectRebind(t *testing.T) {
+	query := "UPDATE cities SET name=?, latitude=?, longitude=? WHERE id=?"
+	assert.Equal(t, query, mysqlDialect.rebind(query))
+	assert.Equal(t, query, sqliteDialect.rebind(query))
+	assert.Equal(t, "UPDATE cities SET name=$1, latitude=$2, longitude=$3 WHERE id=$4", postgresDialect.rebind(query))
+}
+
+func TestPostgresStoreReadsIDsWithReturning(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := NewPostgresStore(db)
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta("INSERT INTO temperatures(city_id, max, min, timestamp, received_at) VALUES($1, $2, $3, to_timestamp($4), to_timestamp($5)) RETURNING id")).
+		WithArgs(1, 30.0, 10.0, int64(1580000000), int64(1580000060)).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO webhook_outbox(webhook_id, temperature_id) SELECT webhooks.id, temperatures.id FROM temperatures " +
+		"JOIN webhooks ON webhooks.city_id = temperatures.city_id WHERE temperatures.id IN ($1)")).
+		WithArgs(7).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO temperature_rollups(city_id, resolution, bucket_start, readings, sum_max, sum_min, min_min, max_max) VALUES($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (city_id, resolution, bucket_start) DO UPDATE SET readings = temperature_rollups.readings + excluded.readings")).
+		WithArgs(1, int64(3600), int64(1579996800), 1, 30.0, 10.0, 10.0, 30.0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO temperature_rollups").
+		WithArgs(1, int64(86400), int64(1579996800), 1, 30.0, 10.0, 10.0, 30.0).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	temperature := &Temperature{CityID: 1, Max: 30, Min: 10, Timestamp: 1580000000, ReceivedAt: 1580000060}
+	assert.Nil(t, s.CreateTemperature(temperature))
+	assert.Equal(t, 7, temperature.ID)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMySQLStoreNumbersBatchFromFirstInsertID(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := NewMySQLStore(db)
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO temperatures(city_id, max, min, timestamp, received_at) VALUES(?, ?, ?, FROM_UNIXTIME(?), FROM_UNIXTIME(?)), (?, ?, ?, FROM_UNIXTIME(?), FROM_UNIXTIME(?))")).
+		WithArgs(1, 30.0, 10.0, int64(1580000000), int64(1580000060), 2, 20.0, 5.0, int64(1580000000), int64(1580000060)).
+		WillReturnResult(sqlmock.NewResult(7, 2))
+	// the readings are added to the outbox by their ids
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO webhook_outbox(webhook_id, temperature_id) SELECT")).
+		WithArgs(7, 8).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	for i := 0; i < 4; i++ {
+		mock.ExpectExec(regexp.QuoteMeta("INSERT INTO temperature_rollups(city_id, resolution, bucket_start, readings, sum_max, sum_min, min_min, max_max) VALUES(?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE")).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	mock.ExpectCommit()
+
+	temperatures := []*Temperature{
+		{CityID: 1, Max: 30, Min: 10, Timestamp: 1580000000, ReceivedAt: 1580000060},
+		{CityID: 2, Max: 20, Min: 5, Timestamp: 1580000000, ReceivedAt: 1580000060},
+	}
+	assert.Nil(t, s.CreateTemperatures(temperatures))
+	assert.Equal(t, 7, temperatures[0].ID)
+	assert.Equal(t, 8, temperatures[1].ID)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMySQLStoreClaimOutboxSkipsEntriesClaimedMeanwhile(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+	s := NewMySQLStore(db)
+	columns := []string{"id", "claimed_until", "webhook_id", "city_id", "callback_url", "unit", "secret", "previous_secret", "previous_secret_expires_at", "temperature_id", "city_id", "max", "min", "timestamp", "received_at"}
+	mock.ExpectPrepare("SELECT (.+) FROM webhook_outbox JOIN webhooks (.+) WHERE webhook_outbox.claimed_until < \\? ORDER BY webhook_outbox.id LIMIT \\?").
+		ExpectQuery().WithArgs(int64(1000), 10).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, 0, 3, 1, "https://my.service.com/first", "C", "second", "first", 1100, 5, 1, 20.5, 10.0, 1580000000, 1580000060).
+			AddRow(2, 990, 4, 1, "https://my.service.com/second", "F", "", "", 0, 5, 1, 20.5, 10.0, 1580000000, 1580000060))
+	claim := mock.ExpectPrepare(regexp.QuoteMeta("UPDATE webhook_outbox SET claimed_until=? WHERE id=? AND claimed_until=?"))
+	claim.ExpectExec().WithArgs(int64(1060), 1, int64(0)).WillReturnResult(sqlmock.NewResult(0, 1))
+	// another instance claimed the second entry after it was read
+	claim.ExpectExec().WithArgs(int64(1060), 2, int64(990)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	entries, err := s.ClaimOutbox(1000, 1060, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []OutboxEntry{{
+		ID:          1,
+		Webhook:     Webhook{ID: 3, CityID: 1, CallbackURL: "https://my.service.com/first", Unit: Celsius, Secret: "second", PreviousSecret: "first", PreviousSecretExpiresAt: 1100},
+		Temperature: Temperature{ID: 5, CityID: 1, Max: 20.5, Min: 10, Timestamp: 1580000000, ReceivedAt: 1580000060},
+	}}, entries)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
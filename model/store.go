@@ -0,0 +1,137 @@
+package model
+
+import "errors"
+
+// ErrCityNameTaken is returned when a soft deleted city is restored while
+// another city has its name. Names are only unique among cities that aren't
+// deleted.
+var ErrCityNameTaken = errors.New("City name is taken by another city")
+
+// CityQuery selects a page of cities
+type CityQuery struct {
+	// NamePrefix keeps the cities whose name starts with it, ignoring case
+	NamePrefix string
+	// SortBy is either "id" or "name"
+	SortBy     string
+	Descending bool
+	// After is the last city of the previous page, nil for the first page
+	After *City
+	Limit int
+}
+
+// TemperatureQuery selects a page of the readings of a city ordered by
+// measurement time
+type TemperatureQuery struct {
+	CityID int
+	// From and To bound the measurement time to [From, To), zero leaves
+	// the bound open
+	From int64
+	To   int64
+	// After is the last reading of the previous page, nil for the first page
+	After *Temperature
+	Limit int
+}
+
+// DeliveryQuery selects a page of the delivery attempts of a webhook, latest
+// first
+type DeliveryQuery struct {
+	WebhookID int
+	// Status keeps the attempts with it, empty keeps all of them
+	Status DeliveryStatus
+	// StatusCode keeps the attempts answered with it, zero keeps all of them
+	StatusCode int
+	// Before is the id of the last attempt of the previous page, zero for the
+	// first page
+	Before int
+	Limit  int
+}
+
+// CityStore persists cities
+type CityStore interface {
+	CreateCity(c *City) error
+	// GetCity fills c from the city identified by c.ID
+	GetCity(c *City) error
+	ListCities(q CityQuery) ([]City, error)
+	// FindCitiesInBox returns the cities whose coordinates lie in box
+	FindCitiesInBox(box GeoBox) ([]City, error)
+	UpdateCity(c *City) error
+	// DeleteCity fills c from the stored city before soft deleting it. Soft
+	// deleted cities are hidden until restored.
+	DeleteCity(c *City) error
+	// DeleteCityCascade fills c from the stored city, soft deleted or not,
+	// then removes it with its temperatures and webhooks in one transaction.
+	// It returns the removed webhooks.
+	DeleteCityCascade(c *City) ([]Webhook, error)
+	// RestoreCity brings back the soft deleted city identified by c.ID and
+	// fills c from it, or returns ErrCityNameTaken when its name was reused
+	RestoreCity(c *City) error
+}
+
+// TemperatureStore persists temperature readings. A new reading is added to
+// the outbox for every webhook of its city in the same transaction.
+type TemperatureStore interface {
+	CreateTemperature(t *Temperature) error
+	// CreateTemperatures stores all of temperatures in one transaction, or
+	// none of them
+	CreateTemperatures(temperatures []*Temperature) error
+	// GetTemperatures returns the readings of a city taken at or after timestamp
+	GetTemperatures(cityID int, timestamp int64) ([]Temperature, error)
+	ListTemperatures(q TemperatureQuery) ([]Temperature, error)
+	// AggregateTemperatures summarizes with agg the readings of a city taken
+	// at or after from
+	AggregateTemperatures(cityID int, from int64, agg Aggregation) (Forecast, error)
+	// AggregateCityTemperatures summarizes the readings of each of cityIDs
+	// like AggregateTemperatures, or of every city when cityIDs is nil. The
+	// forecasts are keyed by city id and unknown cities are left out.
+	AggregateCityTemperatures(cityIDs []int, from int64, agg Aggregation) (map[int]Forecast, error)
+	// ListRollups returns the rollups of a city in buckets of bucket seconds
+	// covering [from, to), skipping empty buckets. Buckets are aligned to the
+	// unix epoch and bucket must be a multiple of an hour.
+	ListRollups(cityID int, bucket, from, to int64) ([]Rollup, error)
+}
+
+// WebhookStore persists webhook subscriptions. The secrets of the webhooks
+// are only read with the deliveries claimed from the outbox.
+type WebhookStore interface {
+	CreateWebhook(w *Webhook) error
+	GetWebhooks() ([]Webhook, error)
+	// DeleteWebhook fills w from the stored webhook before removing it
+	DeleteWebhook(w *Webhook) error
+	// RotateWebhookSecret replaces the secret of the webhook w.ID with
+	// secret, keeping the replaced one valid until the unix time
+	// previousExpiresAt. w is filled from the stored webhook.
+	RotateWebhookSecret(w *Webhook, secret string, previousExpiresAt int64) error
+}
+
+// OutboxStore holds the deliveries of readings to webhooks until they are
+// done. A delivery is claimed for a while, so that it is claimed again when
+// whoever claimed it stopped before completing it.
+type OutboxStore interface {
+	// ClaimOutbox claims up to limit deliveries, oldest first, that are
+	// unclaimed or whose claim ended before the unix time now. They are
+	// claimed until the unix time until.
+	ClaimOutbox(now, until int64, limit int) ([]OutboxEntry, error)
+	// ExtendOutboxClaim claims the deliveries ids until the unix time until,
+	// keeping the claim of deliveries still being worked on
+	ExtendOutboxClaim(ids []int, until int64) error
+	// CompleteOutbox removes the delivery id from the outbox
+	CompleteOutbox(id int) error
+}
+
+// DeliveryStore logs the delivery attempts of webhooks
+type DeliveryStore interface {
+	RecordDelivery(d *Delivery) error
+	ListDeliveries(q DeliveryQuery) ([]Delivery, error)
+	// PruneDeliveries removes the attempts made before the unix time before
+	// and returns how many it removed
+	PruneDeliveries(before int64) (int64, error)
+}
+
+// Store is the storage the application depends on
+type Store interface {
+	CityStore
+	TemperatureStore
+	WebhookStore
+	OutboxStore
+	DeliveryStore
+}
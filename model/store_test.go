@@ -0,0 +1,715 @@
+package model
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testStore runs the conformance suite every Store implementation must pass.
+// newStore must return an empty store on every call.
+func testStore(t *testing.T, newStore func(t *testing.T) Store) {
+	t.Run("CreateAndGetCity", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		assert.Nil(t, s.CreateCity(city))
+		assert.NotZero(t, city.ID)
+		got := &City{ID: city.ID}
+		assert.Nil(t, s.GetCity(got))
+		assert.Equal(t, "Berlin", got.Name)
+		assert.InDelta(t, 52.52, got.Latitude, 0.001)
+		assert.InDelta(t, 13.405, got.Longitude, 0.001)
+	})
+	t.Run("CreateCityDuplicateName", func(t *testing.T) {
+		s := newStore(t)
+		assert.Nil(t, s.CreateCity(&City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}))
+		assert.NotNil(t, s.CreateCity(&City{Name: "Berlin", Latitude: 1, Longitude: 1}))
+	})
+	t.Run("GetCityNotExisting", func(t *testing.T) {
+		s := newStore(t)
+		err := s.GetCity(&City{ID: 1000})
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "no rows in result set")
+	})
+	t.Run("ListCities", func(t *testing.T) {
+		s := newStore(t)
+		for _, name := range []string{"Hamburg", "berlin", "Bremen", "Munich", "B_rlin"} {
+			assert.Nil(t, s.CreateCity(&City{Name: name, Latitude: 50, Longitude: 10}))
+		}
+		names := func(cities []City) []string {
+			result := []string{}
+			for _, c := range cities {
+				result = append(result, c.Name)
+			}
+			return result
+		}
+
+		cities, err := s.ListCities(CityQuery{SortBy: "id", Limit: 2})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"Hamburg", "berlin"}, names(cities))
+		cities, err = s.ListCities(CityQuery{SortBy: "id", After: &cities[1], Limit: 2})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"Bremen", "Munich"}, names(cities))
+		cities, err = s.ListCities(CityQuery{SortBy: "id", Descending: true, After: &cities[0], Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"berlin", "Hamburg"}, names(cities))
+
+		cities, err = s.ListCities(CityQuery{SortBy: "name", NamePrefix: "B", Limit: 10})
+		assert.Nil(t, err)
+		assert.ElementsMatch(t, []string{"berlin", "Bremen", "B_rlin"}, names(cities))
+		cities, err = s.ListCities(CityQuery{SortBy: "name", NamePrefix: "b_", Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"B_rlin"}, names(cities))
+
+		cities, err = s.ListCities(CityQuery{SortBy: "name", NamePrefix: "m", Descending: true, Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"Munich"}, names(cities))
+		cities, err = s.ListCities(CityQuery{SortBy: "name", NamePrefix: "h", After: &City{ID: 4, Name: "Munich"}, Limit: 10})
+		assert.Nil(t, err)
+		assert.Empty(t, cities)
+	})
+	t.Run("FindCitiesInBox", func(t *testing.T) {
+		s := newStore(t)
+		berlin := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		suva := &City{Name: "Suva", Latitude: -18.12, Longitude: 178.45}
+		apia := &City{Name: "Apia", Latitude: -13.83, Longitude: -171.77}
+		for _, city := range []*City{berlin, suva, apia} {
+			assert.Nil(t, s.CreateCity(city))
+		}
+		cities, err := s.FindCitiesInBox(GeoBox{MinLat: 50, MaxLat: 55, MinLon: 10, MaxLon: 15})
+		assert.Nil(t, err)
+		if assert.Len(t, cities, 1) {
+			assert.Equal(t, berlin.ID, cities[0].ID)
+		}
+		cities, err = s.FindCitiesInBox(GeoBox{MinLat: -20, MaxLat: -10, MinLon: 170, MaxLon: -170})
+		assert.Nil(t, err)
+		assert.Len(t, cities, 2)
+		cities, err = s.FindCitiesInBox(GeoBox{MinLat: -20, MaxLat: -10, MinLon: -170, MaxLon: 170})
+		assert.Nil(t, err)
+		assert.Empty(t, cities)
+	})
+	t.Run("UpdateCity", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		assert.Nil(t, s.CreateCity(city))
+		assert.Nil(t, s.UpdateCity(&City{ID: city.ID, Name: "Hamburg", Latitude: 53.55, Longitude: 9.99}))
+		got := &City{ID: city.ID}
+		assert.Nil(t, s.GetCity(got))
+		assert.Equal(t, "Hamburg", got.Name)
+		assert.InDelta(t, 53.55, got.Latitude, 0.001)
+	})
+	t.Run("UpdateCityUnchanged", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		assert.Nil(t, s.CreateCity(city))
+		assert.Nil(t, s.UpdateCity(city))
+	})
+	t.Run("UpdateCityNotExisting", func(t *testing.T) {
+		s := newStore(t)
+		err := s.UpdateCity(&City{ID: 1000, Name: "Hamburg", Latitude: 53.55, Longitude: 9.99})
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "no rows in result set")
+	})
+	t.Run("DeleteCity", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		assert.Nil(t, s.CreateCity(city))
+		deleted := &City{ID: city.ID}
+		assert.Nil(t, s.DeleteCity(deleted))
+		assert.Equal(t, "Berlin", deleted.Name)
+		assert.NotNil(t, s.GetCity(&City{ID: city.ID}))
+		assert.NotNil(t, s.UpdateCity(city))
+		cities, err := s.ListCities(CityQuery{SortBy: "id", Limit: 10})
+		assert.Nil(t, err)
+		assert.Empty(t, cities)
+		cities, err = s.FindCitiesInBox(GeoBox{MinLat: 50, MaxLat: 55, MinLon: 10, MaxLon: 15})
+		assert.Nil(t, err)
+		assert.Empty(t, cities)
+		err = s.DeleteCity(&City{ID: city.ID})
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "no rows in result set")
+	})
+	t.Run("DeleteCityNotExisting", func(t *testing.T) {
+		s := newStore(t)
+		err := s.DeleteCity(&City{ID: 1000})
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "no rows in result set")
+	})
+	t.Run("DeleteCityWithTemperatures", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		assert.Nil(t, s.CreateCity(city))
+		assert.Nil(t, s.CreateTemperature(&Temperature{CityID: city.ID, Max: 20, Min: 10, Timestamp: time.Now().Unix()}))
+		assert.Nil(t, s.DeleteCity(&City{ID: city.ID}))
+		temperatures, err := s.GetTemperatures(city.ID, 0)
+		assert.Nil(t, err)
+		assert.Len(t, temperatures, 1)
+	})
+	t.Run("RestoreCity", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		assert.Nil(t, s.CreateCity(city))
+		err := s.RestoreCity(&City{ID: city.ID})
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "no rows in result set")
+		assert.Nil(t, s.DeleteCity(&City{ID: city.ID}))
+		restored := &City{ID: city.ID}
+		assert.Nil(t, s.RestoreCity(restored))
+		assert.Equal(t, "Berlin", restored.Name)
+		assert.Nil(t, s.GetCity(&City{ID: city.ID}))
+	})
+	t.Run("ReuseNameOfDeletedCity", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		assert.Nil(t, s.CreateCity(city))
+		assert.Nil(t, s.DeleteCity(&City{ID: city.ID}))
+		reused := &City{Name: "Berlin", Latitude: 1, Longitude: 1}
+		assert.Nil(t, s.CreateCity(reused))
+		assert.Equal(t, ErrCityNameTaken, s.RestoreCity(&City{ID: city.ID}))
+		// names are unique among live cities
+		assert.NotNil(t, s.CreateCity(&City{Name: "Berlin", Latitude: 2, Longitude: 2}))
+		assert.Nil(t, s.DeleteCity(&City{ID: reused.ID}))
+		assert.Nil(t, s.RestoreCity(&City{ID: city.ID}))
+	})
+	t.Run("DeleteCityCascade", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		other := &City{Name: "Hamburg", Latitude: 53.55, Longitude: 9.99}
+		assert.Nil(t, s.CreateCity(city))
+		assert.Nil(t, s.CreateCity(other))
+		now := time.Now().Unix()
+		assert.Nil(t, s.CreateTemperature(&Temperature{CityID: city.ID, Max: 20, Min: 10, Timestamp: now}))
+		assert.Nil(t, s.CreateTemperature(&Temperature{CityID: other.ID, Max: 20, Min: 10, Timestamp: now}))
+		webhook := &Webhook{CityID: city.ID, CallbackURL: "https://my.service.com/first"}
+		kept := &Webhook{CityID: other.ID, CallbackURL: "https://my.service.com/second"}
+		assert.Nil(t, s.CreateWebhook(webhook))
+		assert.Nil(t, s.CreateWebhook(kept))
+		// soft deleted cities can still be removed for good
+		assert.Nil(t, s.DeleteCity(&City{ID: city.ID}))
+
+		deleted := &City{ID: city.ID}
+		removed, err := s.DeleteCityCascade(deleted)
+		assert.Nil(t, err)
+		assert.Equal(t, "Berlin", deleted.Name)
+		assert.Equal(t, []Webhook{*webhook}, removed)
+		temperatures, err := s.GetTemperatures(city.ID, 0)
+		assert.Nil(t, err)
+		assert.Empty(t, temperatures)
+		temperatures, err = s.GetTemperatures(other.ID, 0)
+		assert.Nil(t, err)
+		assert.Len(t, temperatures, 1)
+		webhooks, err := s.GetWebhooks()
+		assert.Nil(t, err)
+		assert.Equal(t, []Webhook{*kept}, webhooks)
+		assert.NotNil(t, s.RestoreCity(&City{ID: city.ID}))
+
+		_, err = s.DeleteCityCascade(&City{ID: city.ID})
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "no rows in result set")
+	})
+	t.Run("CreateTemperatureUnknownCity", func(t *testing.T) {
+		s := newStore(t)
+		assert.NotNil(t, s.CreateTemperature(&Temperature{CityID: 1000, Max: 20, Min: 10, Timestamp: time.Now().Unix()}))
+	})
+	t.Run("GetTemperatures", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		other := &City{Name: "Hamburg", Latitude: 53.55, Longitude: 9.99}
+		assert.Nil(t, s.CreateCity(city))
+		assert.Nil(t, s.CreateCity(other))
+		now := time.Now().Unix()
+		old := &Temperature{CityID: city.ID, Max: 1, Min: 0, Timestamp: now - 2*24*3600, ReceivedAt: now}
+		recent := &Temperature{CityID: city.ID, Max: 30, Min: 10, Timestamp: now - 3600, ReceivedAt: now}
+		elsewhere := &Temperature{CityID: other.ID, Max: 5, Min: 2, Timestamp: now}
+		for _, temp := range []*Temperature{old, recent, elsewhere} {
+			assert.Nil(t, s.CreateTemperature(temp))
+			assert.NotZero(t, temp.ID)
+		}
+		temperatures, err := s.GetTemperatures(city.ID, now-24*3600)
+		assert.Nil(t, err)
+		if assert.Len(t, temperatures, 1) {
+			assert.Equal(t, recent.ID, temperatures[0].ID)
+			assert.Equal(t, city.ID, temperatures[0].CityID)
+			assert.Equal(t, 30.0, temperatures[0].Max)
+			assert.Equal(t, 10.0, temperatures[0].Min)
+			assert.Equal(t, now-3600, temperatures[0].Timestamp)
+			assert.Equal(t, now, temperatures[0].ReceivedAt)
+		}
+	})
+	t.Run("ListTemperatures", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		other := &City{Name: "Hamburg", Latitude: 53.55, Longitude: 9.99}
+		assert.Nil(t, s.CreateCity(city))
+		assert.Nil(t, s.CreateCity(other))
+		// readings are stored out of measurement order, two share a timestamp
+		for _, timestamp := range []int64{1580000300, 1580000100, 1580000200, 1580000100, 1580000400} {
+			assert.Nil(t, s.CreateTemperature(&Temperature{CityID: city.ID, Max: 20, Min: 10, Timestamp: timestamp, ReceivedAt: 1580000500}))
+		}
+		assert.Nil(t, s.CreateTemperature(&Temperature{CityID: other.ID, Max: 20, Min: 10, Timestamp: 1580000100, ReceivedAt: 1580000500}))
+		ids := func(temperatures []Temperature) []int {
+			result := []int{}
+			for _, t := range temperatures {
+				result = append(result, t.ID)
+			}
+			return result
+		}
+
+		temperatures, err := s.ListTemperatures(TemperatureQuery{CityID: city.ID, Limit: 3})
+		assert.Nil(t, err)
+		assert.Equal(t, []int{2, 4, 3}, ids(temperatures))
+		assert.Equal(t, int64(1580000100), temperatures[1].Timestamp)
+		assert.Equal(t, int64(1580000500), temperatures[1].ReceivedAt)
+		temperatures, err = s.ListTemperatures(TemperatureQuery{CityID: city.ID, After: &temperatures[0], Limit: 3})
+		assert.Nil(t, err)
+		assert.Equal(t, []int{4, 3, 1}, ids(temperatures))
+
+		temperatures, err = s.ListTemperatures(TemperatureQuery{CityID: city.ID, From: 1580000200, To: 1580000400, Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, []int{3, 1}, ids(temperatures))
+		temperatures, err = s.ListTemperatures(TemperatureQuery{CityID: city.ID, From: 1580000500, Limit: 10})
+		assert.Nil(t, err)
+		assert.Empty(t, temperatures)
+	})
+	t.Run("AggregateTemperatures", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		other := &City{Name: "Hamburg", Latitude: 53.55, Longitude: 9.99}
+		assert.Nil(t, s.CreateCity(city))
+		assert.Nil(t, s.CreateCity(other))
+		now := time.Now().Unix()
+		for i, max := range []float64{30, 10, 20, 40} {
+			assert.Nil(t, s.CreateTemperature(&Temperature{CityID: city.ID, Max: max, Min: float64(i), Timestamp: now, ReceivedAt: now}))
+		}
+		assert.Nil(t, s.CreateTemperature(&Temperature{CityID: city.ID, Max: 100, Min: 100, Timestamp: now - 7200, ReceivedAt: now}))
+		assert.Nil(t, s.CreateTemperature(&Temperature{CityID: other.ID, Max: 100, Min: 100, Timestamp: now, ReceivedAt: now}))
+
+		expected := map[Aggregation][2]float32{
+			Mean:       {25, 1.5},
+			Median:     {25, 1.5},
+			P90:        {37, 2.7},
+			MinOfMins:  {10, 0},
+			MaxOfMaxes: {40, 3},
+			StdDev:     {11.18034, 1.118034},
+		}
+		for agg, values := range expected {
+			forecast, err := s.AggregateTemperatures(city.ID, now-3600, agg)
+			assert.Nil(t, err, agg)
+			assert.Equal(t, city.ID, forecast.CityID)
+			assert.Equal(t, 4, forecast.Sample, agg)
+			assert.InDelta(t, values[0], forecast.Max, 0.001, agg)
+			assert.InDelta(t, values[1], forecast.Min, 0.001, agg)
+		}
+
+		forecast, err := s.AggregateTemperatures(city.ID, now+3600, Median)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, forecast.Sample)
+		_, err = s.AggregateTemperatures(city.ID, now-3600, Aggregation("mode"))
+		assert.NotNil(t, err)
+	})
+	t.Run("AggregateCityTemperatures", func(t *testing.T) {
+		s := newStore(t)
+		berlin := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		hamburg := &City{Name: "Hamburg", Latitude: 53.55, Longitude: 9.99}
+		munich := &City{Name: "Munich", Latitude: 48.14, Longitude: 11.58}
+		deleted := &City{Name: "Bonn", Latitude: 50.73, Longitude: 7.1}
+		for _, c := range []*City{berlin, hamburg, munich, deleted} {
+			assert.Nil(t, s.CreateCity(c))
+		}
+		now := time.Now().Unix()
+		for i, max := range []float64{30, 10, 20, 40} {
+			assert.Nil(t, s.CreateTemperature(&Temperature{CityID: berlin.ID, Max: max, Min: float64(i), Timestamp: now, ReceivedAt: now}))
+		}
+		assert.Nil(t, s.CreateTemperature(&Temperature{CityID: berlin.ID, Max: 100, Min: 100, Timestamp: now - 7200, ReceivedAt: now}))
+		assert.Nil(t, s.CreateTemperature(&Temperature{CityID: hamburg.ID, Max: 15, Min: 5, Timestamp: now, ReceivedAt: now}))
+		assert.Nil(t, s.CreateTemperature(&Temperature{CityID: deleted.ID, Max: 15, Min: 5, Timestamp: now, ReceivedAt: now}))
+		assert.Nil(t, s.DeleteCity(deleted))
+
+		for _, agg := range Aggregations {
+			forecasts, err := s.AggregateCityTemperatures([]int{berlin.ID, hamburg.ID, munich.ID, deleted.ID, 99}, now-3600, agg)
+			assert.Nil(t, err, agg)
+			assert.Len(t, forecasts, 3, agg)
+			// the grouped forecasts agree with the forecasts of each city
+			for _, c := range []*City{berlin, hamburg, munich} {
+				expected, err := s.AggregateTemperatures(c.ID, now-3600, agg)
+				assert.Nil(t, err)
+				assert.Equal(t, c.ID, forecasts[c.ID].CityID, agg)
+				assert.Equal(t, expected.Sample, forecasts[c.ID].Sample, agg)
+				assert.InDelta(t, expected.Max, forecasts[c.ID].Max, 0.001, agg)
+				assert.InDelta(t, expected.Min, forecasts[c.ID].Min, 0.001, agg)
+			}
+		}
+
+		all := meanForecasts(t, s, nil, now-3600)
+		assert.Len(t, all, 3)
+		assert.Equal(t, 4, all[berlin.ID].Sample)
+		assert.Equal(t, 1, all[hamburg.ID].Sample)
+		assert.Equal(t, 0, all[munich.ID].Sample)
+		assert.Len(t, meanForecasts(t, s, []int{}, now-3600), 0)
+		_, err := s.AggregateCityTemperatures(nil, now-3600, Aggregation("mode"))
+		assert.NotNil(t, err)
+	})
+	t.Run("ListRollups", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		other := &City{Name: "Hamburg", Latitude: 53.55, Longitude: 9.99}
+		assert.Nil(t, s.CreateCity(city))
+		assert.Nil(t, s.CreateCity(other))
+		// 1579996800 is midnight UTC
+		day := int64(1579996800)
+		assert.Nil(t, s.CreateTemperature(&Temperature{CityID: city.ID, Max: 20, Min: 10, Timestamp: day + 600}))
+		assert.Nil(t, s.CreateTemperatures([]*Temperature{
+			{CityID: city.ID, Max: 30, Min: 5, Timestamp: day + 3000},
+			{CityID: city.ID, Max: 25, Min: 15, Timestamp: day + 7200},
+			{CityID: city.ID, Max: 10, Min: 0, Timestamp: day + 86400},
+			{CityID: other.ID, Max: 99, Min: 99, Timestamp: day},
+		}))
+
+		rollups, err := s.ListRollups(city.ID, 3600, day, day+2*86400)
+		assert.Nil(t, err)
+		assert.Equal(t, []Rollup{
+			{Start: day, Count: 2, Min: 5, Max: 30, AvgMax: 25, AvgMin: 7.5},
+			{Start: day + 7200, Count: 1, Min: 15, Max: 25, AvgMax: 25, AvgMin: 15},
+			{Start: day + 86400, Count: 1, Min: 0, Max: 10, AvgMax: 10, AvgMin: 0},
+		}, rollups)
+		rollups, err = s.ListRollups(city.ID, 86400, day, day+2*86400)
+		assert.Nil(t, err)
+		assert.Equal(t, []Rollup{
+			{Start: day, Count: 3, Min: 5, Max: 30, AvgMax: 25, AvgMin: 10},
+			{Start: day + 86400, Count: 1, Min: 0, Max: 10, AvgMax: 10, AvgMin: 0},
+		}, rollups)
+		// the range is widened to whole buckets, which are aligned to the epoch
+		rollups, err = s.ListRollups(city.ID, 2*86400, day+3600, day+3601)
+		assert.Nil(t, err)
+		if assert.Len(t, rollups, 1) {
+			assert.Equal(t, day-86400, rollups[0].Start)
+			assert.Equal(t, 3, rollups[0].Count)
+		}
+		rollups, err = s.ListRollups(city.ID, 6*3600, day+86400, day+2*86400)
+		assert.Nil(t, err)
+		assert.Equal(t, []Rollup{{Start: day + 86400, Count: 1, Min: 0, Max: 10, AvgMax: 10, AvgMin: 0}}, rollups)
+
+		_, err = s.ListRollups(city.ID, 1800, day, day+86400)
+		assert.NotNil(t, err)
+
+		_, err = s.DeleteCityCascade(&City{ID: city.ID})
+		assert.Nil(t, err)
+		rollups, err = s.ListRollups(city.ID, 3600, day, day+2*86400)
+		assert.Nil(t, err)
+		assert.Empty(t, rollups)
+	})
+	t.Run("CreateTemperatures", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		assert.Nil(t, s.CreateCity(city))
+		assert.Nil(t, s.CreateTemperature(&Temperature{CityID: city.ID, Max: 1, Min: 0, Timestamp: 1, ReceivedAt: 1}))
+		now := time.Now().Unix()
+		batch := []*Temperature{}
+		for i := 0; i < 250; i++ {
+			batch = append(batch, &Temperature{CityID: city.ID, Max: float64(i), Min: float64(-i), Timestamp: now - int64(i), ReceivedAt: now})
+		}
+		assert.Nil(t, s.CreateTemperatures(batch))
+		temperatures, err := s.GetTemperatures(city.ID, now-1000)
+		assert.Nil(t, err)
+		if assert.Len(t, temperatures, 250) {
+			stored := map[int]Temperature{}
+			for _, temp := range temperatures {
+				stored[temp.ID] = temp
+			}
+			for _, temp := range batch {
+				assert.Equal(t, *temp, stored[temp.ID])
+			}
+		}
+	})
+	t.Run("CreateTemperaturesUnknownCity", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		assert.Nil(t, s.CreateCity(city))
+		now := time.Now().Unix()
+		batch := []*Temperature{
+			{CityID: city.ID, Max: 20, Min: 10, Timestamp: now, ReceivedAt: now},
+			{CityID: 1000, Max: 20, Min: 10, Timestamp: now, ReceivedAt: now},
+		}
+		assert.NotNil(t, s.CreateTemperatures(batch))
+		temperatures, err := s.GetTemperatures(city.ID, 0)
+		assert.Nil(t, err)
+		assert.Empty(t, temperatures)
+	})
+	t.Run("Webhooks", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		assert.Nil(t, s.CreateCity(city))
+		first := &Webhook{CityID: city.ID, CallbackURL: "https://my.service.com/first"}
+		second := &Webhook{CityID: city.ID, CallbackURL: "https://my.service.com/second"}
+		assert.Nil(t, s.CreateWebhook(first))
+		assert.Nil(t, s.CreateWebhook(second))
+		webhooks, err := s.GetWebhooks()
+		assert.Nil(t, err)
+		assert.Equal(t, []Webhook{*first, *second}, webhooks)
+
+		deleted := &Webhook{ID: first.ID}
+		assert.Nil(t, s.DeleteWebhook(deleted))
+		assert.Equal(t, *first, *deleted)
+		webhooks, err = s.GetWebhooks()
+		assert.Nil(t, err)
+		assert.Equal(t, []Webhook{*second}, webhooks)
+	})
+	t.Run("Outbox", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		other := &City{Name: "Hamburg", Latitude: 53.55, Longitude: 9.99}
+		assert.Nil(t, s.CreateCity(city))
+		assert.Nil(t, s.CreateCity(other))
+		first := &Webhook{CityID: city.ID, CallbackURL: "https://my.service.com/first"}
+		second := &Webhook{CityID: city.ID, CallbackURL: "https://my.service.com/second", Unit: Fahrenheit}
+		assert.Nil(t, s.CreateWebhook(first))
+		assert.Nil(t, s.CreateWebhook(second))
+		temperature := &Temperature{CityID: city.ID, Max: 20.5, Min: 10, Timestamp: 1580000000, ReceivedAt: 1580000060}
+		assert.Nil(t, s.CreateTemperature(temperature))
+		// readings of cities without webhooks aren't delivered
+		assert.Nil(t, s.CreateTemperature(&Temperature{CityID: other.ID, Max: 20, Min: 10, Timestamp: 1580000000, ReceivedAt: 1580000060}))
+		batch := []*Temperature{{CityID: city.ID, Max: 21, Min: 11, Timestamp: 1580000100, ReceivedAt: 1580000160}}
+		assert.Nil(t, s.CreateTemperatures(batch))
+
+		entries, err := s.ClaimOutbox(1000, 1060, 3)
+		assert.Nil(t, err)
+		if assert.Len(t, entries, 3) {
+			assert.Equal(t, *first, entries[0].Webhook)
+			assert.Equal(t, *temperature, entries[0].Temperature)
+			assert.Equal(t, *second, entries[1].Webhook)
+			assert.Equal(t, temperature.ID, entries[1].Temperature.ID)
+			assert.Equal(t, *first, entries[2].Webhook)
+			assert.Equal(t, batch[0].ID, entries[2].Temperature.ID)
+		}
+		// claimed deliveries are left out until their claim ends
+		last, err := s.ClaimOutbox(1000, 1060, 10)
+		assert.Nil(t, err)
+		if assert.Len(t, last, 1) {
+			assert.Equal(t, *second, last[0].Webhook)
+			assert.Equal(t, batch[0].ID, last[0].Temperature.ID)
+		}
+		for _, e := range entries[:2] {
+			assert.Nil(t, s.CompleteOutbox(e.ID))
+		}
+		rest, err := s.ClaimOutbox(1030, 1090, 10)
+		assert.Nil(t, err)
+		assert.Empty(t, rest)
+		rest, err = s.ClaimOutbox(1061, 1120, 10)
+		assert.Nil(t, err)
+		if assert.Len(t, rest, 2) {
+			assert.Equal(t, entries[2].ID, rest[0].ID)
+			assert.Equal(t, last[0].ID, rest[1].ID)
+		}
+
+		// deleting a webhook or its city drops its deliveries
+		assert.Nil(t, s.DeleteWebhook(&Webhook{ID: second.ID}))
+		_, err = s.DeleteCityCascade(&City{ID: city.ID})
+		assert.Nil(t, err)
+		rest, err = s.ClaimOutbox(2000, 2060, 10)
+		assert.Nil(t, err)
+		assert.Empty(t, rest)
+	})
+	t.Run("ExtendOutboxClaim", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		assert.Nil(t, s.CreateCity(city))
+		assert.Nil(t, s.CreateWebhook(&Webhook{CityID: city.ID, CallbackURL: "https://my.service.com/first"}))
+		assert.Nil(t, s.CreateWebhook(&Webhook{CityID: city.ID, CallbackURL: "https://my.service.com/second"}))
+		assert.Nil(t, s.CreateTemperature(&Temperature{CityID: city.ID, Max: 20, Min: 10, Timestamp: 1580000000, ReceivedAt: 1580000060}))
+		entries, err := s.ClaimOutbox(1000, 1060, 10)
+		assert.Nil(t, err)
+		assert.Len(t, entries, 2)
+		assert.Nil(t, s.ExtendOutboxClaim(nil, 1200))
+		assert.Nil(t, s.ExtendOutboxClaim([]int{entries[0].ID}, 1200))
+		// only the delivery whose claim wasn't extended is claimed again
+		rest, err := s.ClaimOutbox(1061, 1120, 10)
+		assert.Nil(t, err)
+		if assert.Len(t, rest, 1) {
+			assert.Equal(t, entries[1].ID, rest[0].ID)
+		}
+		rest, err = s.ClaimOutbox(1200, 1260, 10)
+		assert.Nil(t, err)
+		if assert.Len(t, rest, 1) {
+			assert.Equal(t, entries[1].ID, rest[0].ID)
+		}
+		rest, err = s.ClaimOutbox(1201, 1260, 10)
+		assert.Nil(t, err)
+		if assert.Len(t, rest, 1) {
+			assert.Equal(t, entries[0].ID, rest[0].ID)
+		}
+	})
+	t.Run("WebhookSecrets", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		assert.Nil(t, s.CreateCity(city))
+		webhook := &Webhook{CityID: city.ID, CallbackURL: "https://my.service.com/first", Secret: "first"}
+		assert.Nil(t, s.CreateWebhook(webhook))
+		// secrets are only read with the deliveries
+		webhooks, err := s.GetWebhooks()
+		assert.Nil(t, err)
+		assert.Equal(t, []Webhook{{ID: webhook.ID, CityID: city.ID, CallbackURL: webhook.CallbackURL, Unit: Celsius}}, webhooks)
+
+		rotated := &Webhook{ID: webhook.ID}
+		assert.Nil(t, s.RotateWebhookSecret(rotated, "second", 1100))
+		assert.Equal(t, Webhook{ID: webhook.ID, CityID: city.ID, CallbackURL: webhook.CallbackURL, Unit: Celsius, Secret: "second", PreviousSecretExpiresAt: 1100}, *rotated)
+		assert.Nil(t, s.CreateTemperature(&Temperature{CityID: city.ID, Max: 20, Min: 10, Timestamp: 1580000000, ReceivedAt: 1580000060}))
+		entries, err := s.ClaimOutbox(1000, 1060, 10)
+		assert.Nil(t, err)
+		if assert.Len(t, entries, 1) {
+			assert.Equal(t, "second", entries[0].Webhook.Secret)
+			assert.Equal(t, "first", entries[0].Webhook.PreviousSecret)
+			assert.Equal(t, []string{"second", "first"}, entries[0].Webhook.Secrets(1099))
+			assert.Equal(t, []string{"second"}, entries[0].Webhook.Secrets(1100))
+		}
+
+		err = s.RotateWebhookSecret(&Webhook{ID: 1000}, "third", 1100)
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "no rows in result set")
+	})
+	t.Run("RotateWebhookWithoutSecret", func(t *testing.T) {
+		s := newStore(t)
+		city := &City{Name: "Berlin", Latitude: 52.52, Longitude: 13.405}
+		assert.Nil(t, s.CreateCity(city))
+		webhook := &Webhook{CityID: city.ID, CallbackURL: "https://my.service.com/first"}
+		assert.Nil(t, s.CreateWebhook(webhook))
+		// there is no secret to keep when a webhook gets its first one
+		rotated := &Webhook{ID: webhook.ID}
+		assert.Nil(t, s.RotateWebhookSecret(rotated, "first", 1100))
+		assert.Equal(t, "first", rotated.Secret)
+		assert.Zero(t, rotated.PreviousSecretExpiresAt)
+	})
+	t.Run("Deliveries", func(t *testing.T) {
+		s := newStore(t)
+		attempts := []*Delivery{
+			{WebhookID: 1, TemperatureID: 5, Attempt: 1, Status: DeliveryFailed, StatusCode: 503, Latency: 120, Response: "busy", Error: "responded with status 503", CreatedAt: 1000},
+			{WebhookID: 2, TemperatureID: 5, Attempt: 1, Status: DeliverySucceeded, StatusCode: 200, Latency: 30, Response: `{"ok":true}`, CreatedAt: 1000},
+			{WebhookID: 1, TemperatureID: 5, Attempt: 2, Status: DeliveryFailed, Latency: 10000, Error: "timeout", CreatedAt: 1002},
+			{WebhookID: 1, TemperatureID: 5, Attempt: 3, Status: DeliverySucceeded, StatusCode: 204, Latency: 40, CreatedAt: 1006},
+		}
+		for _, d := range attempts {
+			assert.Nil(t, s.RecordDelivery(d))
+		}
+		deliveries, err := s.ListDeliveries(DeliveryQuery{WebhookID: 1, Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, []Delivery{*attempts[3], *attempts[2], *attempts[0]}, deliveries)
+
+		deliveries, err = s.ListDeliveries(DeliveryQuery{WebhookID: 1, Status: DeliveryFailed, Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, []Delivery{*attempts[2], *attempts[0]}, deliveries)
+		deliveries, err = s.ListDeliveries(DeliveryQuery{WebhookID: 1, StatusCode: 503, Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, []Delivery{*attempts[0]}, deliveries)
+		// pages follow each other
+		deliveries, err = s.ListDeliveries(DeliveryQuery{WebhookID: 1, Limit: 2})
+		assert.Nil(t, err)
+		assert.Equal(t, []Delivery{*attempts[3], *attempts[2]}, deliveries)
+		deliveries, err = s.ListDeliveries(DeliveryQuery{WebhookID: 1, Before: attempts[2].ID, Limit: 2})
+		assert.Nil(t, err)
+		assert.Equal(t, []Delivery{*attempts[0]}, deliveries)
+
+		pruned, err := s.PruneDeliveries(1002)
+		assert.Nil(t, err)
+		assert.EqualValues(t, 2, pruned)
+		deliveries, err = s.ListDeliveries(DeliveryQuery{WebhookID: 1, Limit: 10})
+		assert.Nil(t, err)
+		assert.Equal(t, []Delivery{*attempts[3], *attempts[2]}, deliveries)
+		deliveries, err = s.ListDeliveries(DeliveryQuery{WebhookID: 2, Limit: 10})
+		assert.Nil(t, err)
+		assert.Empty(t, deliveries)
+	})
+	t.Run("CreateWebhookUnknownCity", func(t *testing.T) {
+		s := newStore(t)
+		assert.NotNil(t, s.CreateWebhook(&Webhook{CityID: 1000, CallbackURL: "https://my.service.com/first"}))
+	})
+	t.Run("DeleteWebhookNotExisting", func(t *testing.T) {
+		s := newStore(t)
+		err := s.DeleteWebhook(&Webhook{ID: 1000})
+		assert.NotNil(t, err)
+		assert.Contains(t, err.Error(), "no rows in result set")
+	})
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		return NewMemoryStore()
+	})
+}
+
+func TestMySQLStore(t *testing.T) {
+	dsn := os.Getenv("MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("MYSQL_DSN not set, skipping MySQL store tests")
+	}
+	db, err := Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a database connection", err)
+	}
+	defer db.Close()
+	m, err := NewMigrator(db, "mysql")
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when loading migrations", err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatalf("an error '%s' was not expected when migrating", err)
+	}
+	testStore(t, func(t *testing.T) Store {
+		for _, table := range []string{"webhook_deliveries", "webhook_outbox", "webhooks", "temperature_rollups", "temperatures", "cities"} {
+			if _, err := db.Exec("DELETE FROM " + table); err != nil {
+				t.Fatalf("an error '%s' was not expected when emptying %s", err, table)
+			}
+		}
+		return NewMySQLStore(db)
+	})
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testStore(t, func(t *testing.T) Store {
+		db, err := Open("sqlite", ":memory:")
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a database", err)
+		}
+		t.Cleanup(func() { db.Close() })
+		m, err := NewMigrator(db, "sqlite")
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when loading migrations", err)
+		}
+		if _, err := m.Up(); err != nil {
+			t.Fatalf("an error '%s' was not expected when migrating", err)
+		}
+		return NewSQLiteStore(db)
+	})
+}
+
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_DSN not set, skipping Postgres store tests")
+	}
+	db, err := Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a database connection", err)
+	}
+	defer db.Close()
+	m, err := NewMigrator(db, "postgres")
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when loading migrations", err)
+	}
+	if _, err := m.Up(); err != nil {
+		t.Fatalf("an error '%s' was not expected when migrating", err)
+	}
+	testStore(t, func(t *testing.T) Store {
+		if _, err := db.Exec("TRUNCATE webhook_deliveries, webhook_outbox, webhooks, temperature_rollups, temperatures, cities RESTART IDENTITY"); err != nil {
+			t.Fatalf("an error '%s' was not expected when emptying tables", err)
+		}
+		return NewPostgresStore(db)
+	})
+}
+
+// meanForecasts returns the mean forecasts of cityIDs
+func meanForecasts(t *testing.T, s Store, cityIDs []int, from int64) map[int]Forecast {
+	forecasts, err := s.AggregateCityTemperatures(cityIDs, from, Mean)
+	assert.Nil(t, err)
+	return forecasts
+}
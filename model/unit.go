@@ -0,0 +1,106 @@
+package model
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Unit is a temperature scale. Temperatures are stored in Celsius and
+// converted when they are received and returned.
+type Unit string
+
+const (
+	Celsius    Unit = "C"
+	Fahrenheit Unit = "F"
+	Kelvin     Unit = "K"
+)
+
+// Precision is the number of decimals temperatures are returned with
+const Precision = 2
+
+// absoluteZero is the lowest temperature in Celsius
+const absoluteZero = -273.15
+
+// ParseUnit returns the Unit named by its symbol or its name, in any case
+func ParseUnit(name string) (Unit, error) {
+	switch strings.ToLower(name) {
+	case "c", "celsius":
+		return Celsius, nil
+	case "f", "fahrenheit":
+		return Fahrenheit, nil
+	case "k", "kelvin":
+		return Kelvin, nil
+	}
+	return "", fmt.Errorf("Unsupported unit '%s'", name)
+}
+
+// ToCelsius converts a temperature in u to Celsius
+func (u Unit) ToCelsius(value float64) float64 {
+	switch u {
+	case Fahrenheit:
+		return (value - 32) * 5 / 9
+	case Kelvin:
+		return value + absoluteZero
+	}
+	return value
+}
+
+// FromCelsius converts a temperature in Celsius to u
+func (u Unit) FromCelsius(value float64) float64 {
+	switch u {
+	case Fahrenheit:
+		return value*9/5 + 32
+	case Kelvin:
+		return value - absoluteZero
+	}
+	return value
+}
+
+// scale converts a difference of temperatures in Celsius to u
+func (u Unit) scale(delta float64) float64 {
+	if u == Fahrenheit {
+		return delta * 9 / 5
+	}
+	return delta
+}
+
+// CheckCelsius reports a temperature in Celsius below absolute zero
+func CheckCelsius(value float64) error {
+	if value < absoluteZero {
+		return fmt.Errorf("must not be below absolute zero (%v C)", absoluteZero)
+	}
+	return nil
+}
+
+// Round rounds value to Precision decimals
+func Round(value float64) float64 {
+	p := math.Pow10(Precision)
+	return math.Round(value*p) / p
+}
+
+// In returns t, read in Celsius, converted to unit
+func (t Temperature) In(unit Unit) Temperature {
+	t.Max, t.Min = Round(unit.FromCelsius(t.Max)), Round(unit.FromCelsius(t.Min))
+	t.Unit = unit
+	return t
+}
+
+// In returns f, summarized in Celsius, converted to unit. A standard
+// deviation is a difference and only scaled.
+func (f Forecast) In(unit Unit) Forecast {
+	convert := unit.FromCelsius
+	if f.Aggregation == StdDev {
+		convert = unit.scale
+	}
+	f.Max, f.Min = Round(convert(f.Max)), Round(convert(f.Min))
+	f.Unit = unit
+	return f
+}
+
+// In returns r, summarized in Celsius, converted to unit
+func (r Rollup) In(unit Unit) Rollup {
+	r.Min, r.Max = Round(unit.FromCelsius(r.Min)), Round(unit.FromCelsius(r.Max))
+	r.AvgMax, r.AvgMin = Round(unit.FromCelsius(r.AvgMax)), Round(unit.FromCelsius(r.AvgMin))
+	return r
+}
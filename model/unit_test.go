@@ -0,0 +1,47 @@
+package model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseUnit(t *testing.T) {
+	for name, unit := range map[string]Unit{"C": Celsius, "celsius": Celsius, "f": Fahrenheit, "Fahrenheit": Fahrenheit, "K": Kelvin, "KELVIN": Kelvin} {
+		parsed, err := ParseUnit(name)
+		assert.Nil(t, err)
+		assert.Equal(t, unit, parsed)
+	}
+	_, err := ParseUnit("R")
+	assert.NotNil(t, err)
+	_, err = ParseUnit("")
+	assert.NotNil(t, err)
+}
+
+func TestUnitConversions(t *testing.T) {
+	assert.InDelta(t, 212, Fahrenheit.FromCelsius(100), 1e-9)
+	assert.InDelta(t, 100, Fahrenheit.ToCelsius(212), 1e-9)
+	assert.InDelta(t, -40, Fahrenheit.ToCelsius(-40), 1e-9)
+	assert.InDelta(t, 273.15, Kelvin.FromCelsius(0), 1e-9)
+	assert.InDelta(t, 0, Kelvin.ToCelsius(273.15), 1e-9)
+	assert.Equal(t, 21.5, Celsius.ToCelsius(21.5))
+	assert.Nil(t, CheckCelsius(absoluteZero))
+	assert.NotNil(t, CheckCelsius(Kelvin.ToCelsius(-1)))
+}
+
+func TestIn(t *testing.T) {
+	temperature := Temperature{CityID: 1, Max: 21.123, Min: -3.3333, Timestamp: 1580000000}
+	assert.Equal(t, Temperature{CityID: 1, Max: 21.12, Min: -3.33, Unit: Celsius, Timestamp: 1580000000}, temperature.In(Celsius))
+	assert.Equal(t, Temperature{CityID: 1, Max: 70.02, Min: 26, Unit: Fahrenheit, Timestamp: 1580000000}, temperature.In(Fahrenheit))
+	assert.Equal(t, Temperature{CityID: 1, Max: 294.27, Min: 269.82, Unit: Kelvin, Timestamp: 1580000000}, temperature.In(Kelvin))
+
+	// a standard deviation is a spread, not a temperature
+	forecast := Forecast{Max: 10, Min: 2, Sample: 3, Aggregation: StdDev}
+	assert.Equal(t, Forecast{Max: 18, Min: 3.6, Unit: Fahrenheit, Sample: 3, Aggregation: StdDev}, forecast.In(Fahrenheit))
+	assert.Equal(t, Forecast{Max: 10, Min: 2, Unit: Kelvin, Sample: 3, Aggregation: StdDev}, forecast.In(Kelvin))
+	forecast.Aggregation = Mean
+	assert.Equal(t, Forecast{Max: 50, Min: 35.6, Unit: Fahrenheit, Sample: 3, Aggregation: Mean}, forecast.In(Fahrenheit))
+
+	rollup := Rollup{Count: 2, Min: 0, Max: 10, AvgMax: 5, AvgMin: 1}
+	assert.Equal(t, Rollup{Count: 2, Min: 32, Max: 50, AvgMax: 41, AvgMin: 33.8}, rollup.In(Fahrenheit))
+}
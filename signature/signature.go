@@ -0,0 +1,134 @@
+// Package signature signs webhook deliveries and verifies them. A delivery
+// carries the header
+//
+//	X-Signature: t=1580000000,v1=5257a869e7ecebeda32affa62cdca3fa51cad7e77a0e56ff536d0ce8e108d8bd
+//
+// where t is the unix time the delivery was signed at and v1 is the hex
+// encoded HMAC-SHA256 of the timestamp, a dot and the body. While the secret
+// of a webhook is rotated the delivery carries a v1 for each of its secrets,
+// so a receiver knowing either of them accepts it.
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header is the header deliveries are signed in
+const Header = "X-Signature"
+
+// DefaultTolerance is how old a signature Verify accepts by default
+const DefaultTolerance = 5 * time.Minute
+
+var (
+	// ErrMissing is returned when a delivery isn't signed
+	ErrMissing = errors.New("Missing signature")
+	// ErrMalformed is returned when the signature header can't be parsed
+	ErrMalformed = errors.New("Malformed signature")
+	// ErrExpired is returned when a delivery was signed too long ago, or in
+	// the future
+	ErrExpired = errors.New("Signature timestamp outside of the tolerance")
+	// ErrMismatch is returned when no signature matches a secret
+	ErrMismatch = errors.New("Signature doesn't match")
+)
+
+// NewSecret returns a random secret to sign deliveries with
+func NewSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Sign returns the signature header of body signed at with each of secrets
+func Sign(body []byte, at time.Time, secrets ...string) string {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	header := "t=" + timestamp
+	for _, secret := range secrets {
+		header += ",v1=" + hex.EncodeToString(mac(secret, timestamp, body))
+	}
+	return header
+}
+
+func mac(secret, timestamp string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
+
+// Verify checks that header signs body with one of secrets, no longer than
+// tolerance ago. A zero tolerance is DefaultTolerance.
+func Verify(header string, body []byte, tolerance time.Duration, secrets ...string) error {
+	return verify(header, body, tolerance, time.Now(), secrets)
+}
+
+func verify(header string, body []byte, tolerance time.Duration, now time.Time, secrets []string) error {
+	if header == "" {
+		return ErrMissing
+	}
+	if tolerance <= 0 {
+		tolerance = DefaultTolerance
+	}
+	var timestamp string
+	signatures := [][]byte{}
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return ErrMalformed
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signature, err := hex.DecodeString(kv[1])
+			if err != nil {
+				return ErrMalformed
+			}
+			signatures = append(signatures, signature)
+		}
+		// other schemes are skipped so that new ones can be added
+	}
+	at, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return ErrMalformed
+	}
+	if age := now.Sub(time.Unix(at, 0)); age > tolerance || age < -tolerance {
+		return ErrExpired
+	}
+	for _, secret := range secrets {
+		expected := mac(secret, timestamp, body)
+		for _, signature := range signatures {
+			if hmac.Equal(expected, signature) {
+				return nil
+			}
+		}
+	}
+	return ErrMismatch
+}
+
+// VerifyRequest verifies the delivery r with Verify and returns its body. The
+// body of r is read and can be read again.
+func VerifyRequest(r *http.Request, tolerance time.Duration, secrets ...string) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if err := Verify(r.Header.Get(Header), body, tolerance, secrets...); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
@@ -0,0 +1,80 @@
+package signature
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var body = []byte(`{"city_id":1,"max":30,"min":10}`)
+
+func TestSign(t *testing.T) {
+	at := time.Unix(1580000000, 0)
+	header := Sign(body, at, "secret")
+	assert.Regexp(t, "^t=1580000000,v1=[0-9a-f]{64}$", header)
+	assert.Equal(t, header, Sign(body, at, "secret"))
+	assert.NotEqual(t, header, Sign(body, at.Add(time.Second), "secret"))
+	assert.NotEqual(t, header, Sign([]byte(`{}`), at, "secret"))
+	assert.Equal(t, "t=1580000000", Sign(body, at))
+}
+
+func TestVerify(t *testing.T) {
+	at := time.Unix(1580000000, 0)
+	header := Sign(body, at, "secret")
+	assert.Nil(t, verify(header, body, 0, at.Add(time.Minute), []string{"secret"}))
+	assert.Nil(t, verify(header, body, 0, at.Add(-time.Minute), []string{"other", "secret"}))
+
+	assert.Equal(t, ErrMismatch, verify(header, body, 0, at, []string{"other"}))
+	assert.Equal(t, ErrMismatch, verify(header, []byte(`{}`), 0, at, []string{"secret"}))
+	// the timestamp is signed too
+	replayed := "t=1580000100" + header[len("t=1580000000"):]
+	assert.Equal(t, ErrMismatch, verify(replayed, body, 0, at, []string{"secret"}))
+
+	assert.Equal(t, ErrExpired, verify(header, body, 0, at.Add(DefaultTolerance+time.Second), []string{"secret"}))
+	assert.Equal(t, ErrExpired, verify(header, body, 0, at.Add(-DefaultTolerance-time.Second), []string{"secret"}))
+	assert.Nil(t, verify(header, body, time.Hour, at.Add(DefaultTolerance+time.Second), []string{"secret"}))
+
+	assert.Equal(t, ErrMissing, verify("", body, 0, at, []string{"secret"}))
+	for _, malformed := range []string{"t=1580000000", "v1=abcd", "t=now,v1=abcd", "t=1580000000,v1=xyz", "t=1580000000;v1=abcd"} {
+		assert.Equal(t, ErrMalformed, verify(malformed, body, 0, at, []string{"secret"}), malformed)
+	}
+}
+
+func TestVerifyDuringRotation(t *testing.T) {
+	at := time.Unix(1580000000, 0)
+	header := Sign(body, at, "new", "old")
+	// receivers that know either secret accept the delivery
+	assert.Nil(t, verify(header, body, 0, at, []string{"old"}))
+	assert.Nil(t, verify(header, body, 0, at, []string{"new"}))
+	assert.Equal(t, ErrMismatch, verify(header, body, 0, at, []string{"other"}))
+	// unknown schemes are skipped
+	assert.Nil(t, verify(header+",v0=whatever", body, 0, at, []string{"new"}))
+}
+
+func TestVerifyRequest(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/high-temperature", bytes.NewReader(body))
+	req.Header.Set(Header, Sign(body, time.Now(), "secret"))
+	verified, err := VerifyRequest(req, 0, "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, body, verified)
+	// the body can still be read by the handler
+	read, _ := ioutil.ReadAll(req.Body)
+	assert.Equal(t, body, read)
+
+	req, _ = http.NewRequest("POST", "/high-temperature", bytes.NewReader(body))
+	_, err = VerifyRequest(req, 0, "secret")
+	assert.Equal(t, ErrMissing, err)
+}
+
+func TestNewSecret(t *testing.T) {
+	first, err := NewSecret()
+	assert.Nil(t, err)
+	assert.Len(t, first, 64)
+	second, err := NewSecret()
+	assert.Nil(t, err)
+	assert.NotEqual(t, first, second)
+}